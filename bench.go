@@ -0,0 +1,164 @@
+/*
+	MIT License
+
+	Copyright (c) 2020 Operator Foundation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in all
+	copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+type benchResult struct {
+	dialTime time.Duration
+	err      error
+}
+
+// benchCommand opens connections through a transport and sends data over
+// them. The server's target must either discard the data, or echo it back
+// when -echo is used.
+func benchCommand(arguments []string) {
+	flags := newCommandFlags("bench", "-transport [transport] -optionsFile [client config]")
+	clientFlags := defineClientFlags(flags)
+	connections := flags.Int("connections", 10, "Number of connections to open")
+	concurrency := flags.Int("concurrency", 1, "Number of connections to run at the same time")
+	byteCount := flags.Int64("bytes", 1024*1024, "Number of bytes to send on each connection")
+	echo := flags.Bool("echo", false, "Read the data back from the connection, for servers whose target echoes")
+	_ = flags.Parse(arguments)
+
+	golog.SetLevel("disable")
+
+	if *connections < 1 || *concurrency < 1 || *byteCount < 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "-connections and -concurrency must be at least 1 and -bytes cannot be negative")
+		os.Exit(2)
+	}
+
+	results := make([]benchResult, *connections)
+	next := make(chan int)
+	var waitGroup sync.WaitGroup
+
+	start := time.Now()
+	for worker := 0; worker < *concurrency; worker++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for index := range next {
+				results[index] = benchConnection(clientFlags, *byteCount, *echo)
+			}
+		}()
+	}
+	for index := range results {
+		next <- index
+	}
+	close(next)
+	waitGroup.Wait()
+	elapsed := time.Since(start)
+
+	var dialTimes []time.Duration
+	var transferred int64
+	for index, result := range results {
+		if result.err != nil {
+			fmt.Printf("%d: %s\n", index+1, result.err.Error())
+			continue
+		}
+
+		dialTimes = append(dialTimes, result.dialTime)
+		transferred += *byteCount
+	}
+
+	fmt.Printf("%d of %d connections succeeded in %s\n", len(dialTimes), len(results), elapsed.Round(time.Millisecond))
+	if len(dialTimes) == 0 {
+		os.Exit(1)
+	}
+
+	sort.Slice(dialTimes, func(i, j int) bool { return dialTimes[i] < dialTimes[j] })
+	var total time.Duration
+	for _, dialTime := range dialTimes {
+		total += dialTime
+	}
+	fmt.Printf("connection time: min %s, median %s, max %s, mean %s\n",
+		dialTimes[0].Round(time.Millisecond),
+		dialTimes[len(dialTimes)/2].Round(time.Millisecond),
+		dialTimes[len(dialTimes)-1].Round(time.Millisecond),
+		(total / time.Duration(len(dialTimes))).Round(time.Millisecond))
+
+	if *echo {
+		transferred *= 2
+	}
+	fmt.Printf("transferred %d bytes, %.2f MB/s\n", transferred, float64(transferred)/elapsed.Seconds()/1e6)
+}
+
+func benchConnection(clientFlags *clientFlags, byteCount int64, echo bool) benchResult {
+	var result benchResult
+
+	start := time.Now()
+	conn, err := clientFlags.dial()
+	result.dialTime = time.Since(start)
+	if err != nil {
+		result.err = fmt.Errorf("failed to connect: %s", err.Error())
+		return result
+	}
+	defer conn.Close()
+
+	if *clientFlags.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(*clientFlags.timeout))
+	}
+
+	readErrors := make(chan error, 1)
+	if echo {
+		go func() {
+			_, readError := io.CopyN(io.Discard, conn, byteCount)
+			readErrors <- readError
+		}()
+	} else {
+		readErrors <- nil
+	}
+
+	if _, writeError := io.CopyN(conn, zeroReader{}, byteCount); writeError != nil {
+		result.err = fmt.Errorf("failed to send: %s", writeError.Error())
+		return result
+	}
+
+	if readError := <-readErrors; readError != nil {
+		result.err = fmt.Errorf("failed to read the echo: %s", readError.Error())
+		return result
+	}
+
+	return result
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(buffer []byte) (int, error) {
+	for index := range buffer {
+		buffer[index] = 0
+	}
+
+	return len(buffer), nil
+}
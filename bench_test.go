@@ -0,0 +1,100 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchServer accepts connections and passes what it reads from each of them
+// to handle.
+func benchServer(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// TestBenchConnection tests a bench connection with and without echo, with no
+// timeout, which must not cut the connection off, and with a timeout that a
+// server which never echoes runs into.
+func TestBenchConnection(t *testing.T) {
+	echoing := benchServer(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	silent := benchServer(t, func(conn net.Conn) { _, _ = io.Copy(io.Discard, conn) })
+
+	tests := []struct {
+		server  string
+		timeout string
+		echo    bool
+		err     string
+	}{
+		{echoing, "0", true, ""},
+		{echoing, "0", false, ""},
+		{echoing, "5s", true, ""},
+		{silent, "5s", false, ""},
+		{silent, "200ms", true, "failed to read the echo"},
+	}
+
+	for _, test := range tests {
+		flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+		clientFlags := defineClientFlags(flags)
+		if err := flags.Parse([]string{"-transport", "plain", "-options", `{"serverAddress":"` + test.server + `"}`, "-timeout", test.timeout}); err != nil {
+			t.Fatal(err)
+		}
+
+		started := time.Now()
+		result := benchConnection(clientFlags, 64*1024, test.echo)
+		if test.err == "" && result.err != nil {
+			t.Errorf("with timeout %s and echo %v: expected the connection to succeed, got %s", test.timeout, test.echo, result.err)
+		}
+		if test.err != "" && (result.err == nil || !strings.Contains(result.err.Error(), test.err)) {
+			t.Errorf("with timeout %s and echo %v: expected %q, got %v", test.timeout, test.echo, test.err, result.err)
+		}
+		if elapsed := time.Since(started); elapsed > 5*time.Second {
+			t.Errorf("with timeout %s and echo %v: the connection took %s", test.timeout, test.echo, elapsed)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+/*
+	MIT License
+
+	Copyright (c) 2020 Operator Foundation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in all
+	copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/dispatcher"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+const (
+	checkOK      = "ok"
+	checkWarning = "warning"
+	checkError   = "error"
+)
+
+type checkResult struct {
+	Check   string `json:"check"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type checkReport struct {
+	Valid   bool          `json:"valid"`
+	Results []checkResult `json:"results"`
+}
+
+func (report *checkReport) add(check string, status string, format string, args ...interface{}) {
+	report.Results = append(report.Results, checkResult{Check: check, Status: status, Message: fmt.Sprintf(format, args...)})
+	if status == checkError {
+		report.Valid = false
+	}
+}
+
+// checkConfig does everything the dispatcher would do to start up, short of
+// opening any sockets, and reports every problem it finds.
+func checkConfig(config *dispatcherConfig, configPath string, problems configProblems) *checkReport {
+	report := &checkReport{Valid: true}
+
+	if len(problems) == 0 {
+		report.add("configuration", checkOK, "")
+	}
+	for _, problem := range problems {
+		report.add("configuration", checkError, "%s", problem)
+	}
+
+	// Servers have private keys in their transport options.
+	hasSecrets := !config.isClient()
+
+	if configPath != "" {
+		checkFilePermissions(report, "config file "+configPath, configPath, hasSecrets && len(config.Options) != 0)
+	}
+
+	checkStateDir(report, config.StateDir)
+
+	if config.Logging.Unsafe {
+		report.add("logging", checkWarning, "unsafe logging is enabled, the logs will contain addresses and secrets")
+	}
+
+	options, optionsError := config.options()
+	if config.OptionsFile != "" {
+		checkFilePermissions(report, "options file "+config.OptionsFile, config.OptionsFile, hasSecrets)
+
+		contents, readError := os.ReadFile(config.OptionsFile)
+		if readError != nil {
+			optionsError = readError
+		} else {
+			options = string(contents)
+		}
+	}
+
+	for _, transport := range config.Transports {
+		names := []string{transport.Name}
+		if transport.Name == "*" {
+			names = transports.Transports()
+		}
+
+		// A server bindaddr may carry options of its own.
+		transportOptions, transportOptionsError := options, optionsError
+		if len(transport.Options) != 0 {
+			transportOptions, transportOptionsError = transport.options()
+		} else if transport.OptionsFile != "" {
+			checkFilePermissions(report, "options file "+transport.OptionsFile, transport.OptionsFile, hasSecrets)
+
+			contents, readError := os.ReadFile(transport.OptionsFile)
+			transportOptions, transportOptionsError = string(contents), readError
+		}
+
+		for _, name := range names {
+			check := "transport " + name
+			if transportOptionsError != nil {
+				report.add(check, checkError, "the options cannot be read: %s", transportOptionsError.Error())
+			} else if err := checkTransport(config, name, transport.Bindaddr, transportOptions); err != nil {
+				report.add(check, checkError, "%s", err.Error())
+			} else if config.isClient() && transport.Bindaddr != "" {
+				report.add(check, checkWarning, "has a bindaddr, which is only used by servers")
+			} else {
+				report.add(check, checkOK, "")
+			}
+		}
+	}
+
+	if config.isClient() {
+		checkListenAddr(report, config.Mode, config.ProxyListenAddr)
+
+		if config.Proxy != "" {
+			if _, err := pt_extras.ParseProxyURI(config.Proxy); err != nil {
+				report.add("proxy", checkError, "%s", err.Error())
+			} else {
+				report.add("proxy", checkOK, "")
+			}
+		}
+	} else if config.AuthCookie != "" {
+		checkFilePermissions(report, "auth cookie "+config.AuthCookie, config.AuthCookie, true)
+	}
+
+	return report
+}
+
+// checkTransport checks the options of a transport as client options for a
+// client, and as server options for a server or for a transport with a
+// bindaddr, which only a server listens on.
+func checkTransport(config *dispatcherConfig, name string, bindaddr string, options string) error {
+	if config.isClient() {
+		if err := transports.CheckConfig(name, options, true); err != nil {
+			return fmt.Errorf("invalid client options: %s", err.Error())
+		}
+	}
+
+	if !config.isClient() || bindaddr != "" {
+		if err := transports.CheckConfig(name, options, false); err != nil {
+			return fmt.Errorf("invalid server options: %s", err.Error())
+		}
+
+		return checkBindaddr(name, bindaddr, options)
+	}
+
+	return nil
+}
+
+// checkBindaddr checks that a server can listen on its bindaddr with its
+// options, which may name a different address.
+func checkBindaddr(name string, bindaddr string, options string) error {
+	if bindaddr == "" {
+		return nil
+	}
+
+	addr, err := pt_extras.ResolveBindaddr(bindaddr)
+	if err != nil {
+		return err
+	}
+
+	_, err = pt_extras.ArgsToListener(name, "", options, false, "", addr.String())
+	return err
+}
+
+func checkStateDir(report *checkReport, stateDir string) {
+	check := "state directory " + stateDir
+
+	info, err := os.Stat(stateDir)
+	if os.IsNotExist(err) {
+		report.add(check, checkOK, "does not exist yet and will be created")
+		return
+	} else if err != nil {
+		report.add(check, checkError, "%s", err.Error())
+		return
+	}
+
+	if !info.IsDir() {
+		report.add(check, checkError, "is not a directory")
+	} else if info.Mode().Perm()&0200 == 0 {
+		report.add(check, checkError, "is not writable")
+	} else if info.Mode().Perm()&0022 != 0 {
+		report.add(check, checkWarning, "can be written by other users (mode %04o)", info.Mode().Perm())
+	} else {
+		report.add(check, checkOK, "")
+	}
+}
+
+// checkFilePermissions checks that a file can be read, and that files holding
+// secrets are not readable by other users.
+func checkFilePermissions(report *checkReport, check string, filePath string, hasSecrets bool) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		report.add(check, checkError, "%s", err.Error())
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		report.add(check, checkError, "%s", err.Error())
+		return
+	}
+
+	if hasSecrets && info.Mode().Perm()&0077 != 0 {
+		report.add(check, checkWarning, "contains secrets but can be read by other users (mode %04o), use chmod 600", info.Mode().Perm())
+		return
+	}
+
+	report.add(check, checkOK, "")
+}
+
+func checkListenAddr(report *checkReport, mode string, listenAddr string) {
+	if listenAddr == "" {
+		return
+	}
+
+	check := "proxy listen address " + listenAddr
+
+	var err error
+	if mode == dispatcher.ModeTransparentUDP || mode == dispatcher.ModeSTUN {
+		_, err = net.ResolveUDPAddr("udp", listenAddr)
+	} else {
+		_, err = net.ResolveTCPAddr("tcp", listenAddr)
+	}
+
+	if err != nil {
+		report.add(check, checkError, "%s", err.Error())
+	} else {
+		report.add(check, checkOK, "")
+	}
+}
+
+// printCheckReport writes the report either as JSON or as one line per check.
+func printCheckReport(output io.Writer, report *checkReport, format string) {
+	if format == "json" {
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+		return
+	}
+
+	for _, result := range report.Results {
+		line := fmt.Sprintf("%-7s %s", result.Status, result.Check)
+		if result.Message != "" {
+			line += ": " + result.Message
+		}
+		_, _ = fmt.Fprintln(output, line)
+	}
+
+	if report.Valid {
+		_, _ = fmt.Fprintln(output, "the configuration is valid")
+	} else {
+		_, _ = fmt.Fprintln(output, "the configuration is not valid")
+	}
+}
@@ -0,0 +1,222 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+// checkFlags checks the configuration given by the run flags.
+func checkFlags(t *testing.T, arguments ...string) (*dispatcherConfig, *checkReport) {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	runFlags := defineRunFlags(flags)
+	if err := flags.Parse(append([]string{"-state", t.TempDir()}, arguments...)); err != nil {
+		t.Fatal(err)
+	}
+
+	config, problems, err := runFlags.config(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.validate(&problems)
+
+	return config, checkConfig(config, "", problems)
+}
+
+// transportResult returns the result of the check of a transport.
+func transportResult(t *testing.T, report *checkReport, name string) checkResult {
+	for _, result := range report.Results {
+		if result.Check == "transport "+name {
+			return result
+		}
+	}
+
+	t.Fatalf("the transport %s was not checked: %+v", name, report.Results)
+	return checkResult{}
+}
+
+// TestCheckRoles tests that the transport options are checked as server
+// options on a server, which a bindaddr makes it without -server, and as
+// client options on a client.
+func TestCheckRoles(t *testing.T) {
+	shadowClient := `{"serverAddress":"127.0.0.1:2222","serverPublicKey":"not a key","cipherName":"darkstar"}`
+	shadowServer := `{"serverAddress":"127.0.0.1:2222","serverPrivateKey":"not a key","cipherName":"darkstar"}`
+	plain := `{"serverAddress":"127.0.0.1:2222"}`
+
+	tests := []struct {
+		arguments []string
+		role      string
+		transport string
+		status    string
+		message   string
+	}{
+		{[]string{"-transparent", "-transport", "shadow", "-bindaddr", "shadow-127.0.0.1:2222", "-target", "127.0.0.1:3333", "-options", shadowClient}, roleServer, "shadow", checkError, "invalid server options"},
+		{[]string{"-server", "-transparent", "-transport", "shadow", "-bindaddr", "shadow-127.0.0.1:2222", "-target", "127.0.0.1:3333", "-options", shadowClient}, roleServer, "shadow", checkError, "invalid server options"},
+		{[]string{"-client", "-transparent", "-transport", "shadow", "-proxylistenaddr", "127.0.0.1:1443", "-options", shadowServer}, roleClient, "shadow", checkError, "invalid client options"},
+		{[]string{"-transparent", "-transport", "plain", "-bindaddr", "plain-127.0.0.1:2222", "-target", "127.0.0.1:3333", "-options", plain}, roleServer, "plain", checkOK, ""},
+		{[]string{"-transparent", "-transport", "plain", "-proxylistenaddr", "127.0.0.1:1443", "-options", plain}, roleClient, "plain", checkOK, ""},
+	}
+
+	for _, test := range tests {
+		config, report := checkFlags(t, test.arguments...)
+		if config.Role != test.role {
+			t.Errorf("%v: the role is %s, expected %s", test.arguments, config.Role, test.role)
+		}
+
+		result := transportResult(t, report, test.transport)
+		if result.Status != test.status || !strings.Contains(result.Message, test.message) {
+			t.Errorf("%v: the check of %s is %s %q, expected %s %q", test.arguments, test.transport, result.Status, result.Message, test.status, test.message)
+		}
+	}
+}
+
+// TestCheckClientBindaddr tests that the options of a transport with a
+// bindaddr are also checked as server options on a client, which does not
+// listen on it.
+func TestCheckClientBindaddr(t *testing.T) {
+	config := &dispatcherConfig{
+		Role:       roleClient,
+		StateDir:   t.TempDir(),
+		Options:    []byte(`{"serverAddress":"127.0.0.1:2222"}`),
+		Transports: []transportConfig{{Name: "plain", Bindaddr: "127.0.0.1:2222"}},
+	}
+
+	result := transportResult(t, checkConfig(config, "", nil), "plain")
+	if result.Status != checkWarning {
+		t.Errorf("the check of plain is %s %q, expected a warning about the bindaddr", result.Status, result.Message)
+	}
+
+	config.Transports[0].Bindaddr = "127.0.0.1:notaport"
+	result = transportResult(t, checkConfig(config, "", nil), "plain")
+	if result.Status != checkError {
+		t.Errorf("the check of plain is %s %q, expected an error about the bindaddr", result.Status, result.Message)
+	}
+}
+
+// checkOptionsFile checks a transport options file the way the check command
+// does for a dispatcher with the given role.
+func checkOptionsFile(t *testing.T, role string, name string, optionsFile string) checkResult {
+	config := &dispatcherConfig{
+		Role:        role,
+		StateDir:    t.TempDir(),
+		OptionsFile: optionsFile,
+		Transports:  []transportConfig{{Name: name}},
+	}
+
+	return transportResult(t, checkConfig(config, "", nil), name)
+}
+
+// TestCheckGenerated tests that the configs written by generate pass the
+// check, in the role each of them is meant for.
+func TestCheckGenerated(t *testing.T) {
+	tests := []transports.GenerateOptions{
+		{Transports: []string{"shadow"}},
+		{Transports: []string{"Starbridge"}},
+		{Transports: []string{"Replicant"}},
+		{Transports: []string{"Replicant"}, Toneburst: true},
+		{Transports: []string{"Replicant"}, Polish: true},
+		{Transports: []string{"Replicant"}, Toneburst: true, Polish: true},
+		{Transports: []string{"Optimizer", "shadow", "Starbridge", "Replicant"}, Polish: true, Strategy: "first"},
+	}
+
+	for _, options := range tests {
+		factory, ok := transports.Lookup(options.Transports[0])
+		if !ok || factory.Generate == nil {
+			t.Fatalf("configs cannot be generated for %s", options.Transports[0])
+		}
+
+		options.ServerAddress = "127.0.0.1:2222"
+		options.Output = t.TempDir()
+		options.Transports = options.Transports[1:]
+		if err := factory.Generate(options); err != nil {
+			t.Fatalf("generating %s configs failed: %s", factory.Name, err)
+		}
+
+		for role, suffix := range map[string]string{roleServer: "ServerConfig.json", roleClient: "ClientConfig.json"} {
+			optionsFiles, _ := filepath.Glob(filepath.Join(options.Output, "*"+suffix))
+			if len(optionsFiles) != 1 {
+				t.Fatalf("expected one generated %s %s config, found %v", factory.Name, role, optionsFiles)
+			}
+			if result := checkOptionsFile(t, role, factory.Name, optionsFiles[0]); result.Status != checkOK {
+				t.Errorf("the generated %s %s config %+v failed the check: %s", factory.Name, role, options, result.Message)
+			}
+		}
+	}
+}
+
+// TestCheckConfigFiles tests that the example configs in ConfigFiles pass the
+// check.
+func TestCheckConfigFiles(t *testing.T) {
+	configFiles, err := filepath.Glob(filepath.Join("ConfigFiles", "*.json"))
+	if err != nil || len(configFiles) == 0 {
+		t.Fatalf("expected the example configs in ConfigFiles, got %v", err)
+	}
+
+	for _, configFile := range configFiles {
+		base := filepath.Base(configFile)
+		if strings.HasPrefix(base, "Dispatcher") {
+			config, loadError := loadConfigFile(configFile)
+			if loadError != nil {
+				t.Errorf("%s could not be loaded: %s", base, loadError)
+				continue
+			}
+
+			var problems configProblems
+			config.validate(&problems)
+			config.StateDir = t.TempDir()
+			for _, result := range checkConfig(config, "", problems).Results {
+				if result.Status == checkError {
+					t.Errorf("%s failed the %s check: %s", base, result.Check, result.Message)
+				}
+			}
+			continue
+		}
+
+		role := roleClient
+		if strings.Contains(base, "Server") {
+			role = roleServer
+		}
+
+		name := ""
+		for _, transport := range []string{"shadow", "Starbridge", "Replicant", "Optimizer"} {
+			if strings.HasPrefix(base, transport) {
+				name = transport
+			}
+		}
+		if name == "" {
+			t.Errorf("the transport of %s is not known to the test", base)
+			continue
+		}
+
+		if result := checkOptionsFile(t, role, name, configFile); result.Status != checkOK {
+			t.Errorf("%s failed the check as %s %s options: %s", base, name, role, result.Message)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+/*
+	MIT License
+
+	Copyright (c) 2020 Operator Foundation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in all
+	copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+	"github.com/kataras/golog"
+)
+
+// command is one of the subcommands of the dispatcher, each with its own flags.
+type command struct {
+	name        string
+	description string
+	run         func(arguments []string)
+}
+
+var commands []command
+
+func init() {
+	// Set up here rather than in the declaration because the help command
+	// lists the table itself.
+	commands = []command{
+		{"run", "Run the dispatcher (the default when no command is given)", runCommand},
+		{"generate", "Generate a matching client and server config for a transport", generateCommand},
+		{"check", "Check a configuration without starting the dispatcher", checkCommand},
+		{"probe", "Connect to a transport server and report whether the handshake succeeds", probeCommand},
+		{"bench", "Measure the connection time and throughput of a transport", benchCommand},
+		{"version", "Print the version and exit", versionCommand},
+		{"help", "Print this help, or the help of a command", helpCommand},
+	}
+}
+
+func lookupCommand(name string) *command {
+	for index := range commands {
+		if commands[index].name == name {
+			return &commands[index]
+		}
+	}
+
+	return nil
+}
+
+// parseCommand returns the command named by the first argument and the
+// arguments left for it. Without a command, the arguments are the flags of
+// the run command.
+func parseCommand(arguments []string) (*command, []string, error) {
+	if len(arguments) == 0 || strings.HasPrefix(arguments[0], "-") {
+		return lookupCommand("run"), arguments, nil
+	}
+
+	command := lookupCommand(arguments[0])
+	if command == nil {
+		return nil, nil, fmt.Errorf("unknown command %q", arguments[0])
+	}
+
+	return command, arguments[1:], nil
+}
+
+func printUsage() {
+	_, _ = fmt.Fprintf(os.Stderr, "shapeshifter-dispatcher is a PT v3.0 proxy supporting multiple transports and proxy modes\n\n")
+	_, _ = fmt.Fprintf(os.Stderr, "Usage:\n\t%s <command> [flags]\n\nCommands:\n\n", os.Args[0])
+	for _, command := range commands {
+		_, _ = fmt.Fprintf(os.Stderr, "\t%-10s %s\n", command.name, command.description)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command. Flags given without a command are passed to run.\n", os.Args[0])
+}
+
+// newCommandFlags creates the flag set of a command with a usage message
+// showing the command's description.
+func newCommandFlags(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n\n", lookupCommand(name).description)
+		_, _ = fmt.Fprintf(os.Stderr, "Usage:\n\t%s %s %s\n\n", os.Args[0], name, arguments)
+		_, _ = fmt.Fprintf(os.Stderr, "Flags:\n\n")
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+func helpCommand(arguments []string) {
+	if len(arguments) > 0 {
+		if command := lookupCommand(arguments[0]); command != nil && command.name != "help" {
+			command.run([]string{"-h"})
+			return
+		}
+	}
+
+	printUsage()
+}
+
+func versionCommand(arguments []string) {
+	flags := newCommandFlags("version", "")
+	_ = flags.Parse(arguments)
+
+	fmt.Printf("%s\n", getVersion())
+}
+
+// generateFlags are the flags used for config generation.
+type generateFlags struct {
+	transport      *string
+	serverAddress  *string
+	bindAddr       *string
+	toneburst      *bool
+	polish         *bool
+	transportsList *string
+	strategy       *string
+	output         *string
+	force          *bool
+}
+
+// defineGenerateFlags adds the config generation flags to a flag set. The run
+// command shares -transport, -bindaddr and -transports with generation, so
+// they are only defined when not given.
+func defineGenerateFlags(flags *flag.FlagSet, transport *string, bindAddr *string, transportsList *string) *generateFlags {
+	if transport == nil {
+		transport = flags.String("transport", "", "Specify the transport to generate a config for: "+strings.Join(transports.Transports(), ", "))
+	}
+	if bindAddr == nil {
+		bindAddr = flags.String("bindaddr", "", "Specify the bind address to put in the server config")
+	}
+	if transportsList == nil {
+		transportsList = flags.String("transports", "", "Specify the comma separated transports of an Optimizer config")
+	}
+
+	return &generateFlags{
+		transport:      transport,
+		serverAddress:  flags.String("serverIP", "", "Specify the IP address of the server to use in the config"),
+		bindAddr:       bindAddr,
+		toneburst:      flags.Bool("toneburst", false, "Use the starburst toneburst for the Replicant config generation"),
+		polish:         flags.Bool("polish", false, "Use the Darkstar polish for the Replicant config generation"),
+		transportsList: transportsList,
+		strategy:       flags.String("strategy", "first", "Specify the strategy of an Optimizer config: first, random, rotate, track or minimizeDialDuration"),
+		output:         flags.String("output", "", "Specify the directory to write the configs to, or - to print them"),
+		force:          flags.Bool("force", false, "Overwrite existing config files"),
+	}
+}
+
+// generate writes the configs and returns the exit code.
+func (generateFlags *generateFlags) generate() int {
+	bindAddr := generateFlags.bindAddr
+	if *bindAddr == "" {
+		bindAddr = nil
+	}
+
+	if *generateFlags.transport == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "-transport is required to generate a config")
+		return 2
+	}
+
+	factory, ok := transports.Lookup(*generateFlags.transport)
+	if !ok || factory.Generate == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "configs cannot be generated for transport %q, use %s\n", *generateFlags.transport, strings.Join(transports.Default.Generators(), ", "))
+		return 2
+	}
+
+	var transportNames []string
+	if *generateFlags.transportsList != "" {
+		for _, name := range strings.Split(*generateFlags.transportsList, ",") {
+			transportNames = append(transportNames, strings.TrimSpace(name))
+		}
+	}
+
+	err := factory.Generate(transports.GenerateOptions{
+		ServerAddress: *generateFlags.serverAddress,
+		BindAddress:   bindAddr,
+		Toneburst:     *generateFlags.toneburst,
+		Polish:        *generateFlags.polish,
+		Transports:    transportNames,
+		Strategy:      *generateFlags.strategy,
+		Output:        *generateFlags.output,
+		Force:         *generateFlags.force,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "failed to generate the %s configs: %s\n", *generateFlags.transport, err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+func generateCommand(arguments []string) {
+	flags := newCommandFlags("generate", "[transport] -serverIP [address:port]")
+	generateFlags := defineGenerateFlags(flags, nil, nil, nil)
+
+	// The transport can also be given before the flags, as in
+	// "generate optimizer -transports shadow,Starbridge".
+	if len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		*generateFlags.transport = arguments[0]
+		arguments = arguments[1:]
+	}
+	_ = flags.Parse(arguments)
+
+	os.Exit(generateFlags.generate())
+}
+
+func checkCommand(arguments []string) {
+	flags := newCommandFlags("check", "-config [config file] | [run flags]")
+	runFlags := defineRunFlags(flags)
+	format := flags.String("format", "text", "Format of the report (text/json)")
+	_ = flags.Parse(arguments)
+
+	os.Exit(checkRunConfig(flags, runFlags, *format, "format"))
+}
+
+// checkRunConfig prints the check report for the configuration given to the
+// run flags and returns the exit code.
+func checkRunConfig(flags *flag.FlagSet, runFlags *runFlags, format string, allowedWithConfig ...string) int {
+	// Only the report is printed when checking the configuration.
+	golog.SetLevel("disable")
+
+	config, problems, loadError := runFlags.config(flags, allowedWithConfig...)
+	if loadError != nil {
+		_, _ = fmt.Fprintln(os.Stderr, loadError.Error())
+		return 1
+	}
+
+	config.validate(&problems)
+
+	report := checkConfig(config, *runFlags.configPath, problems)
+	printCheckReport(os.Stdout, report, format)
+	if !report.Valid {
+		return 1
+	}
+
+	return 0
+}
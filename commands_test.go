@@ -0,0 +1,63 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestParseCommand tests how the first argument picks the command.
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		arguments []string
+		command   string
+		rest      []string
+	}{
+		{nil, "run", nil},
+		{[]string{"-client", "-transports", "shadow"}, "run", []string{"-client", "-transports", "shadow"}},
+		{[]string{"-showVersion"}, "run", []string{"-showVersion"}},
+		{[]string{"run", "-server"}, "run", []string{"-server"}},
+		{[]string{"generate", "shadow", "-serverAddress", "127.0.0.1:2222"}, "generate", []string{"shadow", "-serverAddress", "127.0.0.1:2222"}},
+		{[]string{"check"}, "check", []string{}},
+		{[]string{"nosuchcommand", "-client"}, "", nil},
+	}
+
+	for _, test := range tests {
+		command, rest, err := parseCommand(test.arguments)
+		if test.command == "" {
+			if err == nil {
+				t.Errorf("parseCommand(%q) picked %s, expected an error", test.arguments, command.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseCommand(%q) failed: %s", test.arguments, err)
+		} else if command.name != test.command || !reflect.DeepEqual(rest, test.rest) {
+			t.Errorf("parseCommand(%q) = %s %q, expected %s %q", test.arguments, command.name, rest, test.command, test.rest)
+		}
+	}
+}
@@ -25,17 +25,23 @@
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
-// Package log implements a simple set of leveled logging wrappers around the
-// standard log package.
+// Package log is the logging facade used by the whole dispatcher. Logs are
+// leveled, written as text, JSON or logfmt, and can carry fields such as the
+// ID of the connection they are about. Unless unsafe logging is enabled,
+// addresses are scrubbed from every line and fields that may hold secrets are
+// redacted.
 package log
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -57,121 +63,353 @@ const (
 	LevelNone
 )
 
-var logLevel = LevelInfo
-var ipcLogLevel = LevelNone
-var enableLogging bool
-var unsafeLogging bool
+// levelNotice is only used for Noticef, which logs at every level.
+const levelNotice = 0
 
-// Init initializes logging with the given path, and log safety options.
-func Init(enable bool, logFilePath string, ipcLog int) error {
+// Log formats accepted by SetFormat.
+const (
+	FormatText   = "text"
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+var (
+	lock          sync.Mutex
+	output        io.Writer = ioutil.Discard
+	format                  = FormatText
+	logLevel                = LevelInfo
+	ipcLogLevel             = LevelNone
+	enableLogging bool
+	unsafeLogging bool
+)
+
+// Init initializes logging with the given path, rotation and IPC log level.
+func Init(enable bool, logFilePath string, ipcLog int, rotation Rotation) error {
+	var writer io.Writer = ioutil.Discard
 	if enable {
-		f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		logFile, err := openRotatingFile(logFilePath, rotation)
 		if err != nil {
 			return err
 		}
-		log.SetOutput(f)
-	} else {
-		log.SetOutput(ioutil.Discard)
+		writer = logFile
 	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	closeOutput()
+	output = writer
 	enableLogging = enable
 	ipcLogLevel = ipcLog
 	return nil
 }
 
-// SetLogLevel sets the log level to the value indicated by the given string
-// (case-insensitive).
-func SetLogLevel(logLevelStr string) error {
+// Reopen closes and reopens the log file, so that it can be rotated by an
+// external tool such as logrotate.
+func Reopen() error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if logFile, ok := output.(*rotatingFile); ok {
+		return logFile.reopen()
+	}
+
+	return nil
+}
+
+func closeOutput() {
+	if logFile, ok := output.(*rotatingFile); ok {
+		_ = logFile.Close()
+	}
+}
+
+// SetUnsafeLogging disables the scrubbing of addresses and secrets from the
+// logs. It is meant for debugging and must be called before logging starts.
+func SetUnsafeLogging(unsafe bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	unsafeLogging = unsafe
+}
+
+// SetOutput sends the logs to writer and enables logging.
+func SetOutput(writer io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	closeOutput()
+	output = writer
+	enableLogging = true
+}
+
+// Output returns the writer the logs are sent to, so that libraries with
+// their own loggers can share it.
+func Output() io.Writer {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return output
+}
+
+// SetFormat selects the format of the log lines: text, json or logfmt.
+func SetFormat(formatStr string) error {
+	switch strings.ToLower(formatStr) {
+	case FormatText, FormatJSON, FormatLogfmt:
+	default:
+		return fmt.Errorf("invalid log format '%s'", formatStr)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	format = strings.ToLower(formatStr)
+	return nil
+}
+
+// ParseLevel returns the log level named by the given string
+// (case-insensitive). NONE and DISABLE are both LevelNone.
+func ParseLevel(logLevelStr string) (int, error) {
 	switch strings.ToUpper(logLevelStr) {
 	case "ERROR":
-		logLevel = LevelError
+		return LevelError, nil
 	case "WARN":
-		logLevel = LevelWarn
+		return LevelWarn, nil
 	case "INFO":
-		logLevel = LevelInfo
+		return LevelInfo, nil
 	case "DEBUG":
-		logLevel = LevelDebug
+		return LevelDebug, nil
+	case "NONE", "DISABLE":
+		return LevelNone, nil
 	default:
-		return fmt.Errorf("invalid log level '%s'", logLevelStr)
+		return 0, fmt.Errorf("invalid log level '%s'", logLevelStr)
 	}
+}
+
+// SetLogLevel sets the log level to the value indicated by the given string
+// (case-insensitive).
+func SetLogLevel(logLevelStr string) error {
+	level, err := ParseLevel(logLevelStr)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	logLevel = level
 	return nil
 }
 
-func ipcLogMessage(logLevel int, message string) {
-	var logLevelStr string
-	switch logLevel {
-	case LevelNone:
-		logLevelStr = "NONE"
+func levelName(level int) string {
+	switch level {
+	case levelNotice:
+		return "NOTICE"
 	case LevelError:
-		logLevelStr = "ERROR"
+		return "ERROR"
 	case LevelWarn:
-		logLevelStr = "WARN"
+		return "WARN"
 	case LevelInfo:
-		logLevelStr = "INFO"
+		return "INFO"
 	case LevelDebug:
-		logLevelStr = "DEBUG"
+		return "DEBUG"
 	default:
-		return
+		return "NONE"
+	}
+}
+
+func ipcLogMessage(logLevel int, message string) {
+	println("LOG " + levelName(logLevel) + " " + message)
+}
+
+// field is a key and its value, already sanitized and turned into a string.
+type field struct {
+	key   string
+	value string
+}
+
+// Logger logs with a set of fields attached to every line.
+type Logger struct {
+	fields []field
+}
+
+var root = &Logger{}
+
+// With returns a logger that adds the key-value pairs to every line.
+func With(keyvals ...interface{}) *Logger {
+	return root.With(keyvals...)
+}
+
+// With returns a logger with the fields of this logger and the key-value
+// pairs. Values that are addresses or errors are sanitized with ElideAddr and
+// ElideError, as are string values of keys that name addresses. The values of
+// keys that name secrets are redacted, and an "options" value is redacted
+// with RedactOptions.
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]field, len(logger.fields), len(logger.fields)+len(keyvals)/2)
+	copy(fields, logger.fields)
+
+	for index := 0; index+1 < len(keyvals); index += 2 {
+		key := fmt.Sprint(keyvals[index])
+		fields = append(fields, field{key, fieldValue(key, keyvals[index+1])})
+	}
+
+	return &Logger{fields}
+}
+
+func fieldValue(key string, value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case net.Addr:
+		return ElideAddr(typed.String())
+	case error:
+		return ElideError(typed)
+	case string:
+		switch {
+		case unsafeLogging:
+			return typed
+		case isSecretKey(key):
+			return redacted
+		case strings.ToLower(key) == "options":
+			return RedactOptions(typed)
+		case isAddrKey(key):
+			return ElideAddr(typed)
+		}
+		return ElideString(typed)
+	default:
+		if isSecretKey(key) && !unsafeLogging {
+			return redacted
+		}
+		return ElideString(fmt.Sprint(typed))
 	}
-	println("LOG "+logLevelStr+" "+message)
+}
+
+// isAddrKey reports whether the field holds an address that must be elided.
+func isAddrKey(key string) bool {
+	key = strings.ToLower(key)
+	switch key {
+	case "remote", "local", "target", "client", "server":
+		return true
+	}
+
+	return strings.HasSuffix(key, "addr") || strings.HasSuffix(key, "address")
+}
+
+// Noticef logs the given format string/arguments at the NOTICE log level.
+// Unless logging is disabled, Noticef logs are always emitted.
+func (logger *Logger) Noticef(format string, a ...interface{}) {
+	logger.log(levelNotice, format, a)
+}
+
+// Errorf logs the given format string/arguments at the ERROR log level.
+func (logger *Logger) Errorf(format string, a ...interface{}) {
+	logger.log(LevelError, format, a)
+}
+
+// Warnf logs the given format string/arguments at the WARN log level.
+func (logger *Logger) Warnf(format string, a ...interface{}) {
+	logger.log(LevelWarn, format, a)
+}
+
+// Infof logs the given format string/arguments at the INFO log level.
+func (logger *Logger) Infof(format string, a ...interface{}) {
+	logger.log(LevelInfo, format, a)
+}
+
+// Debugf logs the given format string/arguments at the DEBUG log level.
+func (logger *Logger) Debugf(format string, a ...interface{}) {
+	logger.log(LevelDebug, format, a)
 }
 
 // Noticef logs the given format string/arguments at the NOTICE log level.
 // Unless logging is disabled, Noticef logs are always emitted.
 func Noticef(format string, a ...interface{}) {
-	if enableLogging {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[NOTICE]: " + msg)
-	}
+	root.log(levelNotice, format, a)
 }
 
 // Errorf logs the given format string/arguments at the ERROR log level.
 func Errorf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[ERROR]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelError, msg)
-	}
+	root.log(LevelError, format, a)
 }
 
 // Warnf logs the given format string/arguments at the WARN log level.
 func Warnf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[WARN]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelWarn, msg)
-	}
+	root.log(LevelWarn, format, a)
 }
 
 // Infof logs the given format string/arguments at the INFO log level.
 func Infof(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelInfo {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[INFO]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelInfo {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelInfo, msg)
-	}
+	root.log(LevelInfo, format, a)
 }
 
 // Debugf logs the given format string/arguments at the DEBUG log level.
 func Debugf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelDebug {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[DEBUG]: " + msg)
+	root.log(LevelDebug, format, a)
+}
+
+func (logger *Logger) log(level int, messageFormat string, a []interface{}) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	toLog := enableLogging && (level == levelNotice || (logLevel != LevelNone && logLevel >= level))
+	toIPC := level != levelNotice && ipcLogLevel != LevelNone && ipcLogLevel >= level
+	if !toLog && !toIPC {
+		return
 	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelDebug {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelDebug, msg)
+
+	message := ElideString(fmt.Sprintf(messageFormat, a...))
+
+	if toLog {
+		_, _ = io.WriteString(output, formatLine(time.Now(), level, message, logger.fields))
+	}
+	if toIPC {
+		ipcLogMessage(level, formatLogfmt(message, logger.fields))
 	}
 }
 
+func formatLine(now time.Time, level int, message string, fields []field) string {
+	switch format {
+	case FormatJSON:
+		entry := make(map[string]string, len(fields)+3)
+		for _, field := range fields {
+			entry[field.key] = field.value
+		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = strings.ToLower(levelName(level))
+		entry["msg"] = message
+
+		line, _ := json.Marshal(entry)
+		return string(line) + "\n"
+	case FormatLogfmt:
+		return "time=" + now.Format(time.RFC3339Nano) + " level=" + strings.ToLower(levelName(level)) + " msg=" + formatLogfmt(message, fields) + "\n"
+	default:
+		line := now.Format("2006/01/02 15:04:05") + " [" + levelName(level) + "]: " + message
+		for _, field := range fields {
+			line += " " + field.key + "=" + logfmtValue(field.value)
+		}
+		return line + "\n"
+	}
+}
+
+// formatLogfmt returns the quoted message followed by the fields.
+func formatLogfmt(message string, fields []field) string {
+	var builder strings.Builder
+	builder.WriteString(logfmtValue(message))
+	for _, field := range fields {
+		builder.WriteString(" " + field.key + "=" + logfmtValue(field.value))
+	}
+
+	return builder.String()
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
 // ElideError transforms the string representation of the provided error
 // based on the unsafeLogging setting.  Callers that wish to log errors
 // returned from Go's net package should use ElideError to sanitize the
@@ -184,11 +422,11 @@ func ElideError(err error) string {
 		return err.Error()
 	}
 
-	// If err is not a net.Error, just return the string representation,
-	// presumably transport authors know what they are doing.
+	// If err is not a net.Error, it may still wrap one, so scrub anything
+	// that looks like an IP address from its string representation.
 	netErr, ok := err.(net.Error)
 	if !ok {
-		return err.Error()
+		return ElideString(err.Error())
 	}
 
 	switch t := netErr.(type) {
@@ -201,7 +439,7 @@ func ElideError(err error) string {
 	case *net.UnknownNetworkError:
 		return "unknown network " + elidedAddr
 	case *net.OpError:
-		return t.Op + ": " + t.Err.Error()
+		return t.Op + ": " + ElideError(t.Err)
 	default:
 		// For unknown error types, do the conservative thing and only log the
 		// type of the error instead of assuming that the string representation
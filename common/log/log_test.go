@@ -0,0 +1,121 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseLogfmt splits a logfmt line into its keys and values, unquoting the
+// quoted values.
+func parseLogfmt(t *testing.T, line string) map[string]string {
+	result := make(map[string]string)
+
+	for line != "" {
+		key, rest, found := strings.Cut(line, "=")
+		if !found {
+			t.Fatalf("%q has no value", line)
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				t.Fatalf("the value of %s is not quoted properly: %s", key, rest)
+			}
+			if value, err = strconv.Unquote(quoted); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[len(quoted):]
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+			rest = " " + rest
+		}
+
+		result[key] = value
+		line = strings.TrimPrefix(rest, " ")
+	}
+
+	return result
+}
+
+// TestFormats tests that the JSON and logfmt lines can be parsed back into
+// the level, the message and the fields, including values that need quoting.
+func TestFormats(t *testing.T) {
+	var output strings.Builder
+	SetOutput(&output)
+	_ = SetLogLevel("INFO")
+	defer SetOutput(ioutil.Discard)
+	defer func() { _ = SetFormat(FormatText) }()
+
+	expected := map[string]string{
+		"level":     "warn",
+		"msg":       `copy ended: "reset" by peer`,
+		"conn":      "7",
+		"transport": "shadow",
+		"reason":    "a=b c\\d",
+		"empty":     "",
+	}
+
+	for _, format := range []string{FormatJSON, FormatLogfmt} {
+		if err := SetFormat(format); err != nil {
+			t.Fatal(err)
+		}
+
+		output.Reset()
+		With("conn", 7, "transport", "shadow", "reason", "a=b c\\d", "empty", "").Warnf("copy ended: %q by peer", "reset")
+		line := output.String()
+		if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+			t.Fatalf("%s: expected a single line, got %q", format, line)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		parsed := make(map[string]string)
+		if format == FormatJSON {
+			if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+				t.Fatalf("%s: %q is not a JSON object: %s", format, line, err)
+			}
+		} else {
+			parsed = parseLogfmt(t, line)
+		}
+
+		if _, ok := parsed["time"]; !ok {
+			t.Errorf("%s: %q has no time", format, line)
+		}
+		for key, value := range expected {
+			if parsed[key] != value {
+				t.Errorf("%s: %s is %q, expected %q", format, key, parsed[key], value)
+			}
+		}
+	}
+
+	if err := SetFormat("xml"); err == nil {
+		t.Error("SetFormat(\"xml\") succeeded, expected an error")
+	}
+}
@@ -0,0 +1,137 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+var (
+	ipv4Pattern = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+
+	// ipv6Pattern matches anything that might be an IPv6 address, with or
+	// without brackets. Matches that do not parse as an address, such as
+	// times, are left alone.
+	ipv6Pattern = regexp.MustCompile(`\[[0-9A-Fa-f:.]+\]|[0-9A-Fa-f]*:[0-9A-Fa-f.]*:[0-9A-Fa-f:.]*`)
+
+	// secretKeys are the parts of option names that hold secrets, such as
+	// serverPrivateKey or password.
+	secretKeys = []string{"private", "password", "passphrase", "secret", "token", "cookie"}
+)
+
+// ElideString removes every IP address from a string, based on the
+// unsafeLogging setting. Ports are kept so that connections can still be
+// told apart.
+func ElideString(str string) string {
+	if unsafeLogging {
+		return str
+	}
+
+	str = ipv4Pattern.ReplaceAllStringFunc(str, func(match string) string {
+		if net.ParseIP(match) == nil {
+			return match
+		}
+		return elidedAddr
+	})
+
+	return ipv6Pattern.ReplaceAllStringFunc(str, func(match string) string {
+		if net.ParseIP(strings.Trim(match, "[]")) == nil {
+			return match
+		}
+		return elidedAddr
+	})
+}
+
+// RedactOptions transforms transport options for logging, based on the
+// unsafeLogging setting. The values of fields that hold secrets, such as
+// private keys and passwords, are redacted and addresses are elided. Options
+// that are not JSON are redacted entirely.
+func RedactOptions(options string) string {
+	if unsafeLogging {
+		return options
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(options), &parsed); err != nil {
+		return redacted
+	}
+
+	result, err := json.Marshal(redactValue("", parsed))
+	if err != nil {
+		return redacted
+	}
+
+	return string(result)
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for childKey, child := range typed {
+			typed[childKey] = redactValue(childKey, child)
+		}
+		return typed
+	case []interface{}:
+		for index, child := range typed {
+			typed[index] = redactValue(key, child)
+		}
+		return typed
+	case string:
+		switch {
+		case isSecretKey(key):
+			return redacted
+		case isAddrKey(key):
+			return ElideAddr(typed)
+		}
+		return ElideString(typed)
+	default:
+		if isSecretKey(key) {
+			return redacted
+		}
+		return typed
+	}
+}
+
+// isSecretKey reports whether a field or option holds a secret that must be
+// redacted.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if key == "key" || key == "psk" {
+		return true
+	}
+
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+
+	return false
+}
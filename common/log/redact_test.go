@@ -0,0 +1,98 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// TestElideString tests that IP addresses are removed and everything else is
+// kept.
+func TestElideString(t *testing.T) {
+	tests := []struct {
+		str      string
+		expected string
+	}{
+		{"dial tcp 192.0.2.1:443: connect: connection refused", "dial tcp [scrubbed]:443: connect: connection refused"},
+		{"dial tcp [2001:db8::1]:443: i/o timeout", "dial tcp [scrubbed]:443: i/o timeout"},
+		{"from ::1 at 15:04:05", "from [scrubbed] at 15:04:05"},
+		{"version 1.2.3 started", "version 1.2.3 started"},
+	}
+
+	for _, test := range tests {
+		if elided := ElideString(test.str); elided != test.expected {
+			t.Errorf("ElideString(%q) = %q, expected %q", test.str, elided, test.expected)
+		}
+	}
+}
+
+// TestRedactOptions tests that secrets are redacted from transport options,
+// including the options of the transports inside an Optimizer config.
+func TestRedactOptions(t *testing.T) {
+	options := `{"strategy":"first","transports":[{"name":"shadow","config":{"serverAddress":"192.0.2.1:2222","serverPrivateKey":"c2VjcmV0","cipherName":"darkstar"}}],"password":"hunter2"}`
+
+	redactedOptions := RedactOptions(options)
+	for _, secret := range []string{"c2VjcmV0", "hunter2", "192.0.2.1"} {
+		if strings.Contains(redactedOptions, secret) {
+			t.Errorf("RedactOptions() = %s, contains %q", redactedOptions, secret)
+		}
+	}
+	for _, kept := range []string{`"cipherName":"darkstar"`, `"strategy":"first"`, `:2222"`} {
+		if !strings.Contains(redactedOptions, kept) {
+			t.Errorf("RedactOptions() = %s, is missing %q", redactedOptions, kept)
+		}
+	}
+
+	if redactedOptions = RedactOptions("not json hunter2"); redactedOptions != redacted {
+		t.Errorf("RedactOptions() = %q for options that are not JSON, expected %q", redactedOptions, redacted)
+	}
+}
+
+// TestSafeLogging tests that lines are scrubbed unless unsafe logging is
+// enabled.
+func TestSafeLogging(t *testing.T) {
+	var output strings.Builder
+	SetOutput(&output)
+	_ = SetLogLevel("INFO")
+	defer SetOutput(ioutil.Discard)
+
+	logger := With("remote", "192.0.2.1:5000", "serverPrivateKey", "c2VjcmV0", "error", errors.New("dial tcp 192.0.2.2:443: refused"))
+	logger.Errorf("failed to reach %s", "192.0.2.3:80")
+	if line := output.String(); strings.Contains(line, "192.0.2.") || strings.Contains(line, "c2VjcmV0") {
+		t.Errorf("the log line leaks an address or a secret: %s", line)
+	}
+
+	SetUnsafeLogging(true)
+	defer SetUnsafeLogging(false)
+
+	output.Reset()
+	Errorf("failed to reach %s", "192.0.2.3:80")
+	if line := output.String(); !strings.Contains(line, "192.0.2.3:80") {
+		t.Errorf("the address was scrubbed with unsafe logging: %s", line)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rotation configures when the log file is rotated. The zero value never
+// rotates the file.
+type Rotation struct {
+	// MaxSize is the size in bytes the file can grow to before it is rotated.
+	MaxSize int64
+	// MaxAge is how long the file is written to before it is rotated.
+	MaxAge time.Duration
+	// MaxFiles is the number of rotated files that are kept.
+	MaxFiles int
+	// Compress compresses the rotated files with gzip.
+	Compress bool
+}
+
+// rotatingFile is a log file that is renamed to path.1, path.2 and so on once
+// it grows too large or too old. The transport libraries log to it as well,
+// so it has its own lock.
+type rotatingFile struct {
+	lock     sync.Mutex
+	path     string
+	rotation Rotation
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func openRotatingFile(path string, rotation Rotation) (*rotatingFile, error) {
+	logFile := &rotatingFile{path: path, rotation: rotation}
+	if err := logFile.open(); err != nil {
+		return nil, err
+	}
+
+	return logFile, nil
+}
+
+func (logFile *rotatingFile) open() error {
+	file, err := os.OpenFile(logFile.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	logFile.file = file
+	logFile.size = info.Size()
+	logFile.opened = time.Now()
+	return nil
+}
+
+func (logFile *rotatingFile) Write(p []byte) (int, error) {
+	logFile.lock.Lock()
+	defer logFile.lock.Unlock()
+
+	if logFile.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if logFile.needsRotation(len(p)) {
+		if err := logFile.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	written, err := logFile.file.Write(p)
+	logFile.size += int64(written)
+	return written, err
+}
+
+func (logFile *rotatingFile) needsRotation(length int) bool {
+	if logFile.size == 0 {
+		return false
+	}
+
+	if logFile.rotation.MaxSize > 0 && logFile.size+int64(length) > logFile.rotation.MaxSize {
+		return true
+	}
+
+	return logFile.rotation.MaxAge > 0 && time.Since(logFile.opened) >= logFile.rotation.MaxAge
+}
+
+// rotate moves every rotated file up by one, deleting the oldest, moves the
+// current file to path.1 and starts a new one.
+func (logFile *rotatingFile) rotate() error {
+	if err := logFile.file.Close(); err != nil {
+		return err
+	}
+	logFile.file = nil
+
+	maxFiles := logFile.rotation.MaxFiles
+	removeRotated(logFile.rotatedPath(maxFiles))
+	for number := maxFiles - 1; number >= 1; number-- {
+		for _, suffix := range []string{"", ".gz"} {
+			_ = os.Rename(logFile.rotatedPath(number)+suffix, logFile.rotatedPath(number+1)+suffix)
+		}
+	}
+
+	if maxFiles == 0 {
+		_ = os.Remove(logFile.path)
+	} else if err := os.Rename(logFile.path, logFile.rotatedPath(1)); err != nil {
+		return err
+	} else if logFile.rotation.Compress {
+		if err := compressFile(logFile.rotatedPath(1)); err != nil {
+			return err
+		}
+	}
+
+	return logFile.open()
+}
+
+func (logFile *rotatingFile) rotatedPath(number int) string {
+	return fmt.Sprintf("%s.%d", logFile.path, number)
+}
+
+func removeRotated(path string) {
+	_ = os.Remove(path)
+	_ = os.Remove(path + ".gz")
+}
+
+// compressFile replaces a file with a gzip compressed copy.
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	destination, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		_ = source.Close()
+		return err
+	}
+
+	writer := gzip.NewWriter(destination)
+	if _, err = io.Copy(writer, source); err == nil {
+		err = writer.Close()
+	}
+	_ = source.Close()
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// reopen closes and reopens the file, for when it has been moved by an
+// external tool such as logrotate.
+func (logFile *rotatingFile) reopen() error {
+	logFile.lock.Lock()
+	defer logFile.lock.Unlock()
+
+	if logFile.file != nil {
+		_ = logFile.file.Close()
+		logFile.file = nil
+	}
+
+	return logFile.open()
+}
+
+func (logFile *rotatingFile) Close() error {
+	logFile.lock.Lock()
+	defer logFile.lock.Unlock()
+
+	if logFile.file == nil {
+		return nil
+	}
+
+	err := logFile.file.Close()
+	logFile.file = nil
+	return err
+}
@@ -0,0 +1,113 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRotation tests that the log file is rotated by size, that only the
+// configured number of rotated files is kept and that they are compressed.
+func TestRotation(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "dispatcher.log")
+	logFile, err := openRotatingFile(logPath, Rotation{MaxSize: 10, MaxFiles: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err = logFile.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		logPath:           "fourth\n",
+		logPath + ".1.gz": "third\n",
+		logPath + ".2.gz": "second\n",
+	}
+	for filePath, contents := range expected {
+		if read := readLogFile(t, filePath); read != contents {
+			t.Errorf("%s contains %q, expected %q", filepath.Base(filePath), read, contents)
+		}
+	}
+
+	if _, err = os.Stat(logPath + ".3.gz"); !os.IsNotExist(err) {
+		t.Errorf("more than 2 rotated files were kept")
+	}
+}
+
+// TestReopen tests that the log file is recreated after it has been moved.
+func TestReopen(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "dispatcher.log")
+	logFile, err := openRotatingFile(logPath, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+
+	_, _ = logFile.Write([]byte("before\n"))
+	if err = os.Rename(logPath, logPath+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err = logFile.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = logFile.Write([]byte("after\n"))
+
+	if read := readLogFile(t, logPath); read != "after\n" {
+		t.Errorf("the reopened file contains %q", read)
+	}
+}
+
+func readLogFile(t *testing.T, filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(filePath, ".gz") {
+		gzipReader, gzipError := gzip.NewReader(file)
+		if gzipError != nil {
+			t.Fatal(gzipError)
+		}
+		reader = gzipReader
+	}
+
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
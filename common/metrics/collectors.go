@@ -0,0 +1,129 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// The metrics kept by the dispatcher. Every metric is labelled with the
+// transport name and the proxy mode.
+var (
+	ConnectionsAccepted = NewCounterVec("shapeshifter_dispatcher_connections_accepted_total",
+		"Connections accepted, from applications on the client and from transport clients on the server.",
+		"transport", "mode")
+
+	ConnectionsRejected = NewCounterVec("shapeshifter_dispatcher_connections_rejected_total",
+		"Accepted connections that were closed straight away because of the connection limits, by reason: total, source or rate.",
+		"transport", "mode", "reason")
+
+	ConnectionsActive = NewGaugeVec("shapeshifter_dispatcher_connections_active",
+		"Accepted connections that are still being handled.",
+		"transport", "mode")
+
+	Dials = NewCounterVec("shapeshifter_dispatcher_dials_total",
+		"Connections made by the client to transport servers, by result: success, or the class of the error.",
+		"transport", "mode", "result")
+
+	HandshakeSeconds = NewHistogramVec("shapeshifter_dispatcher_handshake_duration_seconds",
+		"Time taken by the client to connect to the transport server and complete the transport handshake.",
+		DefaultBuckets, "transport", "mode")
+
+	Bytes = NewCounterVec("shapeshifter_dispatcher_bytes_total",
+		"Bytes copied between the application and the transport. Direction out is sent over the transport, in is received from it.",
+		"transport", "mode", "direction")
+
+	UDPPacketsForwarded = NewCounterVec("shapeshifter_dispatcher_udp_packets_forwarded_total",
+		"UDP packets forwarded over a transport connection, or to the target.",
+		"transport", "mode")
+
+	UDPPacketsDropped = NewCounterVec("shapeshifter_dispatcher_udp_packets_dropped_total",
+		"UDP packets dropped, by reason: connecting when the packet opened a new transport connection, waiting while the connection was being made, rejected when a new flow was over the connection limits, or error.",
+		"transport", "mode", "reason")
+
+	ListenerRestarts = NewCounterVec("shapeshifter_dispatcher_listener_restarts_total",
+		"Times a server transport listener was started again after it stopped, for example after a configuration reload.",
+		"transport", "mode")
+)
+
+// Directions for the Bytes metric.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// Reasons for the ConnectionsRejected metric: too many connections in total,
+// from the same source, or accepted too quickly.
+const (
+	RejectTotal  = "total"
+	RejectSource = "source"
+	RejectRate   = "rate"
+)
+
+// Reasons for the UDPPacketsDropped metric.
+const (
+	DropConnecting = "connecting"
+	DropWaiting    = "waiting"
+	DropRejected   = "rejected"
+	DropError      = "error"
+)
+
+// DialResult is the value of the result label of the Dials metric for the
+// outcome of a dial.
+func DialResult(err error) string {
+	if err == nil {
+		return "success"
+	}
+
+	return ErrorClass(err)
+}
+
+// ErrorClass puts a network error into one of a few classes that can be used
+// as a label value.
+func ErrorClass(err error) string {
+	var dnsError *net.DNSError
+	var netError net.Error
+
+	switch {
+	case errors.As(err, &dnsError):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &netError) && netError.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// The server closed the connection during the handshake.
+		return "closed"
+	default:
+		return "other"
+	}
+}
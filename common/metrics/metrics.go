@@ -0,0 +1,313 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package metrics keeps the dispatcher's counters, gauges and histograms and
+// serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the duration
+// histograms. They are the same as the Prometheus client defaults.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is one metric family, with a series for every combination of label
+// values that has been used.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock   sync.Mutex
+	series map[string]interface{}
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []*metric
+)
+
+func register(name string, help string, kind string, labels []string) *metric {
+	newMetric := &metric{name: name, help: help, kind: kind, labels: labels, series: make(map[string]interface{})}
+
+	registryLock.Lock()
+	registry = append(registry, newMetric)
+	registryLock.Unlock()
+
+	return newMetric
+}
+
+// with returns the series for the label values, creating it with create the
+// first time the values are used.
+func (metric *metric) with(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(metric.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", metric.name, len(metric.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+
+	metric.lock.Lock()
+	defer metric.lock.Unlock()
+
+	series, ok := metric.series[key]
+	if !ok {
+		series = create()
+		metric.series[key] = series
+	}
+
+	return series
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	bits uint64
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Add(value float64) {
+	addFloat(&counter.bits, value)
+}
+
+func (counter *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&counter.bits))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.Add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.Add(-1)
+}
+
+func (gauge *Gauge) Add(value float64) {
+	addFloat(&gauge.bits, value)
+}
+
+func (gauge *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&gauge.bits))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	for index, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[index]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+func addFloat(bits *uint64, value float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
+
+// CounterVec is a counter with labels.
+type CounterVec struct {
+	metric *metric
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{register(name, help, "counter", labels)}
+}
+
+// With returns the counter for the label values, which must be given in the
+// order the labels were declared.
+func (vec *CounterVec) With(labelValues ...string) *Counter {
+	return vec.metric.with(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// GaugeVec is a gauge with labels.
+type GaugeVec struct {
+	metric *metric
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{register(name, help, "gauge", labels)}
+}
+
+func (vec *GaugeVec) With(labelValues ...string) *Gauge {
+	return vec.metric.with(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// HistogramVec is a histogram with labels.
+type HistogramVec struct {
+	metric  *metric
+	buckets []float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{register(name, help, "histogram", labels), buckets}
+}
+
+func (vec *HistogramVec) With(labelValues ...string) *Histogram {
+	return vec.metric.with(labelValues, func() interface{} {
+		return &Histogram{buckets: vec.buckets, counts: make([]uint64, len(vec.buckets))}
+	}).(*Histogram)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func WriteText(output io.Writer) error {
+	registryLock.Lock()
+	metrics := append([]*metric(nil), registry...)
+	registryLock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	var builder strings.Builder
+	for _, metric := range metrics {
+		metric.writeText(&builder)
+	}
+
+	_, err := io.WriteString(output, builder.String())
+	return err
+}
+
+func (metric *metric) writeText(builder *strings.Builder) {
+	metric.lock.Lock()
+	defer metric.lock.Unlock()
+
+	fmt.Fprintf(builder, "# HELP %s %s\n", metric.name, escapeHelp(metric.help))
+	fmt.Fprintf(builder, "# TYPE %s %s\n", metric.name, metric.kind)
+
+	keys := make([]string, 0, len(metric.series))
+	for key := range metric.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labels := formatLabels(metric.labels, strings.Split(key, "\x00"))
+
+		switch series := metric.series[key].(type) {
+		case *Counter:
+			fmt.Fprintf(builder, "%s%s %s\n", metric.name, braces(labels), formatValue(series.Value()))
+		case *Gauge:
+			fmt.Fprintf(builder, "%s%s %s\n", metric.name, braces(labels), formatValue(series.Value()))
+		case *Histogram:
+			series.lock.Lock()
+			for index, bound := range series.buckets {
+				fmt.Fprintf(builder, "%s_bucket%s %d\n", metric.name, braces(joinLabels(labels, "le=\""+formatValue(bound)+"\"")), series.counts[index])
+			}
+			fmt.Fprintf(builder, "%s_bucket%s %d\n", metric.name, braces(joinLabels(labels, "le=\"+Inf\"")), series.count)
+			fmt.Fprintf(builder, "%s_sum%s %s\n", metric.name, braces(labels), formatValue(series.sum))
+			fmt.Fprintf(builder, "%s_count%s %d\n", metric.name, braces(labels), series.count)
+			series.lock.Unlock()
+		}
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	pairs := make([]string, len(names))
+	for index, name := range names {
+		pairs[index] = name + "=\"" + escapeLabel(values[index]) + "\""
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels string, extra string) string {
+	if labels == "" {
+		return extra
+	}
+
+	return labels + "," + extra
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+// Handler serves the metrics to Prometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WriteText(writer)
+	})
+}
@@ -0,0 +1,101 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestWriteText tests the text format of each kind of metric.
+func TestWriteText(t *testing.T) {
+	counter := NewCounterVec("test_counter_total", "A test counter.", "transport")
+	counter.With("shadow").Add(3)
+	counter.With("a\"b").Inc()
+
+	gauge := NewGaugeVec("test_gauge", "A test gauge.", "transport")
+	gauge.With("shadow").Inc()
+	gauge.With("shadow").Inc()
+	gauge.With("shadow").Dec()
+
+	histogram := NewHistogramVec("test_histogram_seconds", "A test histogram.", []float64{0.5, 1}, "transport")
+	histogram.With("shadow").Observe(0.25)
+	histogram.With("shadow").Observe(2)
+
+	var output strings.Builder
+	if err := WriteText(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# TYPE test_counter_total counter",
+		`test_counter_total{transport="a\"b"} 1`,
+		`test_counter_total{transport="shadow"} 3`,
+		"# TYPE test_gauge gauge",
+		`test_gauge{transport="shadow"} 1`,
+		"# TYPE test_histogram_seconds histogram",
+		`test_histogram_seconds_bucket{transport="shadow",le="0.5"} 1`,
+		`test_histogram_seconds_bucket{transport="shadow",le="1"} 1`,
+		`test_histogram_seconds_bucket{transport="shadow",le="+Inf"} 2`,
+		`test_histogram_seconds_sum{transport="shadow"} 2.25`,
+		`test_histogram_seconds_count{transport="shadow"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("WriteText() is missing %q", line)
+		}
+	}
+}
+
+// TestErrorClass tests the classes given to dial errors.
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{nil, "success"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, "dns"},
+		{&net.OpError{Op: "dial", Err: &timeoutError{}}, "timeout"},
+		{io.EOF, "closed"},
+		{errors.New("something else"), "other"},
+	}
+
+	for _, test := range tests {
+		if class := DialResult(test.err); class != test.class {
+			t.Errorf("DialResult(%v) = %q, expected %q", test.err, class, test.class)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
@@ -25,83 +25,29 @@ SOFTWARE.
 package pt_extras
 
 import (
-	"errors"
 	"net"
-	"strings"
 
 	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
-	"github.com/kataras/golog"
 	"golang.org/x/net/proxy"
 )
 
-// target is the server address string
+// ArgsToDialer builds the client of the named transport from its options.
+// dialer connects to the transport server.
 func ArgsToDialer(name string, args string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
-	switch strings.ToLower(name) {
-	case "shadow":
-		transport, err := transports.ParseArgsShadow(args, enableLocket, logDir)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
-		}
-	case "optimizer":
-		transport, err := transports.ParseArgsOptimizer(args, dialer, enableLocket, logDir)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
-		}
-	case "replicant":
-		transport, err := transports.ParseArgsReplicantClient(args, dialer)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
-		}
-	case "starbridge":
-		transport, err := transports.ParseArgsStarbridgeClient(args, dialer)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
-		}
-
-	default:
-		golog.Errorf("Unknown transport: %s", name)
-		return nil, errors.New("unknown transport")
+	transport, err := transports.Default.Dialer(name, args, transports.Environment{Dialer: dialer, EnableLocket: enableLocket, LogDir: logDir})
+	if err != nil {
+		log.Errorf("could not parse options: %s", err.Error())
+		return nil, err
 	}
-}
-
-func ArgsToListener(name string, stateDir string, options string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
-	switch strings.ToLower(name) {
-	case "replicant":
-		config, err := transports.ParseArgsReplicantServer(options)
-		if err != nil {
-			return nil, errors.New("could not parse Replicant options")
-		}
 
-		return config.Listen, nil
-	case "starbridge":
-		config, err := transports.ParseArgsStarbridgeServer(options)
-		if err != nil {
-			return nil, errors.New("could not parse Starbridge options")
-		}
-
-		return config.Listen, nil
-	case "shadow":
-		config, err := transports.ParseArgsShadowServer(options, enableLocket, logDir)
-		if err != nil {
-			return nil, err
-		}
+	return transport, nil
+}
 
-		return config.Listen, nil
-	default:
-		println("unsupported transport name: ", name)
-		return nil, errors.New("unknown transport")
-	}
+// ArgsToListener builds the function that starts the server of the named
+// transport from its options. The server listens on listenAddr, the bindaddr,
+// or where its options say if listenAddr is empty.
+func ArgsToListener(name string, stateDir string, options string, enableLocket bool, logDir string, listenAddr string) (func() (net.Listener, error), error) {
+	return transports.Default.Listener(name, options, transports.Environment{EnableLocket: enableLocket, LogDir: logDir, ListenAddr: listenAddr})
 }
@@ -0,0 +1,200 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxy.FromURL only knows SOCKS5, so the other upstream proxies accepted by
+// ParseProxyURI are registered with it here.
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+	proxy.RegisterDialerType("socks4a", newSOCKS4aDialer)
+}
+
+// proxyAddress returns the address of the proxy, using the default port of
+// its protocol if the URI has none.
+func proxyAddress(uri *url.URL, defaultPort string) string {
+	if uri.Port() != "" {
+		return uri.Host
+	}
+
+	return net.JoinHostPort(uri.Hostname(), defaultPort)
+}
+
+// httpConnectDialer connects through an HTTP proxy with the CONNECT method,
+// with basic authentication if the proxy URI has a username.
+type httpConnectDialer struct {
+	proxyAddr string
+	user      *url.Userinfo
+	forward   proxy.Dialer
+}
+
+func newHTTPConnectDialer(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpConnectDialer{proxyAddr: proxyAddress(uri, "80"), user: uri.User, forward: forward}, nil
+}
+
+func (dialer *httpConnectDialer) Dial(network string, addr string) (net.Conn, error) {
+	conn, err := dialer.forward.Dial(network, dialer.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+
+	// An empty User-Agent keeps Go from sending its own.
+	request.Header.Set("User-Agent", "")
+	if dialer.user != nil {
+		password, _ := dialer.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(dialer.user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err = request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to send the request to the HTTP proxy: %s", err.Error())
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read the response of the HTTP proxy: %s", err.Error())
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("the HTTP proxy refused the connection: %s", response.Status)
+	}
+
+	// The server may already have sent data after the response.
+	if reader.Buffered() > 0 {
+		return &bufferedConn{conn, reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads what is left in its reader before reading from the
+// connection.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn *bufferedConn) Read(buffer []byte) (int, error) {
+	return conn.reader.Read(buffer)
+}
+
+// socks4aDialer connects through a SOCKS4a proxy, which resolves the host
+// names itself. The username of the proxy URI is sent as the user ID.
+type socks4aDialer struct {
+	proxyAddr string
+	userID    string
+	forward   proxy.Dialer
+}
+
+const (
+	socks4Version = 4
+	socks4Connect = 1
+	socks4Granted = 90
+)
+
+func newSOCKS4aDialer(uri *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer := &socks4aDialer{proxyAddr: proxyAddress(uri, "1080"), forward: forward}
+	if uri.User != nil {
+		dialer.userID = uri.User.Username()
+	}
+
+	return dialer, nil
+}
+
+func (dialer *socks4aDialer) Dial(network string, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+
+	// Host names are sent after the user ID, with the address set to
+	// 0.0.0.1.
+	request := []byte{socks4Version, socks4Connect, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		request = append(request, ip...)
+	} else {
+		request = append(request, 0, 0, 0, 1)
+	}
+	request = append(request, dialer.userID...)
+	request = append(request, 0)
+	if ip == nil {
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+
+	conn, err := dialer.forward.Dial(network, dialer.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(request); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to send the request to the SOCKS4a proxy: %s", err.Error())
+	}
+
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read the reply of the SOCKS4a proxy: %s", err.Error())
+	}
+
+	if reply[1] != socks4Granted {
+		_ = conn.Close()
+		return nil, errors.New("the SOCKS4a proxy refused the connection with code " + strconv.Itoa(int(reply[1])))
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,152 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// serveProxy accepts one connection, runs handshake on it and, if that
+// succeeds, echoes whatever follows.
+func serveProxy(t *testing.T, handshake func(conn net.Conn) bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+
+		if handshake(conn) {
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func dialThroughProxy(t *testing.T, uri string) (net.Conn, error) {
+	spec, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := proxy.FromURL(spec, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dialer.Dial("tcp", "example.com:443")
+}
+
+func checkTunnel(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("read %q through the proxy, expected %q", reply, "ping")
+	}
+}
+
+func httpProxy(t *testing.T, status int) string {
+	return serveProxy(t, func(conn net.Conn) bool {
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		if request.Method != http.MethodConnect || request.Host != "example.com:443" {
+			t.Errorf("got %s %s, expected CONNECT example.com:443", request.Method, request.Host)
+		}
+		if got := request.Header.Get("Proxy-Authorization"); got != "Basic dXNlcjpwYXNzd29yZA==" {
+			t.Errorf("got Proxy-Authorization %q", got)
+		}
+
+		response := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		_ = response.Write(conn)
+		return status == http.StatusOK
+	})
+}
+
+// TestHTTPConnectDialer tests that connections go through an HTTP proxy with
+// CONNECT and basic authentication, and fail when the proxy refuses them.
+func TestHTTPConnectDialer(t *testing.T) {
+	conn, err := dialThroughProxy(t, "http://user:password@"+httpProxy(t, http.StatusOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTunnel(t, conn)
+
+	_, err = dialThroughProxy(t, "http://user:password@"+httpProxy(t, http.StatusProxyAuthRequired))
+	if err == nil {
+		t.Fatal("a refused CONNECT succeeded")
+	}
+}
+
+// TestSOCKS4aDialer tests that host names are sent to a SOCKS4a proxy for it to
+// resolve.
+func TestSOCKS4aDialer(t *testing.T) {
+	address := serveProxy(t, func(conn net.Conn) bool {
+		// The request for a host name: version, command, port, 0.0.0.1, the
+		// user ID and the host name, each string ending with a zero.
+		want := "\x04\x01\x01\xbb\x00\x00\x00\x01user\x00example.com\x00"
+		request := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			t.Error(err)
+			return false
+		}
+		if string(request) != want {
+			t.Errorf("got request %q, expected %q", request, want)
+		}
+
+		_, _ = conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+		return true
+	})
+
+	conn, err := dialThroughProxy(t, "socks4a://user@"+address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTunnel(t, conn)
+}
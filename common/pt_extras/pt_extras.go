@@ -38,6 +38,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+	"golang.org/x/net/proxy"
 )
 
 // This file contains things that probably should be in goptlib but are not
@@ -54,33 +57,52 @@ func PtProxyDone() {
 	_, _ = io.Writer.Write(syncWriter{os.Stdout}, line)
 }
 
-func PtGetProxy(proxy *string) (*url.URL, error) {
+// PtGetProxy parses the upstream proxy URI and checks that a dialer can be
+// made for it, reporting any problem on the PT protocol channel with
+// PROXY-ERROR.
+func PtGetProxy(proxySpec *string) (*url.URL, error) {
 	var specString string
 
-	if proxy != nil {
-		specString = *proxy
+	if proxySpec != nil {
+		specString = *proxySpec
 	} else {
 		return nil, errors.New("no proxy specified")
 	}
 	if specString == "" {
 		return nil, nil
 	}
+
+	spec, err := ParseProxyURI(specString)
+	if err != nil {
+		return nil, ptProxyError(err.Error())
+	}
+
+	if _, err = proxy.FromURL(spec, proxy.Direct); err != nil {
+		return nil, ptProxyError(fmt.Sprintf("failed to use the proxy: %s", err))
+	}
+
+	return spec, nil
+}
+
+// ParseProxyURI checks an upstream proxy URI without reporting problems on
+// the PT protocol channel.
+func ParseProxyURI(specString string) (*url.URL, error) {
 	spec, err := url.Parse(specString)
 	if err != nil {
-		return nil, ptProxyError(fmt.Sprintf("failed to parse proxy config: %s", err))
+		return nil, fmt.Errorf("failed to parse proxy config: %s", err)
 	}
 
 	if !spec.IsAbs() {
-		return nil, ptProxyError("proxy URI is relative, must be absolute")
+		return nil, errors.New("proxy URI is relative, must be absolute")
 	}
 	if spec.Path != "" {
-		return nil, ptProxyError("proxy URI has a path defined")
+		return nil, errors.New("proxy URI has a path defined")
 	}
 	if spec.RawQuery != "" {
-		return nil, ptProxyError("proxy URI has a query defined")
+		return nil, errors.New("proxy URI has a query defined")
 	}
 	if spec.Fragment != "" {
-		return nil, ptProxyError("proxy URI has a fragment defined")
+		return nil, errors.New("proxy URI has a fragment defined")
 	}
 
 	switch spec.Scheme {
@@ -91,7 +113,7 @@ func PtGetProxy(proxy *string) (*url.URL, error) {
 		if spec.User != nil {
 			_, isSet := spec.User.Password()
 			if isSet {
-				return nil, ptProxyError("proxy URI specified SOCKS4a and a password")
+				return nil, errors.New("proxy URI specified SOCKS4a and a password")
 			}
 		}
 
@@ -101,20 +123,20 @@ func PtGetProxy(proxy *string) (*url.URL, error) {
 			user := spec.User.Username()
 			passwd, isSet := spec.User.Password()
 			if len(user) < 1 || len(user) > 255 {
-				return nil, ptProxyError("proxy URI specified a invalid SOCKS5 username")
+				return nil, errors.New("proxy URI specified a invalid SOCKS5 username")
 			}
 			if !isSet || len(passwd) < 1 || len(passwd) > 255 {
-				return nil, ptProxyError("proxy URI specified a invalid SOCKS5 password")
+				return nil, errors.New("proxy URI specified a invalid SOCKS5 password")
 			}
 		}
 
 	default:
-		return nil, ptProxyError(fmt.Sprintf("proxy URI has invalid scheme: %s", spec.Scheme))
+		return nil, fmt.Errorf("proxy URI has invalid scheme: %s", spec.Scheme)
 	}
 
 	_, err = resolveAddrStr(spec.Host)
 	if err != nil {
-		return nil, ptProxyError(fmt.Sprintf("proxy URI has invalid host: %s", err))
+		return nil, fmt.Errorf("proxy URI has invalid host: %s", err)
 	}
 
 	return spec, nil
@@ -201,6 +223,16 @@ func ResolveAddr(addrStr string) (*net.TCPAddr, error) {
 	return &net.TCPAddr{IP: ip, Port: port}, nil
 }
 
+// ResolveBindaddr resolves the address of a bindaddr like ResolveAddr, except
+// that the host may be left out to listen on every interface, as in ":0".
+func ResolveBindaddr(addrStr string) (*net.TCPAddr, error) {
+	if strings.HasPrefix(addrStr, ":") {
+		addrStr = "0.0.0.0" + addrStr
+	}
+
+	return ResolveAddr(addrStr)
+}
+
 // Return a new slice, the members of which are those members of addrs having a
 // MethodName in methodNames.
 func FilterBindaddrs(addrs []Bindaddr, methodNames []string) []Bindaddr {
@@ -218,15 +250,20 @@ func FilterBindaddrs(addrs []Bindaddr, methodNames []string) []Bindaddr {
 	return result
 }
 
-func DialOr(info *ServerInfo, addr, methodName string) (*net.TCPConn, error) {
-	if info.ExtendedOrAddr == nil || info.AuthCookiePath == "" {
-		return net.DialTCP("tcp", nil, info.OrAddr)
+// DialOr connects to the ORPort, or to the Extended ORPort if there is one,
+// giving up after timeout unless it is zero.
+func DialOr(info *ServerInfo, addr, methodName string, timeout time.Duration) (*net.TCPConn, error) {
+	orAddr := info.OrAddr
+	if info.ExtendedOrAddr != nil && info.AuthCookiePath != "" {
+		orAddr = info.ExtendedOrAddr
 	}
 
-	s, err := net.DialTCP("tcp", nil, info.ExtendedOrAddr)
+	conn, err := net.DialTimeout("tcp", orAddr.String(), timeout)
 	if err != nil {
 		return nil, err
 	}
+
+	s := conn.(*net.TCPConn)
 	s.SetDeadline(time.Now().Add(5 * time.Second))
 	s.SetDeadline(time.Time{})
 
@@ -242,15 +279,24 @@ type syncWriter struct {
 	*os.File
 }
 
+// ParsePT2ClientParameters parses the PT 2.1 parameter block, which is either
+// a JSON object or a transport URI.
 func ParsePT2ClientParameters(s string) (map[string]interface{}, error) {
 	if len(s) == 0 {
 		return nil, errors.New("cannot use empty string")
 	}
 
+	if transports.IsURI(s) {
+		_, options, err := transports.DecodeURI(s)
+		if err != nil {
+			return nil, err
+		}
+		s = options
+	}
+
 	decoder := json.NewDecoder(strings.NewReader(s))
 	var result map[string]interface{}
 	if err := decoder.Decode(&result); err != nil {
-		fmt.Errorf("Error decoding JSON %q", err)
 		return nil, err
 	}
 	return result, nil
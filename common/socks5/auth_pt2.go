@@ -55,9 +55,9 @@ func (req *Request) authPT2() (err error) {
 	var result = string(data)
 
 	// Parse the authentication data according to the PT 2.0 specification
-	if req.Args, err = pt_extras.ParsePT2ClientParameters(result); err != nil {
-		fmt.Println("Error parsing PT2 client parameters", err)
-		return
+	req.Args, err = pt_extras.ParsePT2ClientParameters(result)
+	if err == nil {
+		req.Options = result
 	}
 
 	return
@@ -46,7 +46,8 @@ import (
 	"net"
 	"syscall"
 	"time"
-	"github.com/kataras/golog"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 )
 
 const (
@@ -120,7 +121,12 @@ func ErrorToReplyCode(err error) ReplyCode {
 type Request struct {
 	Target string
 	Args   map[string]interface{}
-	rw     *bufio.ReadWriter
+
+	// Options is the PT 2.1 parameter block as it was sent, which is handed
+	// to the transport.
+	Options string
+
+	rw *bufio.ReadWriter
 }
 
 // Handshake attempts to handle a incoming client handshake over the provided
@@ -164,6 +170,18 @@ func Handshake(conn net.Conn, needOptions bool) (*Request, error) {
 	return req, err
 }
 
+// Reject refuses an incoming client handshake, without reading it, by
+// answering that none of the client's authentication methods is acceptable.
+// It does not close the connection.
+func Reject(conn net.Conn) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return err
+	}
+
+	_, err := conn.Write([]byte{version, authNoAcceptableMethods})
+	return err
+}
+
 // Reply sends a SOCKS5 reply to the corresponding request.  The BND.ADDR and
 // BND.PORT fields are always set to an address/port corresponding to
 // "0.0.0.0:0".
@@ -197,7 +215,7 @@ func (req *Request) NegotiateAuth(needOptions bool) (byte, error) {
 
 	var err error
 	if err = req.readByteVerify("version", version); err != nil {
-		golog.Errorf("error in NegotiateAuth: %s", err)
+		log.Debugf("error in NegotiateAuth: %s", err)
 		return 0, err
 	}
 
@@ -235,7 +253,7 @@ func (req *Request) NegotiateAuth(needOptions bool) (byte, error) {
 	if _, err = req.rw.Write(msg); err != nil {
 		return 0, err
 	}
-	println("this is the authentication method the socks server is sending: ", version, method)
+	log.Debugf("negotiated SOCKS authentication method 0x%02x", method)
 
 	return method, req.flushBuffers()
 }
@@ -245,7 +263,7 @@ func (req *Request) authenticate(method byte) error {
 	case authNoneRequired:
 		// No authentication required.
 	case AuthJsonParameterBlock:
-		golog.Info("AuthJsonParameterBlock reached")
+		log.Debugf("reading the PT 2.1 parameter block")
 		if err := req.authPT2(); err != nil {
 			return err
 		}
@@ -271,7 +289,7 @@ func (req *Request) readCommand() error {
 
 	var err error
 	if err = req.readByteVerify("version", version); err != nil {
-		golog.Errorf("error in readCommand: %s", err)
+		log.Debugf("error in readCommand: %s", err)
 		_ = req.Reply(ReplyGeneralFailure)
 		return err
 	}
@@ -0,0 +1,589 @@
+/*
+	MIT License
+
+	Copyright (c) 2020 Operator Foundation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in all
+	copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/dispatcher"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+const (
+	roleClient = "client"
+	roleServer = "server"
+)
+
+// dispatcherConfig is everything needed to run the dispatcher. It is either
+// read from the file given with -config or assembled from the command line
+// flags, and is validated the same way in both cases.
+type dispatcherConfig struct {
+	Role             string            `json:"role"`
+	Mode             string            `json:"mode"`
+	StateDir         string            `json:"stateDir"`
+	ProxyListenAddr  string            `json:"proxyListenAddr"`
+	Target           string            `json:"target"`
+	ExtOrPort        string            `json:"extOrPort"`
+	AuthCookie       string            `json:"authCookie"`
+	Proxy            string            `json:"proxy"`
+	EnableLocket     bool              `json:"enableLocket"`
+	ExitOnStdinClose bool              `json:"exitOnStdinClose"`
+	MetricsAddr      string            `json:"metricsAddr"`
+	AdminAddr        string            `json:"adminAddr"`
+	AdminTokenFile   string            `json:"adminTokenFile"`
+	Accounting       bool              `json:"accounting"`
+	Limits           limitsConfig      `json:"limits"`
+	Shaping          shapingConfig     `json:"shaping"`
+	Timeouts         timeoutsConfig    `json:"timeouts"`
+	KeepAlive        keepAliveConfig   `json:"keepAlive"`
+	Transports       []transportConfig `json:"transports"`
+	Options          json.RawMessage   `json:"options"`
+	OptionsFile      string            `json:"optionsFile"`
+	Logging          loggingConfig     `json:"logging"`
+}
+
+type transportConfig struct {
+	Name     string `json:"name"`
+	Bindaddr string `json:"bindaddr"`
+
+	// Options and OptionsFile give a server transport options of its own,
+	// in place of the options shared by every transport.
+	Options     json.RawMessage `json:"options"`
+	OptionsFile string          `json:"optionsFile"`
+}
+
+type loggingConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Level    string `json:"level"`
+	IPCLevel string `json:"ipcLevel"`
+	Format   string `json:"format"`
+	Unsafe   bool   `json:"unsafe"`
+	MaxSize  int64  `json:"maxSize"`
+	MaxAge   string `json:"maxAge"`
+	MaxFiles int    `json:"maxFiles"`
+	Compress bool   `json:"compress"`
+}
+
+type limitsConfig struct {
+	MaxConnections int     `json:"maxConnections"`
+	MaxPerSource   int     `json:"maxPerSource"`
+	IPv4Prefix     int     `json:"ipv4Prefix"`
+	IPv6Prefix     int     `json:"ipv6Prefix"`
+	AcceptRate     float64 `json:"acceptRate"`
+	AcceptBurst    int     `json:"acceptBurst"`
+}
+
+// bandwidthConfig holds rates in bytes per second, with an optional K, M or
+// G suffix, such as "512K" or "10M".
+type bandwidthConfig struct {
+	Upload   string `json:"upload"`
+	Download string `json:"download"`
+}
+
+type shapingConfig struct {
+	bandwidthConfig
+	PerConnection bandwidthConfig            `json:"perConnection"`
+	Transports    map[string]bandwidthConfig `json:"transports"`
+}
+
+// timeoutsConfig holds durations such as "30s" or "5m". An empty or zero
+// duration disables the timeout.
+type timeoutsConfig struct {
+	Dial      string `json:"dial"`
+	Handshake string `json:"handshake"`
+	Idle      string `json:"idle"`
+	Write     string `json:"write"`
+}
+
+// keepAliveConfig holds durations such as "30s". A negative period disables
+// TCP keepalives and an empty or zero heartbeat disables heartbeats.
+type keepAliveConfig struct {
+	Period    string `json:"period"`
+	Heartbeat string `json:"heartbeat"`
+}
+
+// configProblems collects every problem found in a configuration so that they
+// can all be reported at once.
+type configProblems []string
+
+func (problems *configProblems) add(format string, args ...interface{}) {
+	*problems = append(*problems, fmt.Sprintf(format, args...))
+}
+
+func (problems configProblems) Error() string {
+	return strings.Join(problems, "\n")
+}
+
+// loadConfigFile reads a JSON configuration file. Settings that are missing
+// from the file get the same defaults as the command line flags.
+func loadConfigFile(configPath string) (*dispatcherConfig, error) {
+	contents, readErr := os.ReadFile(configPath)
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read the config file %s: %s", configPath, readErr.Error())
+	}
+
+	config := &dispatcherConfig{
+		Role:     roleClient,
+		Mode:     dispatcher.ModeSocks5,
+		StateDir: "state",
+		Logging: loggingConfig{
+			Level:    "ERROR",
+			IPCLevel: "NONE",
+			Format:   log.FormatText,
+			MaxSize:  defaultLogMaxSize,
+			MaxFiles: defaultLogMaxFiles,
+		},
+		Limits: limitsConfig{
+			IPv4Prefix:  dispatcher.DefaultIPv4Prefix,
+			IPv6Prefix:  dispatcher.DefaultIPv6Prefix,
+			AcceptBurst: 1,
+		},
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if decodeErr := decoder.Decode(config); decodeErr != nil {
+		return nil, fmt.Errorf("failed to parse the config file %s: %s", configPath, decodeErr.Error())
+	}
+
+	return config, nil
+}
+
+// options returns the transport options as the string handed to the
+// transports. The options may be given in the config file either as a JSON
+// object or as a string containing one.
+func (config *dispatcherConfig) options() (string, error) {
+	return parseOptions(config.Options)
+}
+
+// options returns the options of the transport itself, if any.
+func (transport transportConfig) options() (string, error) {
+	return parseOptions(transport.Options)
+}
+
+func parseOptions(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	var options string
+	if json.Unmarshal(raw, &options) == nil {
+		return options, nil
+	}
+
+	var object map[string]interface{}
+	if objectErr := json.Unmarshal(raw, &object); objectErr != nil {
+		return "", fmt.Errorf("options must be a JSON object or a string: %s", objectErr.Error())
+	}
+
+	return string(raw), nil
+}
+
+// adminToken reads the admin API token from its file. Without a file, the
+// dispatcher creates a token in the state directory.
+func (config *dispatcherConfig) adminToken() (string, error) {
+	if config.AdminTokenFile == "" {
+		return "", nil
+	}
+
+	contents, err := os.ReadFile(config.AdminTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read the admin token file: %s", err.Error())
+	}
+
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("the admin token file %s is empty", config.AdminTokenFile)
+	}
+
+	return token, nil
+}
+
+// rotation returns when the log file is rotated. The maximum size is given in
+// megabytes.
+func (logging loggingConfig) rotation() log.Rotation {
+	maxAge, _ := time.ParseDuration(logging.MaxAge)
+
+	return log.Rotation{
+		MaxSize:  logging.MaxSize * 1024 * 1024,
+		MaxAge:   maxAge,
+		MaxFiles: logging.MaxFiles,
+		Compress: logging.Compress,
+	}
+}
+
+func (config *dispatcherConfig) isClient() bool {
+	return config.Role == roleClient
+}
+
+// validate checks the configuration and adds every problem it finds.
+func (config *dispatcherConfig) validate(problems *configProblems) {
+	switch config.Role {
+	case roleClient, roleServer:
+	default:
+		problems.add("role must be %q or %q, not %q", roleClient, roleServer, config.Role)
+	}
+
+	switch config.Mode {
+	case dispatcher.ModeSocks5, dispatcher.ModeTransparentTCP, dispatcher.ModeTransparentUDP, dispatcher.ModeSTUN:
+	default:
+		problems.add("invalid mode %q, use %s, %s, %s or %s", config.Mode, dispatcher.ModeSocks5, dispatcher.ModeTransparentTCP, dispatcher.ModeTransparentUDP, dispatcher.ModeSTUN)
+	}
+
+	if len(config.Transports) == 0 {
+		problems.add("no transports are enabled")
+	}
+
+	for _, transport := range config.Transports {
+		if transport.Name == "" {
+			problems.add("every transport needs a name")
+			continue
+		}
+
+		if transport.Name != "*" && !isKnownTransport(transport.Name) {
+			problems.add("unknown transport %q, supported transports are %s", transport.Name, strings.Join(transports.Transports(), ", "))
+		}
+
+		if config.isClient() {
+			if transport.Bindaddr != "" {
+				problems.add("%s: a bind address can only be used in server mode", transport.Name)
+			}
+		} else if transport.Bindaddr == "" {
+			problems.add("%s: a bind address is required in server mode", transport.Name)
+		} else if _, err := pt_extras.ResolveBindaddr(transport.Bindaddr); err != nil {
+			problems.add("%s: invalid bind address %q: %s", transport.Name, transport.Bindaddr, err.Error())
+		}
+
+		if len(transport.Options) != 0 || transport.OptionsFile != "" {
+			if config.isClient() {
+				problems.add("%s: options of its own can only be given to a transport in server mode", transport.Name)
+			}
+			if len(transport.Options) != 0 && transport.OptionsFile != "" {
+				problems.add("%s: options and optionsFile cannot be used at the same time", transport.Name)
+			}
+			if _, err := transport.options(); err != nil {
+				problems.add("%s: %s", transport.Name, err.Error())
+			}
+			if transport.OptionsFile != "" {
+				if _, err := os.Stat(transport.OptionsFile); err != nil {
+					problems.add("%s: cannot use the options file: %s", transport.Name, err.Error())
+				}
+			}
+		}
+	}
+
+	if len(config.Options) != 0 && config.OptionsFile != "" {
+		problems.add("options and optionsFile cannot be used at the same time")
+	}
+
+	if _, err := config.options(); err != nil {
+		problems.add("%s", err.Error())
+	}
+
+	if config.OptionsFile != "" {
+		if _, err := os.Stat(config.OptionsFile); err != nil {
+			problems.add("cannot use the options file: %s", err.Error())
+		}
+	}
+
+	if config.isClient() {
+		if config.Target != "" {
+			problems.add("target cannot be used in client mode, the server address is part of the transport options")
+		}
+		if config.ExtOrPort != "" || config.AuthCookie != "" {
+			problems.add("extOrPort and authCookie can only be used in server mode")
+		}
+	} else {
+		if config.Target == "" {
+			problems.add("a target is required in server mode")
+		} else if _, err := pt_extras.ResolveAddr(config.Target); err != nil {
+			problems.add("invalid target %q: %s", config.Target, err.Error())
+		}
+
+		if config.ExtOrPort != "" {
+			if _, err := pt_extras.ResolveAddr(config.ExtOrPort); err != nil {
+				problems.add("invalid extOrPort %q: %s", config.ExtOrPort, err.Error())
+			}
+		}
+
+		if config.ProxyListenAddr != "" {
+			problems.add("proxyListenAddr can only be used in client mode")
+		}
+		if config.Proxy != "" {
+			problems.add("proxy can only be used in client mode")
+		}
+	}
+
+	if config.MetricsAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", config.MetricsAddr); err != nil {
+			problems.add("invalid metricsAddr %q: %s", config.MetricsAddr, err.Error())
+		}
+	}
+
+	limits := config.Limits
+	if limits.MaxConnections < 0 || limits.MaxPerSource < 0 || limits.AcceptRate < 0 || limits.AcceptBurst < 0 {
+		problems.add("the connection limits cannot be negative")
+	}
+	if limits.IPv4Prefix < 1 || limits.IPv4Prefix > 32 {
+		problems.add("the IPv4 source prefix must be between 1 and 32, not %d", limits.IPv4Prefix)
+	}
+	if limits.IPv6Prefix < 1 || limits.IPv6Prefix > 128 {
+		problems.add("the IPv6 source prefix must be between 1 and 128, not %d", limits.IPv6Prefix)
+	}
+
+	config.Shaping.bandwidthConfig.validate(problems, "shaping")
+	config.Shaping.PerConnection.validate(problems, "shaping perConnection")
+	for name, bandwidth := range config.Shaping.Transports {
+		if !isKnownTransport(name) {
+			problems.add("shaping: unknown transport %q", name)
+		}
+		bandwidth.validate(problems, "shaping "+name)
+	}
+
+	config.Timeouts.validate(problems)
+	config.KeepAlive.validate(problems)
+	if heartbeat, _ := parseTimeout(config.KeepAlive.Heartbeat); heartbeat > 0 && (config.Mode != dispatcher.ModeTransparentUDP || !config.isClient()) {
+		problems.add("heartbeats are only sent by the client in %s mode", dispatcher.ModeTransparentUDP)
+	}
+
+	if config.AdminAddr != "" && !strings.HasPrefix(config.AdminAddr, "unix:") {
+		if host, _, err := net.SplitHostPort(config.AdminAddr); err != nil {
+			problems.add("invalid adminAddr %q: %s", config.AdminAddr, err.Error())
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			problems.add("adminAddr must be a loopback address or a unix socket, not %q", config.AdminAddr)
+		}
+	}
+
+	if config.AdminTokenFile != "" {
+		if config.AdminAddr == "" {
+			problems.add("adminTokenFile can only be used with adminAddr")
+		} else if _, err := config.adminToken(); err != nil {
+			problems.add("%s", err.Error())
+		}
+	}
+
+	switch strings.ToUpper(config.Logging.Level) {
+	case "ERROR", "WARN", "INFO", "DEBUG", "NONE":
+	default:
+		problems.add("invalid log level %q, use ERROR, WARN, INFO, DEBUG or NONE", config.Logging.Level)
+	}
+
+	if _, err := validateIPCLogLevel(config.Logging.IPCLevel); err != nil {
+		problems.add("invalid IPC log level: %s", err.Error())
+	}
+
+	switch strings.ToLower(config.Logging.Format) {
+	case log.FormatText, log.FormatJSON, log.FormatLogfmt:
+	default:
+		problems.add("invalid log format %q, use %s, %s or %s", config.Logging.Format, log.FormatText, log.FormatJSON, log.FormatLogfmt)
+	}
+
+	if config.Logging.MaxSize < 0 {
+		problems.add("the log maxSize cannot be negative")
+	}
+	if config.Logging.MaxFiles < 0 {
+		problems.add("the log maxFiles cannot be negative")
+	}
+	if config.Logging.MaxAge != "" {
+		if maxAge, err := time.ParseDuration(config.Logging.MaxAge); err != nil {
+			problems.add("invalid log maxAge %q: %s", config.Logging.MaxAge, err.Error())
+		} else if maxAge < 0 {
+			problems.add("the log maxAge cannot be negative")
+		}
+	}
+}
+
+// dispatcherConfig translates a validated configuration for the dispatcher
+// package.
+func (config *dispatcherConfig) dispatcherConfig() dispatcher.Config {
+	options, _ := config.options()
+
+	result := dispatcher.Config{
+		IsClient:        config.isClient(),
+		Mode:            config.Mode,
+		Options:         options,
+		OptionsFile:     config.OptionsFile,
+		StateDir:        config.StateDir,
+		EnableLocket:    config.EnableLocket,
+		ProxyListenAddr: config.ProxyListenAddr,
+		Proxy:           config.Proxy,
+		Target:          config.Target,
+		ExtOrPort:       config.ExtOrPort,
+		AuthCookie:      config.AuthCookie,
+		MetricsAddr:     config.MetricsAddr,
+		AdminAddr:       config.AdminAddr,
+		Accounting:      config.Accounting,
+		Shaping:         config.Shaping.shaping(),
+		Timeouts:        config.Timeouts.timeouts(),
+		KeepAlive:       config.KeepAlive.keepAlive(),
+		Limits: dispatcher.Limits{
+			MaxConnections: config.Limits.MaxConnections,
+			MaxPerSource:   config.Limits.MaxPerSource,
+			IPv4Prefix:     config.Limits.IPv4Prefix,
+			IPv6Prefix:     config.Limits.IPv6Prefix,
+			AcceptRate:     config.Limits.AcceptRate,
+			AcceptBurst:    config.Limits.AcceptBurst,
+		},
+	}
+	result.AdminToken, _ = config.adminToken()
+
+	for _, transport := range config.Transports {
+		result.Transports = append(result.Transports, transport.Name)
+		if transport.Bindaddr != "" {
+			options, _ := transport.options()
+			result.Bindaddrs = append(result.Bindaddrs, dispatcher.Bindaddr{Transport: transport.Name, Addr: transport.Bindaddr, Options: options, OptionsFile: transport.OptionsFile})
+		}
+	}
+
+	return result
+}
+
+func (bandwidth bandwidthConfig) validate(problems *configProblems, name string) {
+	for _, rate := range []string{bandwidth.Upload, bandwidth.Download} {
+		if _, err := parseRate(rate); err != nil {
+			problems.add("%s: %s", name, err.Error())
+		}
+	}
+}
+
+func (bandwidth bandwidthConfig) bandwidth() dispatcher.Bandwidth {
+	upload, _ := parseRate(bandwidth.Upload)
+	download, _ := parseRate(bandwidth.Download)
+
+	return dispatcher.Bandwidth{Upload: upload, Download: download}
+}
+
+func (shaping shapingConfig) shaping() dispatcher.Shaping {
+	result := dispatcher.Shaping{
+		Global:        shaping.bandwidthConfig.bandwidth(),
+		PerConnection: shaping.PerConnection.bandwidth(),
+		PerTransport:  make(map[string]dispatcher.Bandwidth),
+	}
+
+	for name, bandwidth := range shaping.Transports {
+		result.PerTransport[strings.ToLower(name)] = bandwidth.bandwidth()
+	}
+
+	return result
+}
+
+func (timeouts timeoutsConfig) validate(problems *configProblems) {
+	names := []string{"dial", "handshake", "idle", "write"}
+	for index, timeout := range []string{timeouts.Dial, timeouts.Handshake, timeouts.Idle, timeouts.Write} {
+		if _, err := parseTimeout(timeout); err != nil {
+			problems.add("invalid %s timeout %q: %s", names[index], timeout, err.Error())
+		}
+	}
+}
+
+func (timeouts timeoutsConfig) timeouts() dispatcher.Timeouts {
+	dial, _ := parseTimeout(timeouts.Dial)
+	handshake, _ := parseTimeout(timeouts.Handshake)
+	idle, _ := parseTimeout(timeouts.Idle)
+	write, _ := parseTimeout(timeouts.Write)
+
+	return dispatcher.Timeouts{Dial: dial, Handshake: handshake, Idle: idle, Write: write}
+}
+
+func (keepAlive keepAliveConfig) validate(problems *configProblems) {
+	if keepAlive.Period != "" {
+		if _, err := time.ParseDuration(keepAlive.Period); err != nil {
+			problems.add("invalid keepalive period %q: %s", keepAlive.Period, err.Error())
+		}
+	}
+
+	if _, err := parseTimeout(keepAlive.Heartbeat); err != nil {
+		problems.add("invalid heartbeat interval %q: %s", keepAlive.Heartbeat, err.Error())
+	}
+}
+
+func (keepAlive keepAliveConfig) keepAlive() dispatcher.KeepAlive {
+	var period time.Duration
+	if keepAlive.Period != "" {
+		period, _ = time.ParseDuration(keepAlive.Period)
+	}
+	heartbeat, _ := parseTimeout(keepAlive.Heartbeat)
+
+	return dispatcher.KeepAlive{Period: period, Heartbeat: heartbeat}
+}
+
+// parseTimeout parses a timeout. An empty timeout is disabled.
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(timeout)
+	if err == nil && duration < 0 {
+		err = errors.New("cannot be negative")
+	}
+
+	return duration, err
+}
+
+// parseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix for multiples of 1024. An empty rate is unlimited.
+func parseRate(rate string) (int64, error) {
+	original := rate
+	rate = strings.TrimSpace(rate)
+	if rate == "" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	switch strings.ToUpper(rate[len(rate)-1:]) {
+	case "K":
+		multiplier = 1024
+	case "M":
+		multiplier = 1024 * 1024
+	case "G":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		rate = rate[:len(rate)-1]
+	}
+
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q, use a number of bytes per second such as 512K or 10M", original)
+	}
+
+	return int64(value * multiplier), nil
+}
+
+func isKnownTransport(name string) bool {
+	_, ok := transports.Lookup(name)
+	return ok
+}
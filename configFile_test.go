@@ -0,0 +1,231 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/dispatcher"
+)
+
+// writeConfigFile writes contents to a config file in a temporary directory
+// and returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return configPath
+}
+
+// TestLoadConfigFileDefaults checks that the settings missing from a config
+// file get the defaults of the command line flags.
+func TestLoadConfigFileDefaults(t *testing.T) {
+	config, err := loadConfigFile(writeConfigFile(t, `{"transports": [{"name": "shadow"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Role != roleClient || config.Mode != dispatcher.ModeSocks5 || config.StateDir != "state" {
+		t.Errorf("expected a socks5 client with the state directory \"state\", got %s, %s and %q", config.Role, config.Mode, config.StateDir)
+	}
+	if config.Logging.Level != "ERROR" || config.Logging.IPCLevel != "NONE" {
+		t.Errorf("expected the log levels ERROR and NONE, got %s and %s", config.Logging.Level, config.Logging.IPCLevel)
+	}
+}
+
+// TestLoadConfigFileUnknownField checks that a misspelled setting is an
+// error instead of being silently ignored.
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	_, err := loadConfigFile(writeConfigFile(t, `{"role": "server", "bindAddr": "127.0.0.1:1234"}`))
+	if err == nil || !strings.Contains(err.Error(), "bindAddr") {
+		t.Errorf("expected an error naming the unknown field, got %v", err)
+	}
+
+	if _, err = loadConfigFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected an error for a missing config file")
+	}
+}
+
+// TestConfigOptions checks that the transport options can be given either as
+// a JSON object or as a string holding one, and nothing else.
+func TestConfigOptions(t *testing.T) {
+	object := `{"shadow": {"password": "1234"}}`
+
+	config := &dispatcherConfig{Options: []byte(object)}
+	if options, err := config.options(); err != nil || options != object {
+		t.Errorf("expected the object as it is, got %q and %v", options, err)
+	}
+
+	config.Options = []byte(`"{\"shadow\": {}}"`)
+	if options, err := config.options(); err != nil || options != `{"shadow": {}}` {
+		t.Errorf("expected the contents of the string, got %q and %v", options, err)
+	}
+
+	config.Options = []byte(`[1, 2]`)
+	if _, err := config.options(); err == nil {
+		t.Error("expected an error for options that are an array")
+	}
+
+	config.Options = nil
+	if options, err := config.options(); err != nil || options != "" {
+		t.Errorf("expected no options, got %q and %v", options, err)
+	}
+}
+
+// TestValidateReportsEveryProblem checks that validate reports all of the
+// problems of a server config at once, instead of stopping at the first.
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := &dispatcherConfig{
+		Role:            roleServer,
+		Mode:            dispatcher.ModeSocks5,
+		ProxyListenAddr: "127.0.0.1:1080",
+		Transports:      []transportConfig{{Name: "shadow"}, {Name: "nosuch", Bindaddr: "127.0.0.1"}},
+		Options:         []byte(`{}`),
+		OptionsFile:     "options.json",
+		Logging:         loggingConfig{IPCLevel: "LOUD"},
+	}
+
+	var problems configProblems
+	config.validate(&problems)
+
+	for _, expected := range []string{
+		"shadow: a bind address is required in server mode",
+		`unknown transport "nosuch"`,
+		`nosuch: invalid bind address "127.0.0.1"`,
+		"options and optionsFile cannot be used at the same time",
+		"a target is required in server mode",
+		"proxyListenAddr can only be used in client mode",
+		"invalid IPC log level",
+	} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("expected the problems to mention %q:\n%s", expected, problems.Error())
+		}
+	}
+}
+
+// TestValidateClient checks the settings that are only wrong on a client,
+// and that a client may enable every transport with "*".
+func TestValidateClient(t *testing.T) {
+	config := &dispatcherConfig{
+		Role:       roleClient,
+		Mode:       dispatcher.ModeTransparentTCP,
+		Target:     "127.0.0.1:80",
+		AuthCookie: "cookie",
+		Transports: []transportConfig{{Name: "*"}, {Name: "shadow", Bindaddr: "127.0.0.1:1234"}},
+		Logging:    loggingConfig{IPCLevel: "NONE"},
+	}
+
+	var problems configProblems
+	config.validate(&problems)
+
+	for _, expected := range []string{"shadow: a bind address can only be used in server mode", "target cannot be used in client mode", "extOrPort and authCookie"} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("expected the problems to mention %q:\n%s", expected, problems.Error())
+		}
+	}
+
+	config.Target, config.AuthCookie, config.Transports = "", "", config.Transports[:1]
+	problems = nil
+	config.validate(&problems)
+	for _, problem := range problems {
+		if strings.Contains(problem, "mode") || strings.Contains(problem, "transport") {
+			t.Errorf("expected no problem with the role or the transports, got %q", problem)
+		}
+	}
+}
+
+// TestParseRate checks the suffixes and the spellings accepted for a rate,
+// and that an empty rate is unlimited.
+func TestParseRate(t *testing.T) {
+	valid := map[string]int64{
+		"":      0,
+		" 0 ":   0,
+		"1000":  1000,
+		"512k":  512 * 1024,
+		"512K":  512 * 1024,
+		"1.5M":  3 * 512 * 1024,
+		" 10M ": 10 * 1024 * 1024,
+		"1g":    1024 * 1024 * 1024,
+	}
+	for rate, expected := range valid {
+		if value, err := parseRate(rate); err != nil || value != expected {
+			t.Errorf("expected parseRate(%q) to be %d, got %d and %v", rate, expected, value, err)
+		}
+	}
+
+	for _, rate := range []string{"-1", "K", "10 MB", "10KB", "fast"} {
+		if _, err := parseRate(rate); err == nil {
+			t.Errorf("expected parseRate(%q) to fail", rate)
+		}
+	}
+}
+
+// TestParseTransportRates checks that either rate of a transport may be left
+// out, and that the separators are required.
+func TestParseTransportRates(t *testing.T) {
+	rates, err := parseTransportRates("shadow=1M/2M, Replicant=/512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rates["shadow"] != (bandwidthConfig{Upload: "1M", Download: "2M"}) {
+		t.Errorf("expected the shadow rates 1M/2M, got %+v", rates["shadow"])
+	}
+	if rates["Replicant"] != (bandwidthConfig{Download: "512K"}) {
+		t.Errorf("expected only a download rate for Replicant, got %+v", rates["Replicant"])
+	}
+
+	for _, spec := range []string{"shadow", "shadow=1M", "shadow=1M/2M,"} {
+		if _, err = parseTransportRates(spec); err == nil {
+			t.Errorf("expected parseTransportRates(%q) to fail", spec)
+		}
+	}
+}
+
+// TestShapingConfig checks that the per-transport rates are keyed by the
+// lower case transport name, and that a bad rate names its setting.
+func TestShapingConfig(t *testing.T) {
+	config := &dispatcherConfig{Shaping: shapingConfig{
+		bandwidthConfig: bandwidthConfig{Download: "10M"},
+		Transports:      map[string]bandwidthConfig{"Shadow": {Upload: "1M"}},
+	}}
+
+	shaping := config.Shaping.shaping()
+	if shaping.Global.Download != 10*1024*1024 || shaping.PerTransport["shadow"].Upload != 1024*1024 {
+		t.Errorf("expected a global download of 10M and a shadow upload of 1M, got %+v", shaping)
+	}
+
+	config.Shaping.Transports["Shadow"] = bandwidthConfig{Upload: "fast"}
+	var problems configProblems
+	config.validate(&problems)
+	if !strings.Contains(problems.Error(), `shaping Shadow: invalid rate "fast"`) {
+		t.Errorf("expected the problems to name the shaping of Shadow:\n%s", problems.Error())
+	}
+}
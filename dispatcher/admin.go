@@ -0,0 +1,296 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dispatcher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+const (
+	adminTokenFile      = "admin_token"
+	defaultDrainTimeout = 30 * time.Second
+)
+
+type adminConnection struct {
+	ID         uint64    `json:"id"`
+	Transport  string    `json:"transport"`
+	Remote     string    `json:"remote"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"ageSeconds"`
+	BytesIn    int64     `json:"bytesIn"`
+	BytesOut   int64     `json:"bytesOut"`
+}
+
+type adminListener struct {
+	Transport string `json:"transport"`
+	Addr      string `json:"addr"`
+}
+
+// serveAdmin starts the admin API. The address is either a loopback host:port
+// or "unix:" followed by the path of a unix socket. Every request must carry
+// the token as "Authorization: Bearer <token>". Without a configured token,
+// a random one is written to the admin_token file in the state directory.
+func (dispatcher *Dispatcher) serveAdmin(addr string, token string) error {
+	var ln net.Listener
+	var err error
+
+	if socketPath := strings.TrimPrefix(addr, "unix:"); socketPath != addr {
+		_ = os.Remove(socketPath)
+		if ln, err = net.Listen("unix", socketPath); err == nil {
+			err = os.Chmod(socketPath, 0600)
+		}
+	} else {
+		if err = checkLoopback(addr); err != nil {
+			return err
+		}
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen for the admin API on %s: %s", addr, err.Error())
+	}
+
+	if token == "" {
+		if token, err = dispatcher.writeAdminToken(); err != nil {
+			_ = ln.Close()
+			return err
+		}
+	}
+
+	handler := dispatcher.adminHandler(token)
+	go func() {
+		_ = http.Serve(ln, handler)
+	}()
+
+	commonLog.Infof("serving the admin API on %s", ln.Addr())
+	dispatcher.admin = ln
+
+	return nil
+}
+
+// adminHandler routes the admin API requests that carry the token.
+func (dispatcher *Dispatcher) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", dispatcher.adminConnections)
+	mux.HandleFunc("/connections/close", dispatcher.adminCloseConnection)
+	mux.HandleFunc("/listeners", dispatcher.adminListeners)
+	mux.HandleFunc("/reload", dispatcher.adminReload)
+	mux.HandleFunc("/loglevel", dispatcher.adminLogLevel)
+	mux.HandleFunc("/drain", dispatcher.adminDrain)
+
+	return requireToken(token, mux)
+}
+
+// checkLoopback only allows the admin API on the local machine.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid admin address %q: %s", addr, err.Error())
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("the admin API can only listen on a loopback address or a unix socket, not %q", addr)
+	}
+
+	return nil
+}
+
+func (dispatcher *Dispatcher) writeAdminToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	tokenPath := filepath.Join(dispatcher.config.StateDir, adminTokenFile)
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write the admin token to %s: %s", tokenPath, err.Error())
+	}
+	// WriteFile does not change the mode of an existing file.
+	if err := os.Chmod(tokenPath, 0600); err != nil {
+		return "", err
+	}
+
+	commonLog.Infof("the admin API token is in %s", tokenPath)
+
+	return token, nil
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), expected) != 1 {
+			writeAdminError(writer, http.StatusUnauthorized, errors.New("a valid token is required"))
+			return
+		}
+
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (dispatcher *Dispatcher) adminConnections(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodGet) {
+		return
+	}
+
+	now := time.Now()
+	result := []adminConnection{}
+	for _, connection := range dispatcher.Connections() {
+		remote := ""
+		if connection.Remote != nil {
+			remote = commonLog.ElideAddr(connection.Remote.String())
+		}
+
+		result = append(result, adminConnection{
+			ID:         connection.ID,
+			Transport:  connection.Transport,
+			Remote:     remote,
+			Started:    connection.Started,
+			AgeSeconds: now.Sub(connection.Started).Seconds(),
+			BytesIn:    connection.BytesIn,
+			BytesOut:   connection.BytesOut,
+		})
+	}
+
+	writeAdminJSON(writer, http.StatusOK, result)
+}
+
+func (dispatcher *Dispatcher) adminCloseConnection(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	id, err := strconv.ParseUint(request.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeAdminError(writer, http.StatusBadRequest, errors.New("id must be a connection id"))
+		return
+	}
+
+	if err = dispatcher.CloseConnection(id); err != nil {
+		writeAdminError(writer, http.StatusNotFound, err)
+		return
+	}
+
+	writeAdminJSON(writer, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+func (dispatcher *Dispatcher) adminListeners(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodGet) {
+		return
+	}
+
+	result := []adminListener{}
+	for _, listener := range dispatcher.Listeners() {
+		result = append(result, adminListener{Transport: listener.Transport, Addr: listener.Addr.String()})
+	}
+
+	writeAdminJSON(writer, http.StatusOK, result)
+}
+
+func (dispatcher *Dispatcher) adminReload(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	if err := dispatcher.Reload(); err != nil {
+		writeAdminError(writer, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	commonLog.Infof("reloaded the transport options from the admin API")
+	writeAdminJSON(writer, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func (dispatcher *Dispatcher) adminLogLevel(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	level := request.URL.Query().Get("level")
+	if err := SetLogLevel(level); err != nil {
+		writeAdminError(writer, http.StatusBadRequest, err)
+		return
+	}
+
+	writeAdminJSON(writer, http.StatusOK, map[string]string{"level": strings.ToLower(level)})
+}
+
+func (dispatcher *Dispatcher) adminDrain(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	timeout := defaultDrainTimeout
+	if timeoutString := request.URL.Query().Get("timeout"); timeoutString != "" {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutString); err != nil {
+			writeAdminError(writer, http.StatusBadRequest, fmt.Errorf("invalid timeout: %s", err.Error()))
+			return
+		}
+	}
+
+	commonLog.Infof("draining from the admin API, waiting up to %s for connections to finish", timeout)
+	go dispatcher.Drain(timeout)
+
+	writeAdminJSON(writer, http.StatusAccepted, map[string]interface{}{"draining": true, "connections": len(dispatcher.Connections())})
+}
+
+func allowMethod(writer http.ResponseWriter, request *http.Request, method string) bool {
+	if request.Method != method {
+		writer.Header().Set("Allow", method)
+		writeAdminError(writer, http.StatusMethodNotAllowed, fmt.Errorf("use %s", method))
+		return false
+	}
+
+	return true
+}
+
+func writeAdminJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	_ = json.NewEncoder(writer).Encode(value)
+}
+
+func writeAdminError(writer http.ResponseWriter, status int, err error) {
+	writeAdminJSON(writer, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,326 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dispatcher
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-test-token"
+
+// startAdminServer starts a plain transparent TCP server forwarding to an
+// echo server, and returns it with its admin API served by httptest.
+func startAdminServer(t *testing.T) (*Dispatcher, *httptest.Server) {
+	server, err := Start(Config{
+		Mode:       ModeTransparentTCP,
+		Transports: []string{"plain"},
+		Options:    `{"serverAddress":"127.0.0.1:0"}`,
+		StateDir:   t.TempDir(),
+		Bindaddrs:  []Bindaddr{{Transport: "plain", Addr: "127.0.0.1:0"}},
+		Target:     startEcho(t),
+	})
+	if err != nil {
+		t.Fatalf("the server did not start: %s", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	admin := httptest.NewServer(server.adminHandler(testAdminToken))
+	t.Cleanup(admin.Close)
+
+	return server, admin
+}
+
+// adminRequest sends a request to the admin API with the token, and returns
+// the status and the decoded JSON body.
+func adminRequest(t *testing.T, admin *httptest.Server, method string, path string, result interface{}) int {
+	request, err := http.NewRequest(method, admin.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	response, err := admin.Client().Do(request)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, path, err)
+	}
+	defer response.Body.Close()
+
+	if result != nil {
+		if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatalf("%s %s returned invalid JSON: %s", method, path, err)
+		}
+	}
+
+	return response.StatusCode
+}
+
+// TestAdminToken tests that requests without the bearer token are refused.
+func TestAdminToken(t *testing.T) {
+	_, admin := startAdminServer(t)
+
+	tests := []struct {
+		authorization string
+		expected      int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong-token", http.StatusUnauthorized},
+		{testAdminToken, http.StatusUnauthorized},
+		{"Bearer " + testAdminToken, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		request, err := http.NewRequest(http.MethodGet, admin.URL+"/listeners", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+
+		response, err := admin.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+
+		if response.StatusCode != test.expected {
+			t.Errorf("Authorization %q returned %d, expected %d", test.authorization, response.StatusCode, test.expected)
+		}
+	}
+}
+
+// TestAdminMethods tests that every endpoint only accepts its own method.
+func TestAdminMethods(t *testing.T) {
+	_, admin := startAdminServer(t)
+
+	tests := []struct {
+		path   string
+		method string
+	}{
+		{"/connections", http.MethodGet},
+		{"/connections/close", http.MethodPost},
+		{"/listeners", http.MethodGet},
+		{"/reload", http.MethodPost},
+		{"/loglevel", http.MethodPost},
+		{"/drain", http.MethodPost},
+	}
+
+	for _, test := range tests {
+		wrong := http.MethodPost
+		if test.method == http.MethodPost {
+			wrong = http.MethodGet
+		}
+
+		request, err := http.NewRequest(wrong, admin.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+		response, err := admin.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+
+		if response.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s returned %d, expected %d", wrong, test.path, response.StatusCode, http.StatusMethodNotAllowed)
+		}
+		if allow := response.Header.Get("Allow"); allow != test.method {
+			t.Errorf("%s %s allows %q, expected %q", wrong, test.path, allow, test.method)
+		}
+	}
+}
+
+// TestAdminConnections tests that an open connection is listed and can be
+// closed by its ID.
+func TestAdminConnections(t *testing.T) {
+	server, admin := startAdminServer(t)
+
+	var listeners []adminListener
+	if status := adminRequest(t, admin, http.MethodGet, "/listeners", &listeners); status != http.StatusOK {
+		t.Fatalf("/listeners returned %d", status)
+	}
+	if len(listeners) != 1 || listeners[0].Transport != "plain" || listeners[0].Addr != server.Addrs()[0].String() {
+		t.Errorf("/listeners returned %+v, expected the plain listener on %s", listeners, server.Addrs()[0])
+	}
+
+	conn, err := net.Dial("tcp", server.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The echo shows the connection has been accepted and is being relayed.
+	message := []byte("hello")
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, len(message))); err != nil {
+		t.Fatal(err)
+	}
+
+	var connections []adminConnection
+	if status := adminRequest(t, admin, http.MethodGet, "/connections", &connections); status != http.StatusOK {
+		t.Fatalf("/connections returned %d", status)
+	}
+	if len(connections) != 1 {
+		t.Fatalf("/connections returned %d connections, expected 1", len(connections))
+	}
+	if connections[0].Transport != "plain" || connections[0].BytesIn != int64(len(message)) {
+		t.Errorf("/connections returned %+v, expected a plain connection that read %d bytes", connections[0], len(message))
+	}
+
+	id := strconv.FormatUint(connections[0].ID, 10)
+	var closed map[string]uint64
+	if status := adminRequest(t, admin, http.MethodPost, "/connections/close?id="+id, &closed); status != http.StatusOK {
+		t.Fatalf("/connections/close returned %d", status)
+	}
+	if closed["closed"] != connections[0].ID {
+		t.Errorf("/connections/close returned %v, expected connection %s", closed, id)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the closed connection returned %v, expected EOF", err)
+	}
+
+	// The relay ends once the connection to the target is closed as well.
+	for deadline := time.Now().Add(5 * time.Second); len(server.Connections()) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the closed connection to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := adminRequest(t, admin, http.MethodPost, "/connections/close?id="+id, nil); status != http.StatusNotFound {
+		t.Errorf("closing a closed connection returned %d, expected %d", status, http.StatusNotFound)
+	}
+	if status := adminRequest(t, admin, http.MethodPost, "/connections/close?id=first", nil); status != http.StatusBadRequest {
+		t.Errorf("closing connection \"first\" returned %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+// TestAdminDrain tests that a drain stops the listeners and finishes once the
+// open connections are closed after the timeout.
+func TestAdminDrain(t *testing.T) {
+	server, admin := startAdminServer(t)
+
+	if status := adminRequest(t, admin, http.MethodPost, "/drain?timeout=soon", nil); status != http.StatusBadRequest {
+		t.Errorf("an invalid timeout returned %d, expected %d", status, http.StatusBadRequest)
+	}
+
+	addr := server.Addrs()[0].String()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var result map[string]interface{}
+	if status := adminRequest(t, admin, http.MethodPost, "/drain?timeout=100ms", &result); status != http.StatusAccepted {
+		t.Fatalf("/drain returned %d, expected %d", status, http.StatusAccepted)
+	}
+	if result["draining"] != true || result["connections"] != float64(1) {
+		t.Errorf("/drain returned %v, expected one connection draining", result)
+	}
+
+	select {
+	case <-server.Drained():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the drain to finish")
+	}
+
+	if _, err = net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("expected the listener to be closed by the drain")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the drained connection returned %v, expected EOF", err)
+	}
+}
+
+// TestAdminTokenFile tests that without a configured token a random one is
+// written to the state directory, readable only by the owner.
+func TestAdminTokenFile(t *testing.T) {
+	stateDir := t.TempDir()
+	server, err := Start(Config{
+		Mode:       ModeTransparentTCP,
+		Transports: []string{"plain"},
+		Options:    `{"serverAddress":"127.0.0.1:0"}`,
+		StateDir:   stateDir,
+		Bindaddrs:  []Bindaddr{{Transport: "plain", Addr: "127.0.0.1:0"}},
+		Target:     startEcho(t),
+		AdminAddr:  "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("the server did not start: %s", err)
+	}
+	defer server.Close()
+
+	tokenPath := filepath.Join(stateDir, adminTokenFile)
+	info, err := os.Stat(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the token file has mode %v, expected 0600", info.Mode().Perm())
+	}
+	token, err := os.ReadFile(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "http://"+server.admin.Addr().String()+"/listeners", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("the token from the file returned %d, expected %d", response.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,685 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package dispatcher runs the shapeshifter-dispatcher proxy inside another Go
+// program. The shapeshifter-dispatcher command line tool is a thin wrapper
+// that translates its flags into a Config and calls Start.
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+	"github.com/kataras/golog"
+	"golang.org/x/net/proxy"
+)
+
+// Proxy modes, as accepted by the -mode flag.
+const (
+	ModeSocks5         = "socks5"
+	ModeTransparentTCP = "transparent-TCP"
+	ModeTransparentUDP = "transparent-UDP"
+	ModeSTUN           = "STUN"
+)
+
+// accountingFile is the name of the file in the state directory the
+// accounting records are written to.
+const accountingFile = "accounting.jsonl"
+
+// Events holds the optional callbacks invoked while the dispatcher runs.
+type Events = modes.Events
+
+// Listener describes a running client or server listener.
+type Listener = modes.Listener
+
+// Connection describes an accepted connection that is being handled.
+type Connection = modes.Connection
+
+// Limits restricts the connections accepted by the listeners.
+type Limits = modes.Limits
+
+// Shaping limits the bandwidth used by the connections.
+type Shaping = modes.Shaping
+
+// Bandwidth is a rate in bytes per second sent over and received from the
+// transports.
+type Bandwidth = modes.Bandwidth
+
+// Timeouts bound the dials, the transport handshakes and the idle
+// connections.
+type Timeouts = modes.Timeouts
+
+// KeepAlive detects dead peers on long lived connections.
+type KeepAlive = modes.KeepAlive
+
+// Default prefix lengths that group source addresses for Limits.MaxPerSource.
+const (
+	DefaultIPv4Prefix = modes.DefaultIPv4Prefix
+	DefaultIPv6Prefix = modes.DefaultIPv6Prefix
+)
+
+// Bindaddr is the address a server transport listens on.
+type Bindaddr struct {
+	Transport string
+	Addr      string
+
+	// Options are the transport options of this listener. If OptionsFile is
+	// set, the options are read from that file instead, and Reload re-reads
+	// it. Without either, the listener uses Config.Options.
+	Options     string
+	OptionsFile string
+}
+
+// Config describes one dispatcher instance. It holds the same settings as the
+// command line flags.
+type Config struct {
+	// IsClient selects the client role, otherwise the dispatcher is a server.
+	IsClient bool
+
+	// Mode is one of the Mode constants. The default is ModeSocks5.
+	Mode string
+
+	// Transports lists the transports to launch. A single "*" launches every
+	// supported transport.
+	Transports []string
+
+	// Options are the transport options. If OptionsFile is set, the options
+	// are read from that file instead, and Reload re-reads it.
+	Options     string
+	OptionsFile string
+
+	StateDir     string
+	EnableLocket bool
+
+	// ProxyListenAddr is the address the client listens on for application
+	// connections. The default is 127.0.0.1:0.
+	ProxyListenAddr string
+
+	// Proxy is an optional upstream proxy URI used by the client.
+	Proxy string
+
+	// Bindaddrs are the addresses the server transports listen on.
+	Bindaddrs []Bindaddr
+
+	// Target is the address the server forwards connections to.
+	Target string
+
+	// ExtOrPort and AuthCookie configure the Extended OR Port on the server.
+	ExtOrPort  string
+	AuthCookie string
+
+	// MetricsAddr is an optional address to serve the metrics on, in the
+	// Prometheus text format, at /metrics.
+	MetricsAddr string
+
+	// AdminAddr is an optional loopback address, or "unix:" followed by a
+	// socket path, to serve the admin API on. Requests must carry AdminToken
+	// as a bearer token. If AdminToken is empty, a random token is written to
+	// the admin_token file in the state directory.
+	AdminAddr  string
+	AdminToken string
+
+	// Accounting writes a record of every accepted connection when it ends to
+	// the accounting.jsonl file in the state directory, one JSON object per
+	// line.
+	Accounting bool
+
+	// Limits restricts the connections accepted, from applications on the
+	// client and from transport clients on the server.
+	Limits Limits
+
+	// Shaping limits the bandwidth used in total, by each transport and by
+	// each connection.
+	Shaping Shaping
+
+	// Timeouts bound the dials, the transport handshakes and the idle
+	// connections and UDP flows. Zero disables a timeout.
+	Timeouts Timeouts
+
+	// KeepAlive sets the TCP keepalive period of the sockets and the
+	// heartbeats of the UDP flows in transparent UDP mode.
+	KeepAlive KeepAlive
+
+	Events Events
+}
+
+// Dispatcher is a running dispatcher started with Start.
+type Dispatcher struct {
+	config  Config
+	names   []string
+	runtime *modes.Runtime
+
+	// listenerOptions are the options of the server listeners that have
+	// their own.
+	listenerOptions []listenerOptions
+
+	metrics net.Listener
+	admin   net.Listener
+
+	drainOnce sync.Once
+	drained   chan struct{}
+}
+
+// ParseBindaddrs parses a -bindaddr value, a comma separated list of
+// transport-address pairs such as "shadow-127.0.0.1:2222".
+func ParseBindaddrs(spec string) ([]Bindaddr, error) {
+	var result []Bindaddr
+
+	for _, part := range strings.Split(spec, ",") {
+		pieces := strings.SplitN(part, "-", 2)
+		if len(pieces) != 2 {
+			return nil, fmt.Errorf("-bindaddr: %q: doesn't contain \"-\"", part)
+		}
+
+		result = append(result, Bindaddr{Transport: pieces[0], Addr: pieces[1]})
+	}
+
+	return result, nil
+}
+
+// Start launches the listeners described by config and returns once they are
+// accepting connections. It returns an error if no listener could be started.
+func Start(config Config) (*Dispatcher, error) {
+	if config.Mode == "" {
+		config.Mode = ModeSocks5
+	}
+
+	if config.StateDir != "" {
+		if err := os.MkdirAll(config.StateDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create the state directory %s: %s", config.StateDir, err.Error())
+		}
+	}
+
+	if config.OptionsFile != "" {
+		contents, readErr := os.ReadFile(config.OptionsFile)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read the options file %s: %s", config.OptionsFile, readErr.Error())
+		}
+		config.Options = string(contents)
+	}
+
+	// The options files of the bindaddrs are read into a copy, so that the
+	// caller's config is left alone.
+	config.Bindaddrs = append([]Bindaddr(nil), config.Bindaddrs...)
+	for index, bindaddr := range config.Bindaddrs {
+		if bindaddr.OptionsFile != "" {
+			contents, readErr := os.ReadFile(bindaddr.OptionsFile)
+			if readErr != nil {
+				return nil, fmt.Errorf("failed to read the options file %s: %s", bindaddr.OptionsFile, readErr.Error())
+			}
+			config.Bindaddrs[index].Options = string(contents)
+		}
+	}
+
+	names := config.Transports
+	if len(names) == 1 && names[0] == "*" {
+		names = transports.Transports()
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no transports were specified")
+	}
+
+	runtime := modes.NewRuntime(config.Options)
+	runtime.EnableLocket = config.EnableLocket
+	runtime.StateDir = config.StateDir
+	runtime.Events = config.Events
+	runtime.Mode = config.Mode
+	runtime.Limits = config.Limits
+	runtime.Shaping = config.Shaping
+	runtime.Timeouts = config.Timeouts
+	runtime.KeepAlive = config.KeepAlive
+
+	dispatcher := &Dispatcher{config: config, names: names, runtime: runtime, drained: make(chan struct{})}
+
+	// Whatever has been started is closed again if a later step fails.
+	started := false
+	defer func() {
+		if !started {
+			_ = dispatcher.Close()
+		}
+	}()
+
+	if config.Accounting {
+		accounting, accountingErr := modes.OpenAccountingLog(filepath.Join(config.StateDir, accountingFile))
+		if accountingErr != nil {
+			return nil, fmt.Errorf("failed to open the accounting file: %s", accountingErr.Error())
+		}
+		runtime.Accounting = accounting
+	}
+
+	var launched bool
+	if config.IsClient {
+		ptClientProxy, proxyErr := pt_extras.PtGetProxy(&config.Proxy)
+		if proxyErr != nil {
+			return nil, proxyErr
+		} else if ptClientProxy != nil {
+			pt_extras.PtProxyDone()
+		}
+		runtime.ProxyURI = ptClientProxy
+
+		socksAddr := config.ProxyListenAddr
+		if socksAddr == "" {
+			socksAddr = "127.0.0.1:0"
+		}
+
+		commonLog.Infof("initializing client transport listeners")
+
+		switch config.Mode {
+		case ModeSocks5:
+			launched = pt_socks5.ClientSetup(socksAddr, names, runtime)
+		case ModeTransparentTCP:
+			launched = transparent_tcp.ClientSetup(socksAddr, names, runtime)
+		case ModeTransparentUDP:
+			launched = transparent_udp.ClientSetup(socksAddr, names, runtime)
+		case ModeSTUN:
+			launched = stun_udp.ClientSetup(socksAddr, names, runtime)
+		default:
+			return nil, fmt.Errorf("unsupported mode %s", config.Mode)
+		}
+	} else {
+		ptServerInfo, serverInfoErr := dispatcher.serverInfo()
+		if serverInfoErr != nil {
+			return nil, serverInfoErr
+		}
+
+		commonLog.Infof("initializing server transport listeners")
+
+		switch config.Mode {
+		case ModeSocks5:
+			launched = pt_socks5.ServerSetup(ptServerInfo, runtime)
+		case ModeTransparentTCP:
+			launched = transparent_tcp.ServerSetup(ptServerInfo, runtime)
+		case ModeTransparentUDP:
+			launched = transparent_udp.ServerSetup(ptServerInfo, runtime)
+		case ModeSTUN:
+			launched = stun_udp.ServerSetup(ptServerInfo, runtime)
+		default:
+			return nil, fmt.Errorf("unsupported mode %s", config.Mode)
+		}
+	}
+
+	if !launched || len(runtime.Listeners()) == 0 {
+		if setupErrors := runtime.SetupErrors(); len(setupErrors) != 0 {
+			return nil, fmt.Errorf("no pluggable transports were launched: %s", strings.Join(setupErrors, "; "))
+		}
+		return nil, errors.New("no pluggable transports were launched")
+	}
+
+	if config.MetricsAddr != "" {
+		if metricsError := dispatcher.serveMetrics(config.MetricsAddr); metricsError != nil {
+			return nil, metricsError
+		}
+	}
+
+	if config.AdminAddr != "" {
+		if adminError := dispatcher.serveAdmin(config.AdminAddr, config.AdminToken); adminError != nil {
+			return nil, adminError
+		}
+	}
+
+	started = true
+	return dispatcher, nil
+}
+
+// Run starts the dispatcher and keeps it running until ctx is cancelled.
+func Run(ctx context.Context, config Config) error {
+	dispatcher, err := Start(config)
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+
+	return dispatcher.Close()
+}
+
+// Listeners returns the listeners that are currently running.
+func (dispatcher *Dispatcher) Listeners() []Listener {
+	return dispatcher.runtime.Listeners()
+}
+
+// Addrs returns the addresses the dispatcher is listening on. Listening on
+// port 0 reports the port that was actually bound.
+func (dispatcher *Dispatcher) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, listener := range dispatcher.runtime.Listeners() {
+		addrs = append(addrs, listener.Addr)
+	}
+
+	return addrs
+}
+
+// Connections returns the accepted connections that are still being handled.
+func (dispatcher *Dispatcher) Connections() []Connection {
+	return dispatcher.runtime.Connections()
+}
+
+// CloseConnection closes one of the connections returned by Connections.
+func (dispatcher *Dispatcher) CloseConnection(id uint64) error {
+	return dispatcher.runtime.CloseConnection(id)
+}
+
+// Drain stops accepting connections and waits for the open connections to
+// finish, closing any that are still open after the timeout. Drained is
+// closed once it is done.
+func (dispatcher *Dispatcher) Drain(timeout time.Duration) {
+	dispatcher.runtime.Drain(timeout)
+	dispatcher.drainOnce.Do(func() {
+		close(dispatcher.drained)
+	})
+}
+
+// Drained returns a channel that is closed when Drain has finished.
+func (dispatcher *Dispatcher) Drained() <-chan struct{} {
+	return dispatcher.drained
+}
+
+// SetLogLevel changes the level of the dispatcher's logs while it runs. The
+// levels are debug, info, warn, error and none, also called disable.
+func SetLogLevel(level string) error {
+	parsed, err := commonLog.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q, use debug, info, warn, error or none", level)
+	}
+	_ = commonLog.SetLogLevel(level)
+
+	// Some of the transport libraries log through golog.
+	golog.SetLevel(gologLevel(parsed))
+
+	return nil
+}
+
+// gologLevel returns the name golog gives to a log level.
+func gologLevel(level int) string {
+	switch level {
+	case commonLog.LevelError:
+		return "error"
+	case commonLog.LevelWarn:
+		return "warn"
+	case commonLog.LevelInfo:
+		return "info"
+	case commonLog.LevelDebug:
+		return "debug"
+	default:
+		return "disable"
+	}
+}
+
+// Options returns the transport options currently in use.
+func (dispatcher *Dispatcher) Options() string {
+	return dispatcher.runtime.Options.Get()
+}
+
+// SetOptions replaces the transport options used for new connections, after
+// checking that every enabled transport that uses them accepts them. Server
+// listeners with options of their own are not affected. Connections that are
+// already running keep the options they were created with.
+func (dispatcher *Dispatcher) SetOptions(options string) error {
+	var validationError error
+	if dispatcher.config.IsClient {
+		validationError = validateDialerOptions(dispatcher.names, options, dispatcher.config.EnableLocket, dispatcher.config.StateDir)
+	} else {
+		validationError = validateListenerOptions(dispatcher.sharedOptionsBindaddrs(), options, dispatcher.config.EnableLocket, dispatcher.config.StateDir)
+	}
+
+	if validationError != nil {
+		return validationError
+	}
+
+	dispatcher.runtime.Options.Set(options)
+
+	return nil
+}
+
+// Reload reads the options file and the options files of the server
+// listeners again, and installs their contents once every transport has
+// accepted them. A rejected configuration leaves the current one in place.
+func (dispatcher *Dispatcher) Reload() error {
+	optionsFile := dispatcher.config.OptionsFile
+
+	reloaded := make([]string, len(dispatcher.listenerOptions))
+	reloadable := optionsFile != ""
+	for index, listener := range dispatcher.listenerOptions {
+		file := listener.bindaddr.OptionsFile
+		if file == "" {
+			continue
+		}
+		reloadable = true
+
+		contents, readErr := os.ReadFile(file)
+		if readErr != nil {
+			return fmt.Errorf("failed to read the options file %s: %s", file, readErr.Error())
+		}
+
+		if validationError := validateListenerOptions([]Bindaddr{listener.bindaddr}, string(contents), dispatcher.config.EnableLocket, dispatcher.config.StateDir); validationError != nil {
+			return validationError
+		}
+		reloaded[index] = string(contents)
+	}
+
+	if !reloadable {
+		return errors.New("options were not loaded from a file, use -optionsFile to enable reloading")
+	}
+
+	if optionsFile != "" {
+		contents, readErr := os.ReadFile(optionsFile)
+		if readErr != nil {
+			return fmt.Errorf("failed to read the options file %s: %s", optionsFile, readErr.Error())
+		}
+
+		// Setting the options restarts the listeners using them, so options
+		// that are unchanged are left alone.
+		if string(contents) != dispatcher.runtime.Options.Get() {
+			if err := dispatcher.SetOptions(string(contents)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for index, listener := range dispatcher.listenerOptions {
+		if listener.bindaddr.OptionsFile != "" && reloaded[index] != listener.options.Get() {
+			listener.options.Set(reloaded[index])
+		}
+	}
+
+	return nil
+}
+
+// sharedOptionsBindaddrs returns the bindaddrs of the enabled server
+// transports that use the options shared by every transport.
+func (dispatcher *Dispatcher) sharedOptionsBindaddrs() []Bindaddr {
+	var bindaddrs []Bindaddr
+	for _, bindaddr := range dispatcher.config.Bindaddrs {
+		if bindaddr.Options != "" {
+			continue
+		}
+
+		for _, name := range dispatcher.names {
+			if strings.EqualFold(bindaddr.Transport, name) {
+				bindaddrs = append(bindaddrs, bindaddr)
+				break
+			}
+		}
+	}
+
+	return bindaddrs
+}
+
+// OptionsFile returns the file the options were loaded from, if any.
+func (dispatcher *Dispatcher) OptionsFile() string {
+	return dispatcher.config.OptionsFile
+}
+
+// MetricsAddr returns the address the metrics are served on, or nil if
+// MetricsAddr was not set.
+func (dispatcher *Dispatcher) MetricsAddr() net.Addr {
+	if dispatcher.metrics == nil {
+		return nil
+	}
+
+	return dispatcher.metrics.Addr()
+}
+
+// Close stops every listener. Connections that are already established are
+// left running until either side closes them.
+func (dispatcher *Dispatcher) Close() error {
+	if dispatcher.metrics != nil {
+		_ = dispatcher.metrics.Close()
+	}
+	if dispatcher.admin != nil {
+		_ = dispatcher.admin.Close()
+	}
+
+	closeError := dispatcher.runtime.Close()
+	if dispatcher.runtime.Accounting != nil {
+		_ = dispatcher.runtime.Accounting.Close()
+	}
+
+	return closeError
+}
+
+func (dispatcher *Dispatcher) serveMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %s", addr, err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		_ = http.Serve(ln, mux)
+	}()
+
+	commonLog.Infof("serving metrics on %s", ln.Addr())
+	dispatcher.metrics = ln
+
+	return nil
+}
+
+// Done returns a channel that is closed when the dispatcher is closed.
+func (dispatcher *Dispatcher) Done() <-chan struct{} {
+	return dispatcher.runtime.Done()
+}
+
+func (dispatcher *Dispatcher) serverInfo() (pt_extras.ServerInfo, error) {
+	var ptServerInfo pt_extras.ServerInfo
+	var bindaddrs []pt_extras.Bindaddr
+
+	for _, bindaddr := range dispatcher.config.Bindaddrs {
+		addr, err := pt_extras.ResolveBindaddr(bindaddr.Addr)
+		if err != nil {
+			return ptServerInfo, fmt.Errorf("-bindaddr: %q: %s", bindaddr.Transport+"-"+bindaddr.Addr, err.Error())
+		}
+
+		ptBindaddr := pt_extras.Bindaddr{MethodName: bindaddr.Transport, Addr: addr, Options: dispatcher.config.Options}
+		if bindaddr.Options != "" {
+			ptBindaddr.Options = bindaddr.Options
+
+			options := modes.NewOptions(bindaddr.Options)
+			dispatcher.runtime.SetListenerOptions(ptBindaddr, options)
+			dispatcher.listenerOptions = append(dispatcher.listenerOptions, listenerOptions{bindaddr, options})
+		}
+
+		bindaddrs = append(bindaddrs, ptBindaddr)
+	}
+
+	bindaddrs = pt_extras.FilterBindaddrs(bindaddrs, dispatcher.names)
+	if len(bindaddrs) == 0 {
+		return ptServerInfo, errors.New("no valid bindaddrs")
+	}
+
+	ptServerInfo.Bindaddrs = bindaddrs
+
+	orAddr, err := pt_extras.ResolveAddr(dispatcher.config.Target)
+	if err != nil {
+		return ptServerInfo, fmt.Errorf("error resolving OR address %q: %s", dispatcher.config.Target, err.Error())
+	}
+	ptServerInfo.OrAddr = orAddr
+
+	if dispatcher.config.AuthCookie != "" {
+		ptServerInfo.AuthCookiePath = dispatcher.config.AuthCookie
+	}
+
+	if dispatcher.config.ExtOrPort != "" {
+		ptServerInfo.ExtendedOrAddr, err = pt_extras.ResolveAddr(dispatcher.config.ExtOrPort)
+		if err != nil {
+			return ptServerInfo, fmt.Errorf("error resolving Extended OR address %q: %s", dispatcher.config.ExtOrPort, err.Error())
+		}
+	}
+
+	return ptServerInfo, nil
+}
+
+// listenerOptions are the options of a server listener that has its own. They
+// are reloaded from the OptionsFile of the bindaddr, if it has one.
+type listenerOptions struct {
+	bindaddr Bindaddr
+	options  *modes.Options
+}
+
+// validateDialerOptions checks that every client transport in names can be
+// set up with the given options, without opening any connections.
+func validateDialerOptions(names []string, options string, enableLocket bool, stateDir string) error {
+	for _, name := range names {
+		if _, err := pt_extras.ArgsToDialer(name, options, proxy.Direct, enableLocket, stateDir); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// validateListenerOptions checks that the server of every bindaddr can be set
+// up with the given options on its address, without opening any sockets.
+func validateListenerOptions(bindaddrs []Bindaddr, options string, enableLocket bool, stateDir string) error {
+	for _, bindaddr := range bindaddrs {
+		addr, err := pt_extras.ResolveBindaddr(bindaddr.Addr)
+		if err != nil {
+			return fmt.Errorf("%s: %s", bindaddr.Transport, err.Error())
+		}
+
+		if _, err = pt_extras.ArgsToListener(bindaddr.Transport, stateDir, options, enableLocket, stateDir, addr.String()); err != nil {
+			return fmt.Errorf("%s: %s", bindaddr.Transport, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dispatcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
+	"github.com/kataras/golog"
+	"github.com/willscott/goturn"
+	"golang.org/x/net/proxy"
+)
+
+// testTransports are the transports the modes are tested with. The client
+// of the plain transport is given the address the server listens on.
+var testTransports = []struct {
+	name    string
+	options string
+}{
+	{"plain", `{"serverAddress":"127.0.0.1:0"}`},
+	{"loopback", `{"serverAddress":"loopback-test"}`},
+	{"chain", `{"transports":[{"name":"loopback","config":{"serverAddress":"chain-test"}},{"name":"plain","config":{"serverAddress":"127.0.0.1:1"}}]}`},
+}
+
+// startEcho starts a TCP server that echoes what it receives.
+func startEcho(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startServer starts a server of the transport that forwards to an echo
+// server, and returns the address it listens on.
+func startServer(t *testing.T, mode string, transport string, options string) string {
+	return startServerTo(t, mode, transport, options, startEcho(t))
+}
+
+// startServerTo starts a server of the transport that forwards to target,
+// and returns the address it listens on.
+func startServerTo(t *testing.T, mode string, transport string, options string, target string) string {
+	server, err := Start(Config{
+		Mode:       mode,
+		Transports: []string{transport},
+		Options:    options,
+		StateDir:   t.TempDir(),
+		Bindaddrs:  []Bindaddr{{Transport: transport, Addr: "127.0.0.1:0"}},
+		Target:     target,
+	})
+	if err != nil {
+		t.Fatalf("the server did not start: %s", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	return server.Addrs()[0].String()
+}
+
+// startClient starts a client of the transport and returns the address it
+// listens on.
+func startClient(t *testing.T, mode string, transport string, options string) string {
+	client, err := Start(Config{
+		IsClient:        true,
+		Mode:            mode,
+		Transports:      []string{transport},
+		Options:         options,
+		StateDir:        t.TempDir(),
+		ProxyListenAddr: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatalf("the client did not start: %s", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client.Addrs()[0].String()
+}
+
+// startPair starts a server and a client dispatcher in the same process,
+// connected with the given transport, and returns the address of the client.
+func startPair(t *testing.T, mode string, transport string, options string) string {
+	return startPairTo(t, mode, transport, options, startEcho(t))
+}
+
+// startPairTo is startPair with the server forwarding to target.
+func startPairTo(t *testing.T, mode string, transport string, options string, target string) string {
+	serverAddr := startServerTo(t, mode, transport, options, target)
+
+	if transport == "plain" {
+		options = `{"serverAddress":"` + serverAddr + `"}`
+	}
+
+	return startClient(t, mode, transport, options)
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	message := []byte("hello through the dispatcher")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+
+	if !bytes.Equal(reply, message) {
+		t.Errorf("received %q, expected %q", reply, message)
+	}
+}
+
+func TestTransparentTCP(t *testing.T) {
+	for _, transport := range testTransports {
+		t.Run(transport.name, func(t *testing.T) {
+			clientAddr := startPair(t, ModeTransparentTCP, transport.name, transport.options)
+
+			conn, err := net.Dial("tcp", clientAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkEcho(t, conn)
+		})
+	}
+}
+
+func TestSocks5(t *testing.T) {
+	for _, transport := range testTransports {
+		t.Run(transport.name, func(t *testing.T) {
+			clientAddr := startPair(t, ModeSocks5, transport.name, transport.options)
+
+			dialer, err := proxy.SOCKS5("tcp", clientAddr, nil, proxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The server forwards every connection to its target, whatever
+			// address the application asked for.
+			conn, err := dialer.Dial("tcp", "192.0.2.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkEcho(t, conn)
+		})
+	}
+}
+
+// TestTransportURI tests that the client options can be given as a URI.
+func TestTransportURI(t *testing.T) {
+	serverAddr := startServer(t, ModeTransparentTCP, "plain", `{"serverAddress":"127.0.0.1:0"}`)
+	clientAddr := startClient(t, ModeTransparentTCP, "plain", "plain://"+serverAddr)
+
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEcho(t, conn)
+}
+
+// TestSocks5ParameterBlock tests that a SOCKS5 client without options uses
+// those sent in the PT 2.1 parameter block.
+func TestSocks5ParameterBlock(t *testing.T) {
+	serverAddr := startServer(t, ModeSocks5, "plain", `{"serverAddress":"127.0.0.1:0"}`)
+	clientAddr := startClient(t, ModeSocks5, "plain", "")
+
+	conn, err := net.Dial("tcp", clientAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offer only the parameter block method, then send the options and a
+	// CONNECT request for 192.0.2.1:80.
+	if _, err = conn.Write([]byte{5, 1, socks5.AuthJsonParameterBlock}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(conn, method); err != nil || method[1] != socks5.AuthJsonParameterBlock {
+		t.Fatalf("the parameter block method was not chosen: %v %v", method, err)
+	}
+
+	options := []byte("plain://" + serverAddr)
+	request := binary.BigEndian.AppendUint32(nil, uint32(len(options)))
+	request = append(request, options...)
+	request = append(request, 5, 1, 0, 1, 192, 0, 2, 1, 0, 80)
+	if _, err = conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil || reply[1] != byte(socks5.ReplySucceeded) {
+		t.Fatalf("the CONNECT request failed: %v %v", reply, err)
+	}
+
+	checkEcho(t, conn)
+}
+
+// startUDPTarget starts a UDP server that passes the packets it receives to
+// the returned channel.
+func startUDPTarget(t *testing.T) (string, <-chan []byte) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	packets := make(chan []byte, 100)
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, _, readErr := conn.ReadFromUDP(buffer)
+			if readErr != nil {
+				return
+			}
+
+			packets <- append([]byte(nil), buffer[:n]...)
+		}
+	}()
+
+	return conn.LocalAddr().String(), packets
+}
+
+// checkUDP sends the packet to the client until the target receives it. The
+// first packets of a flow are dropped while its transport connection is made.
+func checkUDP(t *testing.T, conn net.Conn, packets <-chan []byte, packet []byte) {
+	deadline := time.After(5 * time.Second)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatalf("write failed: %s", err)
+		}
+
+		select {
+		case received := <-packets:
+			if !bytes.Equal(received, packet) {
+				t.Fatalf("received %q, expected %q", received, packet)
+			}
+			return
+		case <-ticker.C:
+		case <-deadline:
+			t.Fatal("the packet did not reach the target")
+		}
+	}
+}
+
+// TestUDP forwards packets in both UDP modes, with an idle timeout short
+// enough that the flows are closed and opened again while the test runs.
+func TestUDP(t *testing.T) {
+	request, err := goturn.NewBindingRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stunPacket, err := request.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		mode   string
+		packet []byte
+	}{
+		{ModeTransparentUDP, []byte("hello through the dispatcher")},
+		{ModeSTUN, stunPacket},
+	} {
+		t.Run(test.mode, func(t *testing.T) {
+			target, packets := startUDPTarget(t)
+			serverAddr := startServerTo(t, test.mode, "plain", `{"serverAddress":"127.0.0.1:0"}`, target)
+
+			client, err := Start(Config{
+				IsClient:        true,
+				Mode:            test.mode,
+				Transports:      []string{"plain"},
+				Options:         `{"serverAddress":"` + serverAddr + `"}`,
+				StateDir:        t.TempDir(),
+				ProxyListenAddr: "127.0.0.1:0",
+				Timeouts:        Timeouts{Idle: 200 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatalf("the client did not start: %s", err)
+			}
+			defer client.Close()
+
+			conn, err := net.Dial("udp", client.Addrs()[0].String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			checkUDP(t, conn, packets, test.packet)
+
+			// Let the flow be closed as idle, then open it again.
+			time.Sleep(500 * time.Millisecond)
+			checkUDP(t, conn, packets, test.packet)
+		})
+	}
+}
+
+// TestSetLogLevel tests that the log levels, including NONE, are given to the
+// transport libraries under the names golog knows them by.
+func TestSetLogLevel(t *testing.T) {
+	defer func() { _ = SetLogLevel("INFO") }()
+
+	tests := []struct {
+		level    string
+		expected golog.Level
+	}{
+		{"ERROR", golog.ErrorLevel},
+		{"warn", golog.WarnLevel},
+		{"INFO", golog.InfoLevel},
+		{"DEBUG", golog.DebugLevel},
+		{"NONE", golog.DisableLevel},
+		{"disable", golog.DisableLevel},
+	}
+
+	for _, test := range tests {
+		if err := SetLogLevel(test.level); err != nil {
+			t.Errorf("SetLogLevel(%q) failed: %s", test.level, err)
+		} else if golog.Default.Level != test.expected {
+			t.Errorf("SetLogLevel(%q) set the golog level to %v, expected %v", test.level, golog.Default.Level, test.expected)
+		}
+	}
+
+	if err := SetLogLevel("LOUD"); err == nil {
+		t.Error("SetLogLevel(\"LOUD\") succeeded, expected an error")
+	}
+}
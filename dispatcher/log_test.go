@@ -0,0 +1,158 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dispatcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// logBuffer collects the log lines written while the dispatcher runs.
+type logBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *logBuffer) Write(data []byte) (int, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+
+	return buffer.buffer.Write(data)
+}
+
+func (buffer *logBuffer) lines() []string {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+
+	return strings.Split(strings.TrimSpace(buffer.buffer.String()), "\n")
+}
+
+// TestConnectionIDs tests that every line logged about a connection carries
+// the same conn field, and that each connection has an ID of its own.
+func TestConnectionIDs(t *testing.T) {
+	var output logBuffer
+	commonLog.SetOutput(&output)
+	defer commonLog.SetOutput(ioutil.Discard)
+	if err := commonLog.SetFormat(commonLog.FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = commonLog.SetFormat(commonLog.FormatText) }()
+	_ = SetLogLevel("DEBUG")
+	defer func() { _ = SetLogLevel("INFO") }()
+
+	// The target closes the connections once it has echoed a message, so
+	// that the server ends them and logs them as closed.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, acceptErr := target.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go func() {
+				message := make([]byte, 64)
+				read, _ := conn.Read(message)
+				_, _ = conn.Write(message[:read])
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	// Only the server is started, so that the IDs of the client dispatcher
+	// aren't mixed in.
+	serverAddr := startServerTo(t, ModeTransparentTCP, "plain", `{"serverAddress":"127.0.0.1:0"}`, target.Addr().String())
+
+	const connections = 2
+	for count := 0; count < connections; count++ {
+		conn, dialErr := net.Dial("tcp", serverAddr)
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		checkEcho(t, conn)
+	}
+
+	type connectionLines struct {
+		opened, closed int
+		transport      string
+		remote         string
+	}
+	var byConn map[string]*connectionLines
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		byConn = make(map[string]*connectionLines)
+		closed := 0
+		for _, line := range output.lines() {
+			var entry map[string]string
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("%q is not a JSON object: %s", line, err)
+			}
+
+			id, ok := entry["conn"]
+			if !ok {
+				continue
+			}
+			if byConn[id] == nil {
+				byConn[id] = &connectionLines{transport: entry["transport"], remote: entry["remote"]}
+			}
+			if entry["transport"] != byConn[id].transport || entry["remote"] != byConn[id].remote {
+				t.Errorf("connection %s is logged as %s from %s and as %s from %s", id, byConn[id].transport, byConn[id].remote, entry["transport"], entry["remote"])
+			}
+
+			switch entry["msg"] {
+			case "new connection":
+				byConn[id].opened++
+			case "connection closed":
+				byConn[id].closed++
+				closed++
+			}
+		}
+
+		if closed >= connections || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(byConn) != connections {
+		t.Errorf("the connections were logged with %d IDs, expected %d", len(byConn), connections)
+	}
+	for id, lines := range byConn {
+		if lines.opened != 1 || lines.closed != 1 {
+			t.Errorf("connection %s was opened %d times and closed %d times, expected once each", id, lines.opened, lines.closed)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package dispatcher
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+// startReloadServer starts a plain transparent TCP server on port 0 with its
+// options read from a file, and returns it with a channel of the addresses
+// its listeners start on.
+func startReloadServer(t *testing.T, options string) (*Dispatcher, string, <-chan net.Addr) {
+	stateDir := t.TempDir()
+	optionsFile := filepath.Join(stateDir, "options.json")
+	if err := os.WriteFile(optionsFile, []byte(options), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	listening := make(chan net.Addr, 10)
+	server, err := Start(Config{
+		Mode:        ModeTransparentTCP,
+		Transports:  []string{"plain"},
+		OptionsFile: optionsFile,
+		StateDir:    stateDir,
+		Bindaddrs:   []Bindaddr{{Transport: "plain", Addr: "127.0.0.1:0"}},
+		Target:      startEcho(t),
+		Events: Events{Listening: func(_ string, addr net.Addr) {
+			listening <- addr
+		}},
+	})
+	if err != nil {
+		t.Fatalf("the server did not start: %s", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	return server, optionsFile, listening
+}
+
+// nextListening returns the address of the next listener that starts.
+func nextListening(t *testing.T, listening <-chan net.Addr) net.Addr {
+	select {
+	case addr := <-listening:
+		return addr
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a listener to start")
+		return nil
+	}
+}
+
+// TestReloadRestartsListener tests that reloading the options rebuilds the
+// listener, on the port it was given the first time for a bindaddr with
+// port 0.
+func TestReloadRestartsListener(t *testing.T) {
+	server, optionsFile, listening := startReloadServer(t, `{"serverAddress":"127.0.0.1:0"}`)
+	first := nextListening(t, listening)
+
+	before, err := net.Dial("tcp", first.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(optionsFile, []byte(`{"serverAddress":"127.0.0.1:0","transport":"plain"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Reload(); err != nil {
+		t.Fatalf("the reload failed: %s", err)
+	}
+
+	if restarted := nextListening(t, listening); restarted.String() != first.String() {
+		t.Errorf("the listener restarted on %s, expected %s", restarted, first)
+	}
+
+	// A connection accepted before the reload keeps running.
+	checkEcho(t, before)
+
+	after, err := net.Dial("tcp", first.String())
+	if err != nil {
+		t.Fatalf("the restarted listener is not accepting connections: %s", err)
+	}
+	checkEcho(t, after)
+}
+
+// TestRestartFailureWaits tests that a listener that can't be rebuilt from
+// the new options waits for the next configuration instead of stopping the
+// dispatcher.
+func TestRestartFailureWaits(t *testing.T) {
+	server, _, listening := startReloadServer(t, `{"serverAddress":"127.0.0.1:0"}`)
+	first := nextListening(t, listening)
+
+	// Reload rejects options the transport can't use, so they are set
+	// directly, as if the listener failed to start with them.
+	server.runtime.Options.Set(`{"transport":"plain"}`)
+
+	for deadline := time.Now().Add(5 * time.Second); len(server.Listeners()) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the listener to be stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-server.Done():
+		t.Fatal("expected the dispatcher to keep running")
+	case <-server.Drained():
+		t.Fatal("expected the dispatcher to keep running")
+	case addr := <-listening:
+		t.Fatalf("a listener started on %s with options it can't use", addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := server.SetOptions(`{"serverAddress":"127.0.0.1:0"}`); err != nil {
+		t.Fatal(err)
+	}
+	if restarted := nextListening(t, listening); restarted.String() != first.String() {
+		t.Errorf("the listener restarted on %s, expected %s", restarted, first)
+	}
+
+	conn, err := net.Dial("tcp", first.String())
+	if err != nil {
+		t.Fatalf("the restarted listener is not accepting connections: %s", err)
+	}
+	checkEcho(t, conn)
+}
+
+// freeAddress returns a loopback address with a port that was free a moment
+// ago.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// startListenerOptionsServer starts a plain transparent TCP server with two
+// bindaddrs, each with its options in a file of its own, and returns it with
+// the bindaddrs and a channel of the addresses its listeners start on.
+func startListenerOptionsServer(t *testing.T) (*Dispatcher, []Bindaddr, <-chan net.Addr) {
+	stateDir := t.TempDir()
+
+	var bindaddrs []Bindaddr
+	for index, options := range []string{`{"serverAddress":"127.0.0.1:0"}`, `{"serverAddress":"127.0.0.1:0","transport":"plain"}`} {
+		optionsFile := filepath.Join(stateDir, "options"+strconv.Itoa(index)+".json")
+		if err := os.WriteFile(optionsFile, []byte(options), 0600); err != nil {
+			t.Fatal(err)
+		}
+		bindaddrs = append(bindaddrs, Bindaddr{Transport: "plain", Addr: freeAddress(t), OptionsFile: optionsFile})
+	}
+
+	listening := make(chan net.Addr, 10)
+	server, err := Start(Config{
+		Mode:       ModeTransparentTCP,
+		Transports: []string{"plain"},
+		Options:    `{"serverAddress":"127.0.0.1:1"}`,
+		StateDir:   stateDir,
+		Bindaddrs:  bindaddrs,
+		Target:     startEcho(t),
+		Events: Events{Listening: func(_ string, addr net.Addr) {
+			listening <- addr
+		}},
+	})
+	if err != nil {
+		t.Fatalf("the server did not start: %s", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	nextListening(t, listening)
+	nextListening(t, listening)
+
+	return server, bindaddrs, listening
+}
+
+// listenerOptionsOf returns the options the listener of bindaddr is using.
+func (dispatcher *Dispatcher) listenerOptionsOf(t *testing.T, bindaddr Bindaddr) string {
+	addr, err := pt_extras.ResolveBindaddr(bindaddr.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dispatcher.runtime.ListenerOptions(pt_extras.Bindaddr{MethodName: bindaddr.Transport, Addr: addr}).Get()
+}
+
+// TestListenerOptions tests that two bindaddrs of the same transport each
+// listen with the options from their own file.
+func TestListenerOptions(t *testing.T) {
+	server, bindaddrs, _ := startListenerOptionsServer(t)
+
+	for _, bindaddr := range bindaddrs {
+		expected, err := os.ReadFile(bindaddr.OptionsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options := server.listenerOptionsOf(t, bindaddr); options != string(expected) {
+			t.Errorf("the listener on %s uses the options %s, expected %s", bindaddr.Addr, options, expected)
+		}
+
+		conn, err := net.Dial("tcp", bindaddr.Addr)
+		if err != nil {
+			t.Fatalf("the listener on %s is not accepting connections: %s", bindaddr.Addr, err)
+		}
+		checkEcho(t, conn)
+	}
+}
+
+// TestReloadListenerOptions tests that a reload only restarts the listener
+// whose options file changed.
+func TestReloadListenerOptions(t *testing.T) {
+	server, bindaddrs, listening := startListenerOptionsServer(t)
+
+	changed := `{"serverAddress":"127.0.0.1:0","bindAddress":"` + bindaddrs[0].Addr + `"}`
+	if err := os.WriteFile(bindaddrs[0].OptionsFile, []byte(changed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := server.listenerOptionsOf(t, bindaddrs[1])
+
+	if err := server.Reload(); err != nil {
+		t.Fatalf("the reload failed: %s", err)
+	}
+
+	if restarted := nextListening(t, listening); restarted.String() != bindaddrs[0].Addr {
+		t.Errorf("the listener on %s restarted, expected the one on %s", restarted, bindaddrs[0].Addr)
+	}
+	select {
+	case restarted := <-listening:
+		t.Errorf("the listener on %s restarted, expected only the one on %s", restarted, bindaddrs[0].Addr)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if options := server.listenerOptionsOf(t, bindaddrs[0]); options != changed {
+		t.Errorf("the listener on %s uses the options %s, expected %s", bindaddrs[0].Addr, options, changed)
+	}
+	if options := server.listenerOptionsOf(t, bindaddrs[1]); options != unchanged {
+		t.Errorf("the listener on %s uses the options %s, expected %s", bindaddrs[1].Addr, options, unchanged)
+	}
+}
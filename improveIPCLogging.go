@@ -26,22 +26,3 @@ func validateIPCLogLevel(ipcLogLevel string) (int, error) {
 		return -1, errors.New("invalid log level")
 	}
 }
-
-func ipcLogMessage(logLevel int, message string) {
-	var logLevelStr string
-	switch logLevel {
-	case log.LevelNone:
-		logLevelStr = "NONE"
-	case log.LevelError:
-		logLevelStr = "ERROR"
-	case log.LevelWarn:
-		logLevelStr = "WARN"
-	case log.LevelInfo:
-		logLevelStr = "INFO"
-	case log.LevelDebug:
-		logLevelStr = "DEBUG"
-	default:
-		return
-	}
-	println("LOG "+logLevelStr+" "+message)
-}
@@ -30,29 +30,31 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/url"
+	"net"
 	"os"
 	"path"
 	"strings"
+	"time"
 
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/dispatcher"
 	"github.com/kataras/golog"
-
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_udp"
 )
 
 const (
 	dispatcherVersion = "0.0.7-dev"
 	dispatcherLogFile = "dispatcher.log"
+
+	// The log file is rotated at 10 MB and five rotated files are kept,
+	// unless configured otherwise.
+	defaultLogMaxSize  = 10
+	defaultLogMaxFiles = 5
 )
 
 var stateDir string
@@ -61,457 +63,572 @@ func getVersion() string {
 	return fmt.Sprintf("dispatcher-%s", dispatcherVersion)
 }
 
-const (
-	socks5 = iota
-	transparentTCP
-	transparentUDP
-	stunUDP
-)
-
 func main() {
+	command, arguments, err := parseCommand(os.Args[1:])
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n\n", err.Error())
+		printUsage()
+		os.Exit(2)
+	}
 
-	// Handle the command line arguments.
-	_, execName := path.Split(os.Args[0])
+	command.run(arguments)
+}
 
-	flag.Usage = func() {
-		_, _ = fmt.Fprintf(os.Stderr, "shapeshifter-dispatcher is a PT v3.0 proxy supporting multiple transports and proxy modes\n\n")
-		_, _ = fmt.Fprintf(os.Stderr, "Usage:\n\t%s -client -state [statedir] -version 2 -transports [transport1,transport2,...]\n\n", os.Args[0])
-		_, _ = fmt.Fprintf(os.Stderr, "Example:\n\t%s -client -state state -version 2 -transports obfs2\n\n", os.Args[0])
-		_, _ = fmt.Fprintf(os.Stderr, "Flags:\n\n")
-		flag.PrintDefaults()
-	}
+// runFlags are the flags of the run and check commands.
+type runFlags struct {
+	statePath        *string
+	exitOnStdinClose *bool
+	transportsList   *string
+	transport        *string
+	serverBindPort   *string
+	serverBindHost   *string
+	targetHost       *string
+	targetPort       *string
+	proxyListenHost  *string
+	proxyListenPort  *string
+	modeName         *string
+	proxy            *string
+	options          *string
+	bindAddr         *string
+	extorport        *string
+	authcookie       *string
+	socksAddr        *string
+	optionsFile      *string
+	transportOptions *string
+	configPath       *string
+	logLevelStr      *string
+	enableLogging    *bool
+	ipcLogLevelStr   *string
+	logFormat        *string
+	unsafeLogging    *bool
+	logMaxSize       *int64
+	logMaxAge        *time.Duration
+	logMaxFiles      *int
+	logCompress      *bool
+	clientMode       *bool
+	serverMode       *bool
+	transparent      *bool
+	udp              *bool
+	target           *string
+	enableLocket     *bool
+	metricsAddr      *string
+	adminAddr        *string
+	adminTokenFile   *string
+	accounting       *bool
+	maxConnections   *int
+	maxPerSource     *int
+	ipv4Prefix       *int
+	ipv6Prefix       *int
+	acceptRate       *float64
+	acceptBurst      *int
+	uploadRate       *string
+	downloadRate     *string
+	connUploadRate   *string
+	connDownloadRate *string
+	transportRates   *string
+	dialTimeout      *time.Duration
+	handshakeTimeout *time.Duration
+	idleTimeout      *time.Duration
+	writeTimeout     *time.Duration
+	keepAlive        *time.Duration
+	heartbeat        *time.Duration
+}
 
-	// Parsing flags starts here, but variables are not set to actual values until flag.Parse() is called.
+func defineRunFlags(flags *flag.FlagSet) *runFlags {
 	// PT 2.1 specification, 3.3.1.1. Common Configuration Parameters
-	var ptversion = flag.String("ptversion", "2.1", "Specify the Pluggable Transport protocol version to use")
-
-	statePath := flag.String("state", "state", "Specify the directory to use to store state information required by the transports")
-	exitOnStdinClose := flag.Bool("exit-on-stdin-close", false, "Set to true to force the dispatcher to close when the stdin pipe is closed")
-
-	transportsList := flag.String("transports", "", "Specify transports to enable")
-
-	//This is for proposal no.9
-	transport := flag.String("transport", "", "Specify a single transport to enable")
-	//copy old code
-	serverBindPort := flag.String("bindport", "", "Specify the bind address port for transparent server")
-	serverBindHost := flag.String("bindhost", "", "Specify the bind address host for transparent server")
-	targetHost := flag.String("targethost", "", "Specify transport server destination address port")
-	targetPort := flag.String("targetport", "", "Specify transport server destination address host")
-	proxyListenHost := flag.String("proxylistenhost", "", "Specify the bind address for the local SOCKS server host provided by the client")
-	proxyListenPort := flag.String("proxylistenport", "", "Specify the bind address for the local SOCKS server port provided by the client")
-	modeName := flag.String("mode", "", "Specify which mode is being used: transparent-TCP, transparent-UDP, socks5, or STUN")
-
-	// PT 2.1 specification, 3.3.1.2. Pluggable PT Client Configuration Parameters
-	proxy := flag.String("proxy", "", "Specify an HTTP or SOCKS4a proxy that the PT needs to use to reach the Internet")
-
-	// PT 2.1 specification, 3.3.1.3. Pluggable PT Server Environment Variables
-	options := flag.String("options", "", "Specify the transport options for the server")
-	if *options != "" {
-		println("--> -options flag found: ", *options)
+	flags.String("ptversion", "2.1", "Specify the Pluggable Transport protocol version to use")
+
+	return &runFlags{
+		statePath:        flags.String("state", "state", "Specify the directory to use to store state information required by the transports"),
+		exitOnStdinClose: flags.Bool("exit-on-stdin-close", false, "Set to true to force the dispatcher to close when the stdin pipe is closed"),
+
+		transportsList: flags.String("transports", "", "Specify transports to enable"),
+
+		//This is for proposal no.9
+		transport:       flags.String("transport", "", "Specify a single transport to enable"),
+		serverBindPort:  flags.String("bindport", "", "Specify the bind address port for transparent server"),
+		serverBindHost:  flags.String("bindhost", "", "Specify the bind address host for transparent server"),
+		targetHost:      flags.String("targethost", "", "Specify transport server destination address port"),
+		targetPort:      flags.String("targetport", "", "Specify transport server destination address host"),
+		proxyListenHost: flags.String("proxylistenhost", "", "Specify the bind address for the local SOCKS server host provided by the client"),
+		proxyListenPort: flags.String("proxylistenport", "", "Specify the bind address for the local SOCKS server port provided by the client"),
+		modeName:        flags.String("mode", "", "Specify which mode is being used: transparent-TCP, transparent-UDP, socks5, or STUN"),
+
+		// PT 2.1 specification, 3.3.1.2. Pluggable PT Client Configuration Parameters
+		proxy: flags.String("proxy", "", "Specify an HTTP, SOCKS4a or SOCKS5 proxy that the PT needs to use to reach the Internet"),
+
+		// PT 2.1 specification, 3.3.1.3. Pluggable PT Server Environment Variables
+		options:    flags.String("options", "", "Specify the transport options for the server"),
+		bindAddr:   flags.String("bindaddr", "", "Specify the bind address for transparent server"),
+		extorport:  flags.String("extorport", "", "Specify the address of a server implementing the Extended OR Port protocol, which is used for per-connection metadata"),
+		authcookie: flags.String("authcookie", "", "Specify an authentication cookie, for use in authenticating with the Extended OR Port"),
+
+		// Experimental flags under consideration for PT 2.1
+		socksAddr:        flags.String("proxylistenaddr", "", "Specify the bind address for the local SOCKS server provided by the client"),
+		optionsFile:      flags.String("optionsFile", "", "store all the options in a single file"),
+		transportOptions: flags.String("transportOptionsFiles", "", "Give server transports options of their own, as a comma separated list of [transport]=[options file], such as shadow=ShadowServerConfig.json,Replicant=ReplicantServerConfig.json"),
+		configPath:       flags.String("config", "", "Read the whole dispatcher configuration from a JSON file instead of the command line flags"),
+
+		// Additional command line flags inherited from obfs4proxy
+		logLevelStr:    flags.String("logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)"),
+		enableLogging:  flags.Bool("enableLogging", false, "Log to [state]/"+dispatcherLogFile),
+		ipcLogLevelStr: flags.String("ipcLogLevel", "NONE", "IPC Log level (ERROR/WARN/INFO/DEBUG/NONE)"),
+		logFormat:      flags.String("logFormat", log.FormatText, "Log format (text/json/logfmt)"),
+		unsafeLogging:  flags.Bool("unsafeLogging", false, "Disable the scrubbing of addresses and secrets from the logs, for debugging"),
+		logMaxSize:     flags.Int64("logMaxSize", defaultLogMaxSize, "Rotate the log file once it reaches this size in megabytes, 0 to never rotate it by size"),
+		logMaxAge:      flags.Duration("logMaxAge", 0, "Rotate the log file once it has been written to for this long, for example 24h"),
+		logMaxFiles:    flags.Int("logMaxFiles", defaultLogMaxFiles, "Number of rotated log files to keep"),
+		logCompress:    flags.Bool("logCompress", false, "Compress the rotated log files with gzip"),
+
+		// Additional command line flags added to shapeshifter-dispatcher
+		clientMode:   flags.Bool("client", false, "Enable client mode"),
+		serverMode:   flags.Bool("server", false, "Enable server mode"),
+		transparent:  flags.Bool("transparent", false, "Enable transparent proxy mode. The default is protocol-aware proxy mode (socks5 for TCP, STUN for UDP)"),
+		udp:          flags.Bool("udp", false, "Enable UDP proxy mode. The default is TCP proxy mode."),
+		target:       flags.String("target", "", "Specify transport server destination address"),
+		enableLocket: flags.Bool("enableLocket", false, "Log to [state]/"+dispatcherLogFile+" using Locket"),
+		metricsAddr:  flags.String("metricsAddr", "", "Serve Prometheus metrics on this address, at /metrics"),
+
+		adminAddr:      flags.String("adminAddr", "", "Serve the admin API on this loopback address, or on unix:[socket path]"),
+		adminTokenFile: flags.String("adminTokenFile", "", "Read the admin API token from this file. The default is to create one in [state]/admin_token"),
+		accounting:     flags.Bool("accounting", false, "Write a record of every connection when it ends to [state]/accounting.jsonl"),
+
+		maxConnections: flags.Int("maxConnections", 0, "Maximum number of connections handled at the same time, 0 for no limit"),
+		maxPerSource:   flags.Int("maxConnectionsPerSource", 0, "Maximum number of connections handled at the same time from one source address, 0 for no limit"),
+		ipv4Prefix:     flags.Int("sourcePrefixV4", dispatcher.DefaultIPv4Prefix, "Prefix length that groups IPv4 source addresses for -maxConnectionsPerSource"),
+		ipv6Prefix:     flags.Int("sourcePrefixV6", dispatcher.DefaultIPv6Prefix, "Prefix length that groups IPv6 source addresses for -maxConnectionsPerSource"),
+		acceptRate:     flags.Float64("acceptRate", 0, "Maximum number of connections accepted per second, 0 for no limit"),
+		acceptBurst:    flags.Int("acceptBurst", 1, "Number of connections that can be accepted at once above -acceptRate"),
+
+		uploadRate:       flags.String("uploadRate", "", "Maximum rate sent over the transports by every connection together, in bytes per second with an optional K, M or G suffix"),
+		downloadRate:     flags.String("downloadRate", "", "Maximum rate received from the transports by every connection together"),
+		connUploadRate:   flags.String("connectionUploadRate", "", "Maximum rate sent over the transport by each connection"),
+		connDownloadRate: flags.String("connectionDownloadRate", "", "Maximum rate received from the transport by each connection"),
+		transportRates:   flags.String("transportRates", "", "Maximum rates shared by the connections of each transport, as a comma separated list of [transport]=[upload]/[download], such as shadow=1M/4M"),
+
+		dialTimeout:      flags.Duration("dialTimeout", 0, "Give up on a TCP connection to the transport server, the proxy or the target after this long, 0 for no timeout"),
+		handshakeTimeout: flags.Duration("handshakeTimeout", 0, "Give up on a transport connection that has not completed its handshake after this long, 0 for no timeout"),
+		idleTimeout:      flags.Duration("idleTimeout", 0, "Close a connection or UDP flow that has carried no data for this long, 0 for no timeout"),
+		writeTimeout:     flags.Duration("writeTimeout", 0, "Close a connection when a write has been blocked for this long, 0 for no timeout"),
+
+		keepAlive: flags.Duration("keepAlive", 0, "TCP keepalive period of the application, target and transport sockets, 0 for the system default and a negative period to disable keepalives"),
+		heartbeat: flags.Duration("heartbeat", 0, "Send a heartbeat over the transport connection of each UDP flow in transparent UDP mode this often, and close the flows that the server stops answering, 0 to disable. The server must support heartbeats too"),
 	}
+}
 
-	bindAddr := flag.String("bindaddr", "", "Specify the bind address for transparent server")
-	extorport := flag.String("extorport", "", "Specify the address of a server implementing the Extended OR Port protocol, which is used for per-connection metadata")
-	authcookie := flag.String("authcookie", "", "Specify an authentication cookie, for use in authenticating with the Extended OR Port")
-
-	// Experimental flags under consideration for PT 2.1
-	socksAddr := flag.String("proxylistenaddr", "", "Specify the bind address for the local SOCKS server provided by the client")
-	optionsFile := flag.String("optionsFile", "", "store all the options in a single file")
-
-	// Additional command line flags inherited from obfs4proxy
-	showVer := flag.Bool("showVersion", false, "Print version and exit")
-	logLevelStr := flag.String("logLevel", "ERROR", "Log level (ERROR/WARN/INFO/DEBUG)")
-	enableLogging := flag.Bool("enableLogging", false, "Log to [state]/"+dispatcherLogFile)
-	ipcLogLevelStr := flag.String("ipcLogLevel", "NONE", "IPC Log level (ERROR/WARN/INFO/DEBUG/NONE)")
-
-	// Flags for config generation
-	generateConfig := flag.Bool("generateConfig", false, "Generate a config for the specified transport")
-	serverAddress := flag.String("serverIP", "", "Specify the IP address of the server to use in the config")
-	toneburst := flag.Bool("toneburst", false, "Use the starburst toneburst for the Replicant config generation")
-	polish := flag.Bool("polish", false, "Use the Darkstar polish for the Replicant config generation")
-
-	// Additional command line flags added to shapeshifter-dispatcher
-	clientMode := flag.Bool("client", false, "Enable client mode")
-	serverMode := flag.Bool("server", false, "Enable server mode")
-	transparent := flag.Bool("transparent", false, "Enable transparent proxy mode. The default is protocol-aware proxy mode (socks5 for TCP, STUN for UDP)")
-	udp := flag.Bool("udp", false, "Enable UDP proxy mode. The default is TCP proxy mode.")
-	target := flag.String("target", "", "Specify transport server destination address")
-	enableLocket := flag.Bool("enableLocket", false, "Log to [state]/"+dispatcherLogFile+" using Locket")
-	flag.Parse() // Flag variables are set to actual values here.
-
-	// Start validation of command line arguments
+// config either reads the whole configuration from -config, or assembles it
+// from the individual flags. Every problem found is returned, the
+// configuration has not been validated yet.
+func (runFlags *runFlags) config(flags *flag.FlagSet, allowedWithConfig ...string) (*dispatcherConfig, configProblems, error) {
+	var problems configProblems
 
-	if *generateConfig {
-		switch strings.ToLower(*transport) {
-			case "shadow":
-				transports.CreateShadowConfigs(*serverAddress, bindAddr)
-			case "starbridge":
-				transports.CreateStarbridgeConfigs(*serverAddress, bindAddr)
-			case "replicant":
-				transports.CreateReplicantConfigs(*serverAddress, *toneburst, *polish, bindAddr)
-			default:
-				// FIXME: add print/log in case of wrong name
+	if *runFlags.configPath != "" {
+		flags.Visit(func(setFlag *flag.Flag) {
+			if setFlag.Name == "config" || containsString(allowedWithConfig, setFlag.Name) {
 				return
-		}
-	} 
-
-	if *showVer {
-		fmt.Printf("%s\n", getVersion())
-		os.Exit(0)
-	}
-
-	logPath := path.Join(stateDir, dispatcherLogFile)
-	logFile, logFileErr := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if logFileErr != nil {
-		println("could open logFile")
-	}
-
-	golog.SetOutput(logFile)
+			}
+			problems.add("-%s cannot be used together with -config, set it in the config file instead", setFlag.Name)
+		})
 
-	if enableLogging != nil {
-		lowerCaseLogLevelStr := strings.ToLower(*logLevelStr)
-		golog.SetLevel(lowerCaseLogLevelStr)
-	} else {
-		golog.SetLevel("fatal")
-	}
+		config, loadError := loadConfigFile(*runFlags.configPath)
+		if loadError != nil {
+			return nil, nil, loadError
+		}
 
-	ipcLogLevel, ipcLogLevelError := validateIPCLogLevel(*ipcLogLevelStr)
-	if ipcLogLevelError != nil {
-		println(ipcLogLevel)
-		golog.Errorf("could not validate IPC log level %s", ipcLogLevelError)
-		return
+		return config, problems, nil
+	}
+
+	transport := runFlags.transport
+	transportsList := runFlags.transportsList
+	bindAddr := runFlags.bindAddr
+	target := runFlags.target
+	socksAddr := runFlags.socksAddr
+
+	config := &dispatcherConfig{
+		Role:             roleServer,
+		StateDir:         *runFlags.statePath,
+		ProxyListenAddr:  *socksAddr,
+		Target:           *target,
+		ExtOrPort:        *runFlags.extorport,
+		AuthCookie:       *runFlags.authcookie,
+		Proxy:            *runFlags.proxy,
+		EnableLocket:     *runFlags.enableLocket,
+		ExitOnStdinClose: *runFlags.exitOnStdinClose,
+		MetricsAddr:      *runFlags.metricsAddr,
+		AdminAddr:        *runFlags.adminAddr,
+		AdminTokenFile:   *runFlags.adminTokenFile,
+		Accounting:       *runFlags.accounting,
+		OptionsFile:      *runFlags.optionsFile,
+		Logging: loggingConfig{
+			Enabled:  *runFlags.enableLogging,
+			Level:    *runFlags.logLevelStr,
+			IPCLevel: *runFlags.ipcLogLevelStr,
+			Format:   *runFlags.logFormat,
+			Unsafe:   *runFlags.unsafeLogging,
+			MaxSize:  *runFlags.logMaxSize,
+			MaxAge:   runFlags.logMaxAge.String(),
+			MaxFiles: *runFlags.logMaxFiles,
+			Compress: *runFlags.logCompress,
+		},
+		Limits: limitsConfig{
+			MaxConnections: *runFlags.maxConnections,
+			MaxPerSource:   *runFlags.maxPerSource,
+			IPv4Prefix:     *runFlags.ipv4Prefix,
+			IPv6Prefix:     *runFlags.ipv6Prefix,
+			AcceptRate:     *runFlags.acceptRate,
+			AcceptBurst:    *runFlags.acceptBurst,
+		},
+		Shaping: shapingConfig{
+			bandwidthConfig: bandwidthConfig{Upload: *runFlags.uploadRate, Download: *runFlags.downloadRate},
+			PerConnection:   bandwidthConfig{Upload: *runFlags.connUploadRate, Download: *runFlags.connDownloadRate},
+		},
+		Timeouts: timeoutsConfig{
+			Dial:      runFlags.dialTimeout.String(),
+			Handshake: runFlags.handshakeTimeout.String(),
+			Idle:      runFlags.idleTimeout.String(),
+			Write:     runFlags.writeTimeout.String(),
+		},
+		KeepAlive: keepAliveConfig{
+			Period:    runFlags.keepAlive.String(),
+			Heartbeat: runFlags.heartbeat.String(),
+		},
+	}
+
+	if *runFlags.transportRates != "" {
+		transportRates, ratesError := parseTransportRates(*runFlags.transportRates)
+		if ratesError != nil {
+			problems.add("-transportRates: %s", ratesError.Error())
+		}
+		config.Shaping.Transports = transportRates
 	}
 
-	// Determine if this is a client or server, initialize the common state.
-	launched := false
-	isClient, err := checkIsClient(*clientMode, *serverMode)
-	if err != nil {
-		flag.Usage()
-		golog.Fatalf("[ERROR]: %s - either --client or --server is required, or configure using PT 2.0 environment variables", execName)
-	}
-	if stateDir, err = makeStateDir(*statePath); err != nil {
-		flag.Usage()
-		golog.Fatalf("[ERROR]: %s - No state directory: Use --state", execName)
-	}
-	if *options != "" && *optionsFile != "" {
-		golog.Fatal("You should not specify -options and -optionsFile at the same time.")
-	}
-	if *optionsFile != "" {
-		_, err := os.Stat(*optionsFile)
-		if err != nil {
-			golog.Errorf("Received an error while attempting to parse the options file %s: %s", *optionsFile, err.Error())
-		} else {
-			contents, readErr := ioutil.ReadFile(*optionsFile)
-			if readErr != nil {
-				golog.Errorf("Failed to open the optionsFile: %s", *optionsFile)
-			} else {
-				*options = string(contents)
-			}
-		}
+	// Determine if this is a client or server. Without -client or -server, a
+	// bind address makes it a server.
+	hasBindaddr := *bindAddr != "" || *runFlags.serverBindHost != "" || *runFlags.serverBindPort != ""
+	if isClient, _ := checkIsClient(*runFlags.clientMode, *runFlags.serverMode, hasBindaddr); isClient {
+		config.Role = roleClient
 	}
 
-	transportValidationError := validateTransports(transport, transportsList)
-	if transportValidationError != nil {
-		golog.Errorf("Failed to validate transports: %s", transportValidationError)
-		return
+	if *runFlags.options != "" {
+		config.Options, _ = json.Marshal(*runFlags.options)
 	}
 
+	validateTransports(&problems, transport, transportsList)
 	if *transport != "" && *transportsList == "" {
 		transportsList = transport
 	}
 
-	modeValidationError := validateMode(modeName, transparent, udp)
-	if modeValidationError != nil {
-		golog.Errorf("Failed to validate the mode: %s", modeValidationError)
-		return
-	}
+	validateMode(&problems, runFlags.modeName, runFlags.transparent, runFlags.udp)
+	config.Mode, _ = determineMode(*runFlags.modeName, *runFlags.transparent, *runFlags.udp)
 
-	mode, modeError := determineMode(*modeName, *transparent, *udp)
-	if modeError != nil {
-		golog.Errorf("Invalid mode name: %s", *modeName)
-		return
-	}
+	if config.isClient() {
+		validateProxyListenAddr(&problems, runFlags.proxyListenHost, runFlags.proxyListenPort, socksAddr)
+		if *runFlags.proxyListenHost != "" && *runFlags.proxyListenPort != "" && *socksAddr == "" {
+			config.ProxyListenAddr = *runFlags.proxyListenHost + ":" + *runFlags.proxyListenPort
+		}
 
-	if isClient {
-		proxyListenValidationError := validateProxyListenAddr(proxyListenHost, proxyListenPort, socksAddr)
-		if proxyListenValidationError != nil {
-			golog.Errorf("could not validate: %s", proxyListenValidationError)
-			golog.Infof("proxylistenhost: %s", *proxyListenHost)
-			golog.Infof("proxylistenport: %s", *proxyListenPort)
-			golog.Infof("proxylistenaddr: %s", *socksAddr)
-			return
+		if config.Mode == dispatcher.ModeSocks5 {
+			validatetargetSocks5(&problems, runFlags.targetHost, runFlags.targetPort, target)
+		} else {
+			validatetarget(&problems, true, runFlags.targetHost, runFlags.targetPort, target)
+		}
+
+		if *transportsList != "" {
+			for _, name := range strings.Split(*transportsList, ",") {
+				config.Transports = append(config.Transports, transportConfig{Name: name})
+			}
+		}
+	} else {
+		validatetarget(&problems, false, runFlags.targetHost, runFlags.targetPort, target)
+		if *runFlags.targetHost != "" && *runFlags.targetPort != "" && *target == "" {
+			config.Target = *runFlags.targetHost + ":" + *runFlags.targetPort
 		}
 
-		if *proxyListenHost != "" && *proxyListenPort != "" && *socksAddr == "" {
-			newSocksAddr := *proxyListenHost + ":" + *proxyListenPort
-			socksAddr = &newSocksAddr
+		if config.Mode == dispatcher.ModeSocks5 {
+			validateSocksServerBindAddr(&problems, runFlags.serverBindHost, runFlags.serverBindPort, bindAddr)
+		} else {
+			validateServerBindAddr(&problems, transport, runFlags.serverBindHost, runFlags.serverBindPort, bindAddr)
 		}
 
-		if *socksAddr == "" {
-			*socksAddr = "127.0.0.1:0"
+		if *transport != "" && *runFlags.serverBindHost != "" && *runFlags.serverBindPort != "" && *bindAddr == "" {
+			newBindAddr := *transport + "-" + *runFlags.serverBindHost + ":" + *runFlags.serverBindPort
+			bindAddr = &newBindAddr
 		}
 
-		if mode == socks5 {
-			targetValidationError := validatetargetSocks5(targetHost, targetPort, target)
-			if targetValidationError != nil {
-				golog.Errorf("could not validate: %s", targetValidationError)
-				return
+		var bindaddrs []dispatcher.Bindaddr
+		if *bindAddr != "" {
+			var bindaddrsError error
+			if bindaddrs, bindaddrsError = dispatcher.ParseBindaddrs(*bindAddr); bindaddrsError != nil {
+				problems.add("%s", bindaddrsError.Error())
 			}
+		}
 
-		} else {
-			targetValidationError := validatetarget(isClient, targetHost, targetPort, target)
-			if targetValidationError != nil {
-				println("could not validate: ", targetValidationError.Error())
-				golog.Errorf("could not validate: %s", targetValidationError)
-				return
+		if *transportsList == "*" {
+			// Start every transport that has a bind address.
+			for _, bindaddr := range bindaddrs {
+				config.Transports = append(config.Transports, transportConfig{Name: bindaddr.Transport, Bindaddr: bindaddr.Addr})
 			}
-			if *targetHost != "" && *targetPort != "" && *target == "" {
-				newTarget := *targetHost + ":" + *targetPort
-				bindAddr = &newTarget
+		} else if *transportsList != "" {
+			for _, name := range strings.Split(*transportsList, ",") {
+				transport := transportConfig{Name: name}
+				for _, bindaddr := range bindaddrs {
+					if bindaddr.Transport == name {
+						transport.Bindaddr = bindaddr.Addr
+					}
+				}
+				config.Transports = append(config.Transports, transport)
 			}
 		}
+	}
 
-	} else {
-		if mode == socks5 {
-			serverBindValidationError := validateSocksServerBindAddr(serverBindHost, serverBindPort, bindAddr)
-			if serverBindValidationError != nil {
-				golog.Errorf("could not validate: %s", serverBindValidationError)
-				return
-			}
-		} else {
-			serverBindValidationError := validateServerBindAddr(transport, serverBindHost, serverBindPort, bindAddr)
-			if serverBindValidationError != nil {
-				golog.Errorf("could not validate: %s", serverBindValidationError)
-				return
+	if *runFlags.transportOptions != "" {
+		optionsFiles, optionsError := parseTransportOptionsFiles(*runFlags.transportOptions)
+		if optionsError != nil {
+			problems.add("-transportOptionsFiles: %s", optionsError.Error())
+		}
+
+		for _, optionsFile := range optionsFiles {
+			found := false
+			for index := range config.Transports {
+				if strings.EqualFold(config.Transports[index].Name, optionsFile.transport) {
+					config.Transports[index].OptionsFile = optionsFile.path
+					found = true
+				}
 			}
 
-			if *transport != "" && *serverBindHost != "" && *serverBindPort != "" && *bindAddr == "" {
-				newBindAddr := *transport + "-" + *serverBindHost + ":" + *serverBindPort
-				bindAddr = &newBindAddr
+			if !found {
+				problems.add("-transportOptionsFiles: %s is not one of the enabled transports", optionsFile.transport)
 			}
 		}
 	}
-	// Finished validation of command line arguments
 
-	golog.Infof("%s - launched", getVersion())
+	return config, problems, nil
+}
 
-	if isClient {
-		golog.Infof("%s - initializing client transport listeners", execName)
+// runCommand starts the dispatcher and keeps it running.
+func runCommand(arguments []string) {
+	_, execName := path.Split(os.Args[0])
 
-		switch mode {
-		case socks5:
-			golog.Infof("%s - initializing client transport listeners", execName)
-			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
-			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
-				return
-			}
-			launched = pt_socks5.ClientSetup(*socksAddr, ptClientProxy, names, *options, *enableLocket, stateDir)
-		case transparentTCP:
-			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
-			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
-				return
-			}
-			launched = transparent_tcp.ClientSetup(*socksAddr, ptClientProxy, names, *options, *enableLocket, stateDir)
-		case transparentUDP:
-			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
-			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
-				return
-			}
-			launched = transparent_udp.ClientSetup(*socksAddr, ptClientProxy, names, *options)
-		case stunUDP:
-			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
-			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
-				return
-			}
-			launched = stun_udp.ClientSetup(*socksAddr, ptClientProxy, names, *options)
-		default:
-			golog.Errorf("unsupported mode %d", mode)
-		}
-	} else {
-		golog.Infof("initializing server transport listeners")
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "shapeshifter-dispatcher is a PT v3.0 proxy supporting multiple transports and proxy modes\n\n")
+		_, _ = fmt.Fprintf(os.Stderr, "Usage:\n\t%s [run] -client -state [statedir] -transports [transport1,transport2,...]\n\t%s [run] -config [config file]\n\n", os.Args[0], os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "Example:\n\t%s run -client -state state -transports shadow -optionsFile shadowClient.json\n\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "Run %s help to list the other commands.\n\n", os.Args[0])
+		_, _ = fmt.Fprintf(os.Stderr, "Flags:\n\n")
+		flags.PrintDefaults()
+	}
 
-		switch mode {
-		case socks5:
-			golog.Infof("%s - initializing socks5 server transport listeners", execName)
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = pt_socks5.ServerSetup(ptServerInfo, stateDir, *options, *enableLocket)
-		case transparentTCP:
-			golog.Infof("%s - initializing transparentTCP server transport listeners", execName)
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = transparent_tcp.ServerSetup(ptServerInfo, stateDir, *options, *enableLocket)
-		case transparentUDP:
-			// launched = transparent_udp.ServerSetup(termMon, *bindAddr, *target)
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = transparent_udp.ServerSetup(ptServerInfo, stateDir, *options)
-		case stunUDP:
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = stun_udp.ServerSetup(ptServerInfo, stateDir, *options)
-		default:
-			golog.Errorf("unsupported mode %d", mode)
-		}
+	runFlags := defineRunFlags(flags)
+
+	// Older versions had a single set of flags for everything. These are kept
+	// as aliases for the generate, version and check commands.
+	generateFlags := defineGenerateFlags(flags, runFlags.transport, runFlags.bindAddr, runFlags.transportsList)
+	generateConfig := flags.Bool("generateConfig", false, "Generate a config for the specified transport, the same as the generate command")
+	showVer := flags.Bool("showVersion", false, "Print version and exit, the same as the version command")
+	checkOnly := flags.Bool("checkConfig", false, "Check the configuration and the transport options without starting the dispatcher, the same as the check command")
+	checkFormat := flags.String("checkFormat", "text", "Format of the -checkConfig report (text/json)")
+	_ = flags.Parse(arguments) // Flag variables are set to actual values here.
+
+	if *generateConfig {
+		os.Exit(generateFlags.generate())
+	}
+
+	if *showVer {
+		fmt.Printf("%s\n", getVersion())
+		os.Exit(0)
+	}
+
+	if *checkOnly {
+		os.Exit(checkRunConfig(flags, runFlags, *checkFormat, "checkConfig", "checkFormat"))
 	}
 
-	if !launched {
-		// Initialization failed, the client or server setup routines should
-		// have logged, so just exit here.
-		println("no pluggable transports were launched")
+	config, problems, loadError := runFlags.config(flags)
+	if loadError != nil {
+		fmt.Fprintln(os.Stderr, loadError.Error())
 		os.Exit(-1)
 	}
 
-	golog.Infof("%s - accepting connections", execName)
+	config.validate(&problems)
 
-	if *exitOnStdinClose {
-		_, _ = io.Copy(ioutil.Discard, os.Stdin)
+	// Until the state directory exists, only IPC logs can be sent.
+	ipcLogLevel, _ := validateIPCLogLevel(config.Logging.IPCLevel)
+	_ = log.Init(false, "", ipcLogLevel, log.Rotation{})
+	_ = log.SetLogLevel(config.Logging.Level)
+	_ = log.SetFormat(config.Logging.Format)
+	log.SetUnsafeLogging(config.Logging.Unsafe)
+
+	if len(problems) > 0 {
+		fmt.Fprintln(os.Stderr, "the configuration is not valid:")
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+			log.Errorf("invalid configuration: %s", problem)
+		}
+		os.Exit(-1)
+	}
+	// Finished validation of command line arguments
+
+	var err error
+	if stateDir, err = makeStateDir(config.StateDir); err != nil {
+		flags.Usage()
+		log.Errorf("%s - No state directory: Use --state", execName)
 		os.Exit(-1)
+	}
+
+	logPath := path.Join(stateDir, dispatcherLogFile)
+	if logError := log.Init(config.Logging.Enabled, logPath, ipcLogLevel, config.Logging.rotation()); logError != nil {
+		fmt.Fprintf(os.Stderr, "could not open the log file: %s\n", logError.Error())
+	}
+	handleReopenSignals()
+
+	// The transport libraries log through golog, send their logs to the same
+	// place.
+	golog.SetOutput(log.Output())
+	_ = dispatcher.SetLogLevel(config.Logging.Level)
+
+	log.Noticef("%s - launched", getVersion())
+	log.Infof("%s - initializing %s", execName, modeDescription(config.Mode))
+
+	if config.isClient() {
+		log.Infof("%s - initializing client transport listeners", execName)
 	} else {
-		select {}
+		log.Infof("%s - initializing %s server transport listeners", execName, config.Mode)
+	}
+
+	dispatcherConfig := config.dispatcherConfig()
+	dispatcherConfig.Events.Listening = func(transport string, addr net.Addr) {
+		fmt.Fprintf(os.Stderr, "%s listening on %s\n", transport, addr)
+	}
+
+	running, startError := dispatcher.Start(dispatcherConfig)
+	if startError != nil {
+		log.Errorf("%s", startError)
+		fmt.Fprintf(os.Stderr, "%s\n", startError)
+		os.Exit(-1)
+	}
+
+	log.Infof("%s - accepting connections", execName)
+
+	handleReloadSignals(running)
+
+	if config.ExitOnStdinClose {
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, os.Stdin)
+			os.Exit(-1)
+		}()
 	}
+
+	// The dispatcher runs until it is drained through the admin API.
+	<-running.Drained()
+	log.Infof("%s - drained, exiting", execName)
+	_ = running.Close()
 }
 
-func determineMode(mode string, isTransparent bool, isUDP bool) (int, error) {
+func determineMode(mode string, isTransparent bool, isUDP bool) (string, error) {
 	if mode != "" {
 		switch mode {
-		case "socks5":
-			return socks5, nil
-		case "transparent-TCP":
-			return transparentTCP, nil
-		case "transparent-UDP":
-			return transparentUDP, nil
-		case "STUN":
-			return stunUDP, nil
+		case dispatcher.ModeSocks5, dispatcher.ModeTransparentTCP, dispatcher.ModeTransparentUDP, dispatcher.ModeSTUN:
+			return mode, nil
 		default:
-			return -1, errors.New("invalid mode")
+			return "", errors.New("invalid mode")
 		}
 	}
 	if isTransparent && isUDP {
-		golog.Infof("initializing transparent proxy")
-		golog.Infof("initializing UDP transparent proxy")
-		return transparentUDP, nil
+		return dispatcher.ModeTransparentUDP, nil
 	} else if isTransparent {
-		golog.Infof("initializing transparent proxy")
-		golog.Infof("initializing TCP transparent proxy")
-		return transparentTCP, nil
+		return dispatcher.ModeTransparentTCP, nil
 	} else if isUDP {
-		golog.Infof("initializing STUN UDP proxy")
-		return stunUDP, nil
+		return dispatcher.ModeSTUN, nil
 	} else {
-		golog.Infof("initializing PT 2.1 socks5 proxy")
-		return socks5, nil
+		return dispatcher.ModeSocks5, nil
 	}
 }
 
-func checkIsClient(client bool, server bool) (bool, error) {
-	if client {
-		return true, nil
-	} else if server {
-		return false, nil
-	} else {
-		return true, nil
+// modeDescription names the proxy a mode runs. determineMode runs before
+// logging is set up, so the mode is logged from here once it is.
+func modeDescription(mode string) string {
+	switch mode {
+	case dispatcher.ModeTransparentUDP:
+		return "UDP transparent proxy"
+	case dispatcher.ModeTransparentTCP:
+		return "TCP transparent proxy"
+	case dispatcher.ModeSTUN:
+		return "STUN UDP proxy"
+	default:
+		return "PT 2.1 socks5 proxy"
 	}
 }
 
-func makeStateDir(statePath string) (string, error) {
-	if statePath != "" {
-		err := os.MkdirAll(statePath, 0700)
-		return statePath, err
-	}
+// parseTransportRates parses a -transportRates value such as
+// "shadow=1M/4M,replicant=512K/2M".
+func parseTransportRates(spec string) (map[string]bandwidthConfig, error) {
+	result := make(map[string]bandwidthConfig)
 
-	return statePath, nil
-}
+	for _, part := range strings.Split(spec, ",") {
+		name, rates, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("%q doesn't contain \"=\"", part)
+		}
 
-func getClientNames(ptversion *string, transportsList *string, proxy *string) (clientProxy *url.URL, names []string, retErr error) {
-	var ptClientInfo pt_extras.ClientInfo
+		upload, download, found := strings.Cut(rates, "/")
+		if !found {
+			return nil, fmt.Errorf("%q doesn't contain \"/\" between the upload and download rates", part)
+		}
 
-	if *transportsList == "*" {
-		ptClientInfo = pt_extras.ClientInfo{MethodNames: transports.Transports()}
-	} else {
-		ptClientInfo = pt_extras.ClientInfo{MethodNames: strings.Split(*transportsList, ",")}
+		result[strings.TrimSpace(name)] = bandwidthConfig{Upload: upload, Download: download}
 	}
 
-	ptClientProxy, proxyErr := pt_extras.PtGetProxy(proxy)
-	if proxyErr != nil {
-		return nil, nil, proxyErr
-	} else if ptClientProxy != nil {
-		pt_extras.PtProxyDone()
-	}
+	return result, nil
+}
 
-	return ptClientProxy, ptClientInfo.MethodNames, nil
+type transportOptionsFile struct {
+	transport string
+	path      string
 }
 
-func getServerInfo(bindaddrList *string, options *string, transportList *string, target *string, extorport *string, authcookie *string) pt_extras.ServerInfo {
-	var ptServerInfo pt_extras.ServerInfo
-	var err error
-	var bindaddrs []pt_extras.Bindaddr
+// parseTransportOptionsFiles parses a -transportOptionsFiles value such as
+// "shadow=ShadowServerConfig.json,Replicant=ReplicantServerConfig.json".
+func parseTransportOptionsFiles(spec string) ([]transportOptionsFile, error) {
+	var result []transportOptionsFile
 
-	bindaddrs, err = getServerBindaddrs(bindaddrList, options, transportList)
-	if err != nil {
-		golog.Errorf(err.Error())
-		golog.Errorf("Error parsing bindaddrs %q %q %q", *bindaddrList, *options, *transportList)
-		return ptServerInfo
-	}
+	for _, part := range strings.Split(spec, ",") {
+		name, optionsPath, found := strings.Cut(part, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || optionsPath == "" {
+			return nil, fmt.Errorf("%q is not [transport]=[options file]", part)
+		}
 
-	ptServerInfo = pt_extras.ServerInfo{Bindaddrs: bindaddrs}
-	ptServerInfo.OrAddr, err = pt_extras.ResolveAddr(*target)
-	if err != nil {
-		golog.Errorf("Error resolving OR address %q %q", *target, err)
-		return ptServerInfo
+		result = append(result, transportOptionsFile{transport: name, path: optionsPath})
 	}
 
-	if *authcookie != "" {
-		ptServerInfo.AuthCookiePath = *authcookie
-	}
+	return result, nil
+}
 
-	if *extorport != "" {
-		ptServerInfo.ExtendedOrAddr, err = pt_extras.ResolveAddr(*extorport)
-		if err != nil {
-			golog.Errorf("Error resolving Extended OR address %q %q", *extorport, err)
-			return ptServerInfo
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
 		}
 	}
 
-	return ptServerInfo
+	return false
 }
 
-// Return an array of Bindaddrs.
-func getServerBindaddrs(bindaddrList *string, options *string, transports *string) ([]pt_extras.Bindaddr, error) {
-	var result []pt_extras.Bindaddr
-	var serverBindaddr string
-	var serverTransports string
-
-	// Get the list of all requested bindaddrs.
-	if *bindaddrList != "" {
-		serverBindaddr = *bindaddrList
+func checkIsClient(client bool, server bool, hasBindaddr bool) (bool, error) {
+	if client {
+		return true, nil
+	} else if server {
+		return false, nil
+	} else {
+		return !hasBindaddr, nil
 	}
+}
 
-	for _, spec := range strings.Split(serverBindaddr, ",") {
-		var bindaddr pt_extras.Bindaddr
-
-		parts := strings.SplitN(spec, "-", 2)
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("-bindaddr: %q: doesn't contain \"-\"", spec)
-		}
-		bindaddr.MethodName = parts[0]
-		addr, err := pt_extras.ResolveAddr(parts[1])
-		if err != nil {
-			return nil, fmt.Errorf("-bindaddr: %q: %s", spec, err.Error())
-		}
-		bindaddr.Addr = addr
-		bindaddr.Options = *options
-		result = append(result, bindaddr)
+func makeStateDir(statePath string) (string, error) {
+	if statePath != "" {
+		err := os.MkdirAll(statePath, 0700)
+		return statePath, err
 	}
 
-	if transports == nil {
-		return nil, errors.New("must specify -transport or -transports in server mode")
-	} else {
-		serverTransports = *transports
-	}
-	result = pt_extras.FilterBindaddrs(result, strings.Split(serverTransports, ","))
-	if len(result) == 0 {
-		golog.Errorf("no valid bindaddrs")
-	}
-	return result, nil
+	return statePath, nil
 }
@@ -0,0 +1,98 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConfigProblems tests that every problem with the run flags is
+// reported together, instead of only the first one.
+func TestConfigProblems(t *testing.T) {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	runFlags := defineRunFlags(flags)
+	err := flags.Parse([]string{
+		"-client",
+		"-mode", "bogus",
+		"-transports", "nosuch",
+		"-transportRates", "shadow",
+		"-uploadRate", "fast",
+		"-idleTimeout", "-1s",
+		"-logLevel", "LOUD",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, problems, err := runFlags.config(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.validate(&problems)
+
+	for _, expected := range []string{
+		"-transportRates",
+		`invalid mode "bogus"`,
+		"--proxylistenaddr",
+		`unknown transport "nosuch"`,
+		`invalid rate "fast"`,
+		`invalid idle timeout "-1s"`,
+		`invalid log level "LOUD"`,
+	} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("the problems do not mention %s:\n%s", expected, problems.Error())
+		}
+	}
+}
+
+// TestConfigProblemsWithConfigFile tests that each of the run flags that
+// cannot be combined with -config is reported.
+func TestConfigProblemsWithConfigFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"role":"client"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	runFlags := defineRunFlags(flags)
+	if err := flags.Parse([]string{"-config", configPath, "-client", "-transports", "shadow"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, problems, err := runFlags.config(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"-client cannot be used", "-transports cannot be used"} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("the problems do not mention %s:\n%s", expected, problems.Error())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// The reasons a connection ended, as written in the accounting records.
+const (
+	CloseEOF      = "eof"
+	CloseError    = "error"
+	CloseTimeout  = "timeout"
+	CloseShutdown = "shutdown"
+)
+
+// AccountingRecord describes a connection that has ended.
+type AccountingRecord struct {
+	ID          uint64    `json:"id"`
+	Transport   string    `json:"transport"`
+	Mode        string    `json:"mode"`
+	Remote      string    `json:"remote"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Duration    float64   `json:"durationSeconds"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+	CloseReason string    `json:"closeReason"`
+}
+
+// AccountingLog writes an AccountingRecord for every connection that ends to
+// a file, one JSON object per line.
+type AccountingLog struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// OpenAccountingLog opens the accounting file at path, appending to it if it
+// already exists.
+func OpenAccountingLog(path string) (*AccountingLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountingLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (accounting *AccountingLog) write(record AccountingRecord) {
+	accounting.lock.Lock()
+	defer accounting.lock.Unlock()
+
+	if accounting.file == nil {
+		return
+	}
+
+	if err := accounting.encoder.Encode(record); err != nil {
+		log.With("error", err).Errorf("failed to write an accounting record")
+	}
+}
+
+// Close closes the accounting file. Connections that end afterwards are not
+// recorded.
+func (accounting *AccountingLog) Close() error {
+	accounting.lock.Lock()
+	defer accounting.lock.Unlock()
+
+	if accounting.file == nil {
+		return nil
+	}
+
+	err := accounting.file.Close()
+	accounting.file = nil
+	return err
+}
+
+// closeReason works out why a connection ended from the way it was closed
+// and the error, if any, that ended the copy loop.
+func closeReason(shutdown bool, relayed bool, copyError error) string {
+	var timeout interface{ Timeout() bool }
+	switch {
+	case shutdown:
+		return CloseShutdown
+	case copyError != nil && errors.As(copyError, &timeout) && timeout.Timeout():
+		return CloseTimeout
+	case copyError != nil || !relayed:
+		// A handler that returns before relaying any data failed to reach
+		// the other side.
+		return CloseError
+	default:
+		return CloseEOF
+	}
+}
@@ -0,0 +1,143 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// readAccountingLog reads the records in an accounting file.
+func readAccountingLog(t *testing.T, path string) []AccountingRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []AccountingRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AccountingRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("expected one JSON record per line, got %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// handleTestConnection runs a connection through the runtime, as if it had
+// been accepted, and reports it as relayed if relayed is set.
+func handleTestConnection(runtime *Runtime, relayed bool) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	runtime.handleConnection("shadow", conn, false, func(logger *log.Logger) {
+		if relayed {
+			runtime.copyFinished(runtime.trackedConnection(conn), nil)
+		}
+		_ = conn.Close()
+	})
+}
+
+// TestAccountingLog checks that every connection gets a record when it ends,
+// that the file is appended to when it is opened again, and that nothing is
+// written once it is closed.
+func TestAccountingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounting.json")
+
+	runtime := NewRuntime("")
+	runtime.Mode = "socks5"
+	accounting, err := OpenAccountingLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.Accounting = accounting
+
+	handleTestConnection(runtime, true)
+	handleTestConnection(runtime, false)
+	if err = accounting.Close(); err != nil {
+		t.Fatal(err)
+	}
+	handleTestConnection(runtime, true)
+
+	if runtime.Accounting, err = OpenAccountingLog(path); err != nil {
+		t.Fatal(err)
+	}
+	handleTestConnection(runtime, true)
+	_ = runtime.Accounting.Close()
+
+	records := readAccountingLog(t, path)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+
+	if records[0].CloseReason != CloseEOF || records[1].CloseReason != CloseError {
+		t.Errorf("expected the close reasons eof and error, got %s and %s", records[0].CloseReason, records[1].CloseReason)
+	}
+	if records[2].ID != 4 {
+		t.Errorf("expected the connection closed while the file was closed to be skipped, got the ID %d", records[2].ID)
+	}
+	for _, record := range records {
+		if record.Transport != "shadow" || record.Mode != "socks5" {
+			t.Errorf("expected a shadow connection in socks5 mode, got %s in %s mode", record.Transport, record.Mode)
+		}
+		if record.End.Before(record.Start) || record.Duration < 0 {
+			t.Errorf("expected the connection to end after it started, got %s to %s", record.Start, record.End)
+		}
+	}
+}
+
+// TestCloseReason checks which close reason wins when a connection ends in
+// more than one way at once.
+func TestCloseReason(t *testing.T) {
+	deadline := &net.OpError{Op: "write", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
+	if reason := closeReason(true, true, deadline); reason != CloseShutdown {
+		t.Errorf("expected a shutdown to win over a timeout, got %s", reason)
+	}
+	if reason := closeReason(false, true, fmt.Errorf("copy failed: %w", deadline)); reason != CloseTimeout {
+		t.Errorf("expected a wrapped deadline error to be a timeout, got %s", reason)
+	}
+	if reason := closeReason(false, true, errors.New("connection reset by peer")); reason != CloseError {
+		t.Errorf("expected a copy error to be an error, got %s", reason)
+	}
+	if reason := closeReason(false, false, nil); reason != CloseError {
+		t.Errorf("expected a connection that never relayed data to be an error, got %s", reason)
+	}
+	if reason := closeReason(false, true, nil); reason != CloseEOF {
+		t.Errorf("expected a connection closed by its peer to be eof, got %s", reason)
+	}
+}
@@ -25,103 +25,210 @@ SOFTWARE.
 package modes
 
 import (
-	"fmt"
 	"net"
-	"net/url"
+	"sync"
+	"time"
 
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
 	locketgo "github.com/OperatorFoundation/locket-go"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/kataras/golog"
 	"golang.org/x/net/proxy"
 )
 
 type ConnState struct {
 	Conn    net.Conn
 	Waiting bool
+
+	// LastActive is when a packet of the flow was last forwarded.
+	LastActive time.Time
+}
+
+// ConnTracker holds the UDP flows by source address. The flows are added and
+// used by the UDP handler while their connections are made in the background,
+// so all access goes through the lock. Each flow counts toward the connection
+// limits of the runtime until it is forgotten.
+type ConnTracker struct {
+	lock    sync.Mutex
+	flows   map[string]ConnState
+	runtime *Runtime
 }
 
-type ConnTracker map[string]ConnState
+func NewConnTracker(runtime *Runtime) *ConnTracker {
+	return &ConnTracker{flows: make(map[string]ConnState), runtime: runtime}
+}
 
-type ClientHandlerTCP func(name string, options string, conn net.Conn, proxyURI *url.URL, enableLocket bool, logDir string)
+// Get returns the flow from addr, if there is one.
+func (tracker *ConnTracker) Get(addr string) (ConnState, bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
 
-type ClientHandlerUDP func(name string, options string, conn *net.UDPConn, proxyURI *url.URL)
+	state, ok := tracker.flows[addr]
+	return state, ok
+}
 
-type ServerHandler func(name string, remote net.Conn, info *pt_extras.ServerInfo)
+// Set records the flow from addr.
+func (tracker *ConnTracker) Set(addr string, state ConnState) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
 
-func NewConnState() ConnState {
-	return ConnState{nil, true}
+	tracker.flows[addr] = state
 }
 
-func OpenConnection(tracker *ConnTracker, addr string, name string, options string, proxyURI *url.URL, enableLocket bool, logDir string) {
-	newConn := NewConnState()
-	(*tracker)[addr] = newConn
+// Delete forgets the flow from addr.
+func (tracker *ConnTracker) Delete(addr string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
 
-	go dialConn(tracker, addr, name, options, proxyURI, enableLocket, logDir)
+	delete(tracker.flows, addr)
+	tracker.runtime.removeFlow(addr)
 }
 
-func dialConn(tracker *ConnTracker, addr string, name string, options string, proxyURI *url.URL, enableLocket bool, logDir string) {
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	var dialer proxy.Dialer
-	dialer = proxy.Direct
-	if proxyURI != nil {
-		var err error
-		dialer, err = proxy.FromURL(proxyURI, proxy.Direct)
-		if err != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			fmt.Println("failed to obtain dialer", proxyURI, proxy.Direct)
-			golog.Error("(%s) - failed to obtain proxy dialer")
-			return
+// CloseIdle closes and forgets the open flows that have not forwarded a
+// packet for longer than the idle timeout.
+func (tracker *ConnTracker) CloseIdle(timeout time.Duration, logger *log.Logger) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	for addr, state := range tracker.flows {
+		if state.Waiting || time.Since(state.LastActive) < timeout {
+			continue
 		}
 
+		logger.With("remote", addr).Debugf("closing idle UDP flow")
+		_ = state.Conn.Close()
+		delete(tracker.flows, addr)
+		tracker.runtime.removeFlow(addr)
 	}
+}
 
-	println("Dialing....")
+type ClientHandlerTCP func(name string, options string, conn net.Conn, runtime *Runtime, logger *log.Logger)
 
-	// Deal with arguments.
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
+type ClientHandlerUDP func(name string, conn *net.UDPConn, runtime *Runtime)
 
+type ServerHandler func(name string, remote net.Conn, info *pt_extras.ServerInfo, runtime *Runtime, logger *log.Logger)
+
+func NewConnState() ConnState {
+	return ConnState{Waiting: true}
+}
+
+// FlowOpened is called with the transport connection of a new UDP flow, and
+// returns the connection that the packets of the flow are written to.
+type FlowOpened func(remote net.Conn, logger *log.Logger) net.Conn
+
+// OpenConnection starts connecting to the transport server for the UDP flow
+// from addr. opened, if not nil, is called once the connection is made. It
+// returns false if the flow is over the connection limits.
+func OpenConnection(tracker *ConnTracker, addr *net.UDPAddr, name string, options string, runtime *Runtime, opened FlowOpened) bool {
+	if reason := runtime.addFlow(addr); reason != "" {
+		runtime.countRejected(name, addr, reason)
+		return false
+	}
+
+	tracker.Set(addr.String(), NewConnState())
+
+	go dialConn(tracker, addr.String(), name, options, runtime, opened)
+	return true
+}
+
+func dialConn(tracker *ConnTracker, addr string, name string, options string, runtime *Runtime, opened FlowOpened) {
+	logger := runtime.flowLogger(name, addr)
+	logger.Infof("new UDP flow, connecting to the transport server")
+
+	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
+	dialer, proxyError := ProxyDialer(runtime)
+	if proxyError != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		logger.Errorf("failed to obtain proxy dialer: %s", log.ElideError(proxyError))
+		tracker.Delete(addr)
+		return
+	}
+
+	// Deal with arguments.
+	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, runtime.EnableLocket, runtime.StateDir)
 	if argsToDialerErr != nil {
-		log.Errorf("Error creating a transport with the provided options: %s", options)
-		log.Errorf("Error: %s", argsToDialerErr)
+		logger.With("options", options).Errorf("error creating a transport with the provided options: %s", argsToDialerErr)
+		tracker.Delete(addr)
 		return
 	}
-	fmt.Println("Dialing ")
-	remote, dialError := transport.Dial()
+
+	remote, dialError := DialTransport(name, transport, runtime)
 	if dialError != nil {
-		fmt.Println("outgoing connection failed: ", dialError)
-		golog.Error("(%s) - outgoing connection failed")
-		println("Failed")
-		delete(*tracker, addr)
+		logger.With("error", dialError).Errorf("outgoing connection failed")
+		tracker.Delete(addr)
 		return
 	}
 
-	println("Success")
+	logger.Infof("connected to the transport server")
+
+	if opened != nil {
+		remote = opened(remote, logger)
+	}
+
+	tracker.Set(addr, ConnState{Conn: remote, LastActive: time.Now()})
+}
+
+// ProxyDialer returns the dialer for the upstream proxy, or a direct dialer
+// if no proxy is configured.
+func ProxyDialer(runtime *Runtime) (proxy.Dialer, error) {
+	if runtime.ProxyURI == nil {
+		return runtime.directDialer(), nil
+	}
 
-	(*tracker)[addr] = ConnState{remote, false}
+	return proxy.FromURL(runtime.ProxyURI, runtime.directDialer())
 }
 
-func ServerAcceptLoop(name string, ln net.Listener, info *pt_extras.ServerInfo, serverHandler ServerHandler, enableLocket bool, stateDir string) {
+// DialTransport connects to the transport server within the handshake
+// timeout, recording the result and the time taken by the connection and
+// handshake in the metrics.
+func DialTransport(name string, transport Optimizer.TransportDialer, runtime *Runtime) (net.Conn, error) {
+	start := time.Now()
+	remote, dialError := DialWithTimeout(transport, runtime.Timeouts.Handshake, runtime.Done())
+
+	metrics.Dials.With(name, runtime.Mode, metrics.DialResult(dialError)).Inc()
+	if dialError == nil {
+		metrics.HandshakeSeconds.With(name, runtime.Mode).Observe(time.Since(start).Seconds())
+	}
+
+	return remote, dialError
+}
+
+// RemoteAddrString returns the address of the other end of a connection, or
+// an empty string for the transport connections that do not know it.
+func RemoteAddrString(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+
+	return ""
+}
+
+func ServerAcceptLoop(name string, ln net.Listener, info *pt_extras.ServerInfo, serverHandler ServerHandler, runtime *Runtime, enableLocket bool) {
+	logger := log.With("transport", name, "mode", runtime.Mode)
+
 	for {
 		conn, err := ln.Accept()
-		fmt.Println("accepted")
 		if err != nil {
-			print("Received an error while attempting to accept a connection:")
-			print(err.Error())
-
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				log.Errorf("ServerAcceptLoop failed")
+				if !runtime.Closed() {
+					logger.With("error", err).Errorf("transport listener failed")
+				}
 				_ = ln.Close()
 				return
 			}
+
+			logger.With("error", err).Warnf("failed to accept a connection")
 			continue
 		}
 
+		runtime.SetKeepAlive(conn)
+
 		if enableLocket {
-			locketConn, locketError := locketgo.NewLocketConn(conn, stateDir, "DispatcherServer")
+			locketConn, locketError := locketgo.NewLocketConn(conn, runtime.StateDir, "DispatcherServer")
 			if locketError != nil {
-				golog.Error("server failed to enable Locket")
+				logger.With("error", locketError).Errorf("server failed to enable Locket")
 				conn.Close()
 				return
 			}
@@ -129,6 +236,10 @@ func ServerAcceptLoop(name string, ln net.Listener, info *pt_extras.ServerInfo,
 			conn = locketConn
 		}
 
-		go serverHandler(name, conn, info)
+		// The listeners started by ServerSetup have already checked the
+		// connection against the limits.
+		go runtime.handleConnection(name, conn, true, func(connLogger *log.Logger) {
+			serverHandler(name, conn, info, runtime, connLogger)
+		})
 	}
 }
@@ -0,0 +1,78 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"net"
+	"time"
+)
+
+// HeartbeatMisses is the number of heartbeat intervals without an answer
+// from the server after which a transport connection is considered dead.
+const HeartbeatMisses = 3
+
+// KeepAlive detects the peers of long lived connections that have gone away
+// without closing them, such as when a NAT drops its mapping.
+type KeepAlive struct {
+	// Period is the TCP keepalive period of the application, target and
+	// transport sockets. Zero keeps the default of the Go runtime, and a
+	// negative period disables TCP keepalives.
+	Period time.Duration
+
+	// Heartbeat is the interval between the heartbeats sent over the
+	// transport connections of UDP flows in transparent UDP mode. Zero
+	// disables them, which is the default because a server without heartbeat
+	// support forwards each heartbeat to the target as an empty datagram.
+	// STUN mode has no heartbeats, since its frames are STUN messages with no
+	// room for an empty one.
+	Heartbeat time.Duration
+}
+
+// SetKeepAlive applies the TCP keepalive period to conn, or to the TCP
+// connection it wraps if it exposes it. Other connections are left alone.
+func (runtime *Runtime) SetKeepAlive(conn net.Conn) {
+	period := runtime.KeepAlive.Period
+	if period == 0 {
+		return
+	}
+
+	for {
+		switch wrapped := conn.(type) {
+		case *net.TCPConn:
+			if period < 0 {
+				_ = wrapped.SetKeepAlive(false)
+				return
+			}
+
+			_ = wrapped.SetKeepAlive(true)
+			_ = wrapped.SetKeepAlivePeriod(period)
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = wrapped.NetConn()
+		default:
+			return
+		}
+	}
+}
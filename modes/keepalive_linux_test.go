@@ -0,0 +1,148 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAliveOf returns whether TCP keepalives are enabled on conn and the
+// idle time before the first one, in seconds.
+func keepAliveOf(t *testing.T, conn *net.TCPConn) (bool, int) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var enabled, idle int
+	var optionError error
+	err = raw.Control(func(fd uintptr) {
+		if enabled, optionError = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); optionError != nil {
+			return
+		}
+		idle, optionError = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if optionError != nil {
+		t.Fatal(optionError)
+	}
+
+	return enabled != 0, idle
+}
+
+// netConnWrapper hides a connection the way the transport libraries do, but
+// exposes it through NetConn.
+type netConnWrapper struct {
+	net.Conn
+}
+
+func (wrapper netConnWrapper) NetConn() net.Conn {
+	return wrapper.Conn
+}
+
+// TestSetKeepAlive tests that the keepalive period is applied to TCP
+// connections, and to the ones they wrap, and that a negative period
+// disables the keepalives.
+func TestSetKeepAlive(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	tests := []struct {
+		name     string
+		period   time.Duration
+		wrap     bool
+		enabled  bool
+		expected int
+	}{
+		{"period", 42 * time.Second, false, true, 42},
+		{"wrapped", 43 * time.Second, true, true, 43},
+		{"disabled", -1, false, false, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, dialErr := net.Dial("tcp", socket.Addr().String())
+			if dialErr != nil {
+				t.Fatal(dialErr)
+			}
+			defer conn.Close()
+
+			runtime := NewRuntime("")
+			runtime.KeepAlive.Period = test.period
+			if test.wrap {
+				runtime.SetKeepAlive(netConnWrapper{conn})
+			} else {
+				runtime.SetKeepAlive(conn)
+			}
+
+			enabled, idle := keepAliveOf(t, conn.(*net.TCPConn))
+			if enabled != test.enabled {
+				t.Errorf("keepalives enabled is %v, expected %v", enabled, test.enabled)
+			}
+			if test.enabled && idle != test.expected {
+				t.Errorf("the keepalive idle time is %ds, expected %ds", idle, test.expected)
+			}
+		})
+	}
+}
+
+// TestListenerKeepAlive tests that the sockets accepted for the transport
+// servers get the keepalive period before the transport wraps them.
+func TestListenerKeepAlive(t *testing.T) {
+	runtime := NewRuntime("")
+	runtime.KeepAlive.Period = 42 * time.Second
+
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := limitedListener{socket, "plain", runtime}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	enabled, idle := keepAliveOf(t, conn.(reservedConn).Conn.(*net.TCPConn))
+	if !enabled || idle != 42 {
+		t.Errorf("the accepted socket has keepalives enabled %v after %ds, expected enabled after 42s", enabled, idle)
+	}
+}
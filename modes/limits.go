@@ -0,0 +1,401 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"net"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+// Default prefix lengths used to group sources for MaxPerSource.
+const (
+	DefaultIPv4Prefix = 32
+	DefaultIPv6Prefix = 64
+)
+
+// rejectWarningInterval is how often the rejected connections are logged as
+// a warning. Every rejection is logged at the debug level.
+const rejectWarningInterval = 10 * time.Second
+
+// Limits restricts the connections accepted by the listeners. Connections
+// over the limits are closed as soon as they are accepted, before the
+// transport handshake on servers. The UDP flows of a client count as
+// connections. Zero values disable each limit.
+type Limits struct {
+	// MaxConnections is the number of connections that can be handled at the
+	// same time.
+	MaxConnections int
+
+	// MaxPerSource is the number of connections that can be handled at the
+	// same time from one source IP address. IPv4 and IPv6 addresses are
+	// grouped into networks with IPv4Prefix and IPv6Prefix bits, by default
+	// 32 and 64.
+	MaxPerSource int
+	IPv4Prefix   int
+	IPv6Prefix   int
+
+	// AcceptRate is the number of connections accepted per second, with
+	// bursts of up to AcceptBurst connections.
+	AcceptRate  float64
+	AcceptBurst int
+}
+
+// tokenBucket allows events at rate per second on average, with bursts of up
+// to burst events. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (bucket *tokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+// give puts back n tokens taken from the bucket.
+func (bucket *tokenBucket) give(n float64) {
+	bucket.refill()
+	bucket.tokens += n
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+}
+
+// take removes n tokens from the bucket if it holds enough of them.
+func (bucket *tokenBucket) take(n float64) bool {
+	bucket.refill()
+	if bucket.tokens < n {
+		return false
+	}
+
+	bucket.tokens -= n
+	return true
+}
+
+// reserve removes n tokens from the bucket, going into debt if it does not
+// hold enough of them, and returns how long to wait until the debt is paid.
+func (bucket *tokenBucket) reserve(n float64) time.Duration {
+	bucket.refill()
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// sourceKey returns the network a remote address is grouped into for
+// MaxPerSource, or an empty string if the address is not known.
+func (limits Limits) sourceKey(remote net.Addr) string {
+	if remote == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return ""
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		prefix := limits.IPv4Prefix
+		if prefix <= 0 || prefix > 32 {
+			prefix = DefaultIPv4Prefix
+		}
+		return ipv4.Mask(net.CIDRMask(prefix, 32)).String()
+	}
+
+	prefix := limits.IPv6Prefix
+	if prefix <= 0 || prefix > 128 {
+		prefix = DefaultIPv6Prefix
+	}
+	return ip.Mask(net.CIDRMask(prefix, 128)).String()
+}
+
+// overLimit returns the reason a new connection from source must be
+// rejected, or an empty string if it can be accepted. A rate token is only
+// taken if takeToken is set and the connection is within the other limits.
+// It must be called with the runtime lock held.
+func (runtime *Runtime) overLimit(source string, takeToken bool) string {
+	limits := runtime.Limits
+
+	if limits.MaxConnections > 0 && len(runtime.connections)+len(runtime.flows)+len(runtime.reserved) >= limits.MaxConnections {
+		return metrics.RejectTotal
+	}
+
+	if limits.MaxPerSource > 0 && source != "" && runtime.sources[source] >= limits.MaxPerSource {
+		return metrics.RejectSource
+	}
+
+	if limits.AcceptRate > 0 && takeToken {
+		if runtime.acceptBucket == nil {
+			runtime.acceptBucket = newTokenBucket(limits.AcceptRate, limits.AcceptBurst)
+		}
+		if !runtime.acceptBucket.take(1) {
+			return metrics.RejectRate
+		}
+	}
+
+	return ""
+}
+
+// refundToken returns the rate token taken for a connection that was
+// rejected later on. It must be called with the runtime lock held.
+func (runtime *Runtime) refundToken() {
+	if runtime.acceptBucket != nil {
+		runtime.acceptBucket.give(1)
+	}
+}
+
+// admit checks a new connection from remote against the limits, taking its
+// rate token, and returns the reason it must be rejected or an empty string.
+// An admitted connection holds a slot from then on, so that connections still
+// in their transport handshake count against the limits, until it is handled
+// or released.
+func (runtime *Runtime) admit(remote net.Addr) string {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	source := runtime.Limits.sourceKey(remote)
+	if reason := runtime.overLimit(source, true); reason != "" {
+		return reason
+	}
+
+	if remote != nil {
+		runtime.reserved[remote.String()] = source
+		if source != "" {
+			runtime.sources[source]++
+		}
+	}
+
+	return ""
+}
+
+// reservation returns the source of the slot reserved for a connection from
+// remote, if there is one. It must be called with the runtime lock held.
+func (runtime *Runtime) reservation(remote net.Addr) (string, bool) {
+	if remote == nil {
+		return "", false
+	}
+
+	source, ok := runtime.reserved[remote.String()]
+	return source, ok
+}
+
+// release frees the slot reserved for a connection from remote that was not
+// handled, such as one whose transport handshake failed.
+func (runtime *Runtime) release(remote net.Addr) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	source, ok := runtime.reservation(remote)
+	if !ok {
+		return
+	}
+
+	delete(runtime.reserved, remote.String())
+	runtime.releaseSource(source)
+}
+
+// addFlow counts a new UDP flow from remote as a connection, or returns the
+// reason it must be rejected.
+func (runtime *Runtime) addFlow(remote net.Addr) string {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	source := runtime.Limits.sourceKey(remote)
+	if reason := runtime.overLimit(source, true); reason != "" {
+		return reason
+	}
+
+	runtime.flows[remote.String()] = source
+	if source != "" {
+		runtime.sources[source]++
+	}
+
+	return ""
+}
+
+// removeFlow stops counting the UDP flow from addr.
+func (runtime *Runtime) removeFlow(addr string) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	source, ok := runtime.flows[addr]
+	if !ok {
+		return
+	}
+
+	delete(runtime.flows, addr)
+	runtime.releaseSource(source)
+}
+
+// releaseSource stops counting a connection from source. It must be called
+// with the runtime lock held.
+func (runtime *Runtime) releaseSource(source string) {
+	if source == "" {
+		return
+	}
+
+	runtime.sources[source]--
+	if runtime.sources[source] == 0 {
+		delete(runtime.sources, source)
+	}
+}
+
+// reservedConn is a connection admitted by a limitedListener. Closing it
+// releases its slot if the connection was never handled.
+type reservedConn struct {
+	net.Conn
+	runtime *Runtime
+}
+
+func (conn reservedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.runtime.release(conn.RemoteAddr())
+
+	return err
+}
+
+// limitedListener rejects the connections over the limits as soon as they
+// are accepted.
+type limitedListener struct {
+	net.Listener
+	transport string
+	runtime   *Runtime
+}
+
+func (listener limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if reason := listener.runtime.admit(conn.RemoteAddr()); reason != "" {
+			listener.runtime.reject(listener.transport, conn, reason)
+			continue
+		}
+
+		// The transports hide the socket behind their own connections, so
+		// the keepalive is set on it here.
+		listener.runtime.SetKeepAlive(conn)
+
+		return reservedConn{conn, listener.runtime}, nil
+	}
+}
+
+// serverListener builds the function that starts the server of a transport,
+// like pt_extras.ArgsToListener, with the limits checked on the connections
+// from its socket, before the transport handshake, and the handshake bounded
+// by the handshake timeout. The transports that do not listen on a socket of
+// their own are limited on the connections they return.
+func (runtime *Runtime) serverListener(name string, options string, enableLocket bool, listenAddr string) (func() (net.Listener, error), error) {
+	limited := false
+	listenSocket := func(address string) (net.Listener, error) {
+		socket, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		limited = true
+		return limitedListener{socket, name, runtime}, nil
+	}
+
+	listen, err := transports.Default.Listener(name, options, transports.Environment{
+		EnableLocket:     enableLocket,
+		LogDir:           runtime.StateDir,
+		ListenAddr:       listenAddr,
+		Listen:           listenSocket,
+		HandshakeTimeout: runtime.Timeouts.Handshake,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (net.Listener, error) {
+		transportLn, listenErr := listen()
+		if listenErr != nil || limited {
+			return transportLn, listenErr
+		}
+
+		return limitedListener{transportLn, name, runtime}, nil
+	}, nil
+}
+
+// reject closes a connection that is over the limits, after refusing it with
+// Reject if that is set.
+func (runtime *Runtime) reject(transport string, conn net.Conn, reason string) {
+	runtime.countRejected(transport, conn.RemoteAddr(), reason)
+
+	if runtime.Reject != nil {
+		_ = runtime.Reject(conn)
+	}
+	_ = conn.Close()
+}
+
+// countRejected records a connection or UDP flow rejected over the limits.
+func (runtime *Runtime) countRejected(transport string, remote net.Addr, reason string) {
+	metrics.ConnectionsRejected.With(transport, runtime.Mode, reason).Inc()
+
+	logger := log.With("transport", transport, "mode", runtime.Mode, "remote", remote, "reason", reason)
+	logger.Debugf("connection rejected")
+
+	runtime.lock.Lock()
+	runtime.rejected++
+	warn := time.Since(runtime.lastRejectWarning) >= rejectWarningInterval
+	rejected := runtime.rejected
+	if warn {
+		runtime.lastRejectWarning = time.Now()
+		runtime.rejected = 0
+	}
+	runtime.lock.Unlock()
+
+	if warn {
+		log.With("transport", transport, "mode", runtime.Mode, "rejected", rejected).Warnf("rejected connections over the connection limits")
+	}
+}
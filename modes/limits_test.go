@@ -0,0 +1,313 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
+)
+
+// TestLimitedListener tests that a connection over the accept rate is closed
+// by the listener and never returned to the transport.
+func TestLimitedListener(t *testing.T) {
+	runtime := NewRuntime("")
+	runtime.Limits = Limits{AcceptRate: 0.001, AcceptBurst: 1}
+
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := limitedListener{socket, "plain", runtime}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first connection was not accepted")
+	}
+
+	second, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the rejected connection returned %v, expected EOF", err)
+	}
+
+	select {
+	case <-accepted:
+		t.Error("the connection over the accept rate was returned")
+	default:
+	}
+}
+
+// TestHandshakeSlots tests that connections still in their transport
+// handshake hold their slot, so that one more than MaxConnections is refused,
+// and that the slot of a failed handshake is given back.
+func TestHandshakeSlots(t *testing.T) {
+	const maxConnections = 2
+
+	runtime := NewRuntime("")
+	runtime.Limits = Limits{MaxConnections: maxConnections}
+	runtime.Timeouts.Handshake = 10 * time.Second
+
+	listen, err := runtime.serverListener("shadow", shadowServerOptions, false, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	reserved := func() int {
+		runtime.lock.Lock()
+		defer runtime.lock.Unlock()
+
+		return len(runtime.reserved)
+	}
+	connect := func(expected int) net.Conn {
+		conn, dialErr := net.Dial("tcp", listener.Addr().String())
+		if dialErr != nil {
+			t.Fatal(dialErr)
+		}
+		for deadline := time.Now().Add(5 * time.Second); reserved() != expected && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if count := reserved(); count != expected {
+			t.Fatalf("%d slots are reserved, expected %d", count, expected)
+		}
+
+		return conn
+	}
+
+	var silent []net.Conn
+	for index := 1; index <= maxConnections; index++ {
+		conn := connect(index)
+		defer conn.Close()
+		silent = append(silent, conn)
+	}
+
+	refused, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	_ = refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the connection over the limit returned %v, expected EOF", err)
+	}
+
+	// The server sees the end of the handshake of the first client.
+	silent[0].Close()
+	for deadline := time.Now().Add(5 * time.Second); reserved() != maxConnections-1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := reserved(); count != maxConnections-1 {
+		t.Fatalf("%d slots are reserved after a handshake failed, expected %d", count, maxConnections-1)
+	}
+
+	admitted := connect(maxConnections)
+	defer admitted.Close()
+	_ = admitted.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err = admitted.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read from the connection in the freed slot returned %v, expected it to stay open", err)
+	}
+}
+
+// TestRefundToken tests that a connection admitted by its listener and then
+// rejected over another limit gives its rate token back.
+func TestRefundToken(t *testing.T) {
+	runtime := NewRuntime("")
+	runtime.Limits = Limits{MaxConnections: 1, AcceptRate: 0.001, AcceptBurst: 2}
+
+	first, firstPeer := net.Pipe()
+	defer first.Close()
+	defer firstPeer.Close()
+	second, secondPeer := net.Pipe()
+	defer second.Close()
+	defer secondPeer.Close()
+
+	if reason := runtime.admit(first.RemoteAddr()); reason != "" {
+		t.Fatalf("the first connection was rejected: %s", reason)
+	}
+	if _, reason := runtime.addConnection("plain", first, true); reason != "" {
+		t.Fatalf("the first connection was rejected: %s", reason)
+	}
+
+	if reason := runtime.admit(second.RemoteAddr()); reason != metrics.RejectTotal {
+		t.Errorf("the second connection was rejected with %q, expected %q", reason, metrics.RejectTotal)
+	}
+	if tokens := runtime.acceptBucket.tokens; tokens < 0.9 {
+		t.Errorf("the bucket holds %.2f tokens, expected the rejected connection not to take one", tokens)
+	}
+
+	runtime.lock.Lock()
+	runtime.acceptBucket.tokens = 0
+	runtime.lock.Unlock()
+	if _, reason := runtime.addConnection("plain", second, true); reason != metrics.RejectTotal {
+		t.Errorf("the second connection was rejected with %q, expected %q", reason, metrics.RejectTotal)
+	}
+	if tokens := runtime.acceptBucket.tokens; tokens < 0.9 {
+		t.Errorf("the bucket holds %.2f tokens, expected the token of the rejected connection back", tokens)
+	}
+}
+
+// TestFlowLimits tests that the UDP flows of a client count toward the
+// limits until they are removed.
+func TestFlowLimits(t *testing.T) {
+	runtime := NewRuntime("")
+	runtime.Limits = Limits{MaxPerSource: 1}
+
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2000}
+
+	if reason := runtime.addFlow(first); reason != "" {
+		t.Fatalf("the first flow was rejected: %s", reason)
+	}
+	if reason := runtime.addFlow(second); reason != metrics.RejectSource {
+		t.Errorf("the second flow was rejected with %q, expected %q", reason, metrics.RejectSource)
+	}
+
+	runtime.removeFlow(first.String())
+	if reason := runtime.addFlow(second); reason != "" {
+		t.Errorf("the second flow was rejected after the first was removed: %s", reason)
+	}
+}
+
+// TestTokenBucket tests taking, reserving and giving back tokens. The
+// buckets start empty with their clock moved back instead of waiting.
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		burst    int
+		elapsed  time.Duration
+		take     float64
+		expected bool
+	}{
+		{5, 0, 1, false},
+		{5, 200 * time.Millisecond, 1, true},
+		{5, 200 * time.Millisecond, 3, false},
+		{5, time.Hour, 5, true},
+		{5, time.Hour, 6, false},
+		{0, time.Hour, 1, true},
+		{0, time.Hour, 2, false},
+	}
+
+	for _, test := range tests {
+		bucket := newTokenBucket(10, test.burst)
+		bucket.tokens = 0
+		bucket.last = time.Now().Add(-test.elapsed)
+
+		if taken := bucket.take(test.take); taken != test.expected {
+			t.Errorf("burst %d after %s: take(%v) = %v, expected %v", test.burst, test.elapsed, test.take, taken, test.expected)
+		}
+	}
+
+	bucket := newTokenBucket(10, 5)
+	if delay := bucket.reserve(5); delay != 0 {
+		t.Errorf("reserve(5) = %s from a full bucket, expected no delay", delay)
+	}
+	if delay := bucket.reserve(5); delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Errorf("reserve(5) = %s from an empty bucket, expected about 500ms", delay)
+	}
+
+	bucket = newTokenBucket(0.001, 1)
+	if !bucket.take(1) || bucket.take(1) {
+		t.Fatal("expected a bucket of one token to allow one take")
+	}
+	bucket.give(1)
+	if !bucket.take(1) {
+		t.Error("the token given back could not be taken")
+	}
+	bucket.give(5)
+	if bucket.tokens > bucket.burst {
+		t.Errorf("the bucket holds %v tokens, expected at most the burst of %v", bucket.tokens, bucket.burst)
+	}
+}
+
+// TestSourceKey tests the networks remote addresses are grouped into.
+func TestSourceKey(t *testing.T) {
+	tests := []struct {
+		limits   Limits
+		remote   net.Addr
+		expected string
+	}{
+		{Limits{}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}, "192.0.2.1"},
+		{Limits{IPv4Prefix: 24}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}, "192.0.2.0"},
+		{Limits{IPv4Prefix: 33}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}, "192.0.2.1"},
+		{Limits{}, &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3::1"), Port: 1000}, "2001:db8:1:2::"},
+		{Limits{IPv6Prefix: 48}, &net.UDPAddr{IP: net.ParseIP("2001:db8:1:2:3::1"), Port: 1000}, "2001:db8:1::"},
+		{Limits{IPv6Prefix: 129}, &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3::1"), Port: 1000}, "2001:db8:1:2::"},
+		{Limits{}, nil, ""},
+		{Limits{}, pipeAddr{}, ""},
+	}
+
+	for _, test := range tests {
+		if key := test.limits.sourceKey(test.remote); key != test.expected {
+			t.Errorf("sourceKey(%v) with prefixes %d and %d = %q, expected %q", test.remote, test.limits.IPv4Prefix, test.limits.IPv6Prefix, key, test.expected)
+		}
+	}
+}
+
+// pipeAddr is the address of a connection that has no IP address.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,123 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+// Options holds the transport options used for new transport connections and
+// listeners. The value can be replaced at runtime when the configuration is
+// reloaded; connections that are already established keep running with the
+// options they were created with.
+type Options struct {
+	lock    sync.RWMutex
+	value   string
+	changed chan struct{}
+}
+
+func NewOptions(value string) *Options {
+	return &Options{value: value, changed: make(chan struct{})}
+}
+
+// Get returns the current transport options.
+func (options *Options) Get() string {
+	options.lock.RLock()
+	defer options.lock.RUnlock()
+
+	return options.value
+}
+
+// Watch returns the current transport options together with a channel that
+// is closed the next time they are replaced.
+func (options *Options) Watch() (string, <-chan struct{}) {
+	options.lock.RLock()
+	defer options.lock.RUnlock()
+
+	return options.value, options.changed
+}
+
+// Set replaces the transport options and wakes up everyone watching them.
+func (options *Options) Set(value string) {
+	options.lock.Lock()
+	defer options.lock.Unlock()
+
+	options.value = value
+	close(options.changed)
+	options.changed = make(chan struct{})
+}
+
+// ListenerOptions returns the options of the server listener on bindaddr:
+// its own if it was given some with SetListenerOptions, otherwise the options
+// shared by every transport.
+func (runtime *Runtime) ListenerOptions(bindaddr pt_extras.Bindaddr) *Options {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	if options, ok := runtime.listenerOptions[bindaddrKey(bindaddr)]; ok {
+		return options
+	}
+
+	return runtime.Options
+}
+
+// SetListenerOptions gives the server listener on bindaddr options of its
+// own. It must be called before the listener is started.
+func (runtime *Runtime) SetListenerOptions(bindaddr pt_extras.Bindaddr, options *Options) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	if runtime.listenerOptions == nil {
+		runtime.listenerOptions = make(map[string]*Options)
+	}
+	runtime.listenerOptions[bindaddrKey(bindaddr)] = options
+}
+
+func bindaddrKey(bindaddr pt_extras.Bindaddr) string {
+	return strings.ToLower(bindaddr.MethodName) + "-" + bindaddr.Addr.String()
+}
+
+// closeOnChange closes the listener when the options change, so that the
+// listener loop can start over with the new configuration, or when the runtime
+// is closed. The returned function must be called once the listener is no
+// longer in use.
+func closeOnChange(ln net.Listener, changed <-chan struct{}, done <-chan struct{}) (stop func()) {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-changed:
+			_ = ln.Close()
+		case <-done:
+			_ = ln.Close()
+		case <-finished:
+		}
+	}()
+
+	return func() { close(finished) }
+}
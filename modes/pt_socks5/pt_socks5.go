@@ -32,172 +32,103 @@ package pt_socks5
 import (
 	"fmt"
 	"net"
-	"net/url"
 
-	locketgo "github.com/OperatorFoundation/locket-go"
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	"github.com/kataras/golog"
-	"golang.org/x/net/proxy"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string, enableLocket bool, stateDir string) (launched bool) {
-	// Launch each of the client listeners.
-	for _, name := range names {
-		ln, err := net.Listen("tcp", socksAddr)
-		if err != nil {
-			golog.Error(err)
-			continue
-		}
-
-		go clientAcceptLoop(name, ln, ptClientProxy, options, enableLocket, stateDir)
-
-		golog.Infof("%s - registered listener: %s", name, ln.Addr())
-
-		launched = true
-	}
+func ClientSetup(socksAddr string, names []string, runtime *modes.Runtime) (launched bool) {
+	// Applications get a SOCKS error when they are over the connection
+	// limits.
+	runtime.Reject = socks5.Reject
+	launched = modes.ClientSetupTCP(socksAddr, names, runtime, clientHandler)
 	fmt.Println("CMETHODS DONE")
 
 	return
 }
 
-func clientAcceptLoop(name string, ln net.Listener, proxyURI *url.URL, options string, enableLocket bool, stateDir string) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				golog.Errorf("serverAcceptLoop failed")
-				_ = ln.Close()
-				return
-			}
-			continue
-		}
-
-		if enableLocket {
-			locketConn, err := locketgo.NewLocketConn(conn, stateDir, "DispatcherClient")
-			if err != nil {
-				golog.Error("client failed to enable Locket")
-				conn.Close()
-				return
-			}
-
-			conn = locketConn
-		}
-
-		go clientHandler(name, conn, proxyURI, options, enableLocket, stateDir)
-	}
-}
-
-func clientHandler(name string, conn net.Conn, proxyURI *url.URL, options string, enableLocket bool, logDir string) {
+func clientHandler(name string, options string, conn net.Conn, runtime *modes.Runtime, logger *log.Logger) {
 	var needOptions = options == ""
 
 	// Read the client's SOCKS handshake.
 	socksReq, err := socks5.Handshake(conn, needOptions)
 	if err != nil {
-		golog.Errorf("%s - client failed socks handshake: %s", name, err)
+		logger.With("error", err).Errorf("client failed socks handshake")
 		conn.Close()
 		return
 	}
-	addrStr := commonLog.ElideAddr(socksReq.Target)
+	logger = logger.With("target", socksReq.Target)
 
-	var dialer proxy.Dialer = proxy.Direct
+	// Without options of its own, the transport uses those sent in the
+	// parameter block.
+	if needOptions {
+		options = socksReq.Options
+	}
 
-	// Deal with arguments.
+	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
+	dialer, proxyErr := modes.ProxyDialer(runtime)
+	if proxyErr != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		logger.With("error", proxyErr).Errorf("failed to obtain proxy dialer")
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+		conn.Close()
+		return
+	}
 
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
+	// Deal with arguments.
+	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, runtime.EnableLocket, runtime.StateDir)
 	if argsToDialerErr != nil {
-		golog.Errorf("Error creating a transport with the provided options: %s", options)
-		golog.Errorf("Error: %s", argsToDialerErr)
+		logger.With("options", options).Errorf("error creating a transport with the provided options: %s", argsToDialerErr)
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
 		conn.Close()
 
 		return
 	}
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	if proxyURI != nil {
-		var proxyErr error
-		dialer, proxyErr = proxy.FromURL(proxyURI, proxy.Direct)
-		if proxyErr != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			golog.Errorf("%s(%s) - failed to obtain proxy dialer: %s", name, addrStr, commonLog.ElideError(err))
-			_ = socksReq.Reply(socks5.ReplyGeneralFailure)
-			conn.Close()
-			return
-		}
-	}
 
-	remote, err2 := transport.Dial()
+	remote, err2 := modes.DialTransport(name, transport, runtime)
 	if err2 != nil {
-		golog.Errorf("%s(%s) - outgoing connection failed: %s", name, addrStr, commonLog.ElideError(err2))
+		logger.With("error", err2).Errorf("outgoing connection failed")
 		_ = socksReq.Reply(socks5.ErrorToReplyCode(err2))
 		conn.Close()
 		return
 	}
+	logger.Debugf("connected to the transport server")
+
 	err = socksReq.Reply(socks5.ReplySucceeded)
 	if err != nil {
-		golog.Errorf("%s(%s) - SOCKS reply failed: %s", name, addrStr, commonLog.ElideError(err))
+		logger.With("error", err).Errorf("SOCKS reply failed")
 		conn.Close()
 		return
 	}
 
-	if err = modes.CopyLoop(conn, remote); err != nil {
-		golog.Warnf("%s(%s) - closed connection: %s", name, addrStr, commonLog.ElideError(err))
-	} else {
-		golog.Infof("%s(%s) - closed connection", name, addrStr)
+	if err = modes.CopyLoop(conn, remote, name, runtime); err != nil {
+		logger.With("error", err).Warnf("closed connection")
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, options string, enableLocket bool) (launched bool) {
-	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options, enableLocket, stateDir)
-		if parseError != nil {
-			return false
-		}
-
-		go func() {
-			for {
-				transportLn, LnError := listen()
-				if LnError != nil {
-					continue
-				}
-				golog.Infof("%s - registered listener: %s", name, commonLog.ElideAddr(bindaddr.Addr.String()))
-				modes.ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler, enableLocket, stateDir)
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					golog.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
-		launched = true
-	}
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, runtime *modes.Runtime) (launched bool) {
+	launched = modes.ServerSetupTCP(ptServerInfo, runtime, serverHandler)
 	fmt.Println("SMETHODS DONE")
 
 	return
 }
 
-func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
-
-	addrStr := commonLog.ElideAddr(remote.RemoteAddr().String())
-	golog.Infof("%s(%s) - new connection", name, addrStr)
-
+func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo, runtime *modes.Runtime, logger *log.Logger) {
 	// Connect to the orport.
-	orConn, err := pt_extras.DialOr(info, remote.RemoteAddr().String(), name)
+	orConn, err := pt_extras.DialOr(info, modes.RemoteAddrString(remote), name, runtime.Timeouts.Dial)
 	if err != nil {
-		golog.Errorf("%s(%s) - failed to connect to ORPort: %s", name, addrStr, commonLog.ElideError(err))
+		logger.With("error", err).Errorf("failed to connect to ORPort")
 		remote.Close()
 
 		return
 	}
 
-	if err = modes.CopyLoop(orConn, remote); err != nil {
-		golog.Warnf("%s(%s) - closed connection: %s", name, addrStr, commonLog.ElideError(err))
-	} else {
-		golog.Infof("%s(%s) - closed connection", name, addrStr)
+	runtime.SetKeepAlive(orConn)
+
+	if err = modes.CopyLoop(orConn, remote, name, runtime); err != nil {
+		logger.With("error", err).Warnf("closed connection")
 	}
 }
@@ -0,0 +1,518 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
+)
+
+// Events holds optional callbacks that are invoked as the dispatcher runs.
+// Callbacks are called from the goroutine handling the listener or connection
+// and must not block.
+type Events struct {
+	// Listening is called every time a listener starts accepting connections,
+	// including when a listener is restarted after a configuration reload.
+	Listening func(transport string, addr net.Addr)
+
+	// ConnectionOpened is called when a new application or transport
+	// connection has been accepted.
+	ConnectionOpened func(transport string, remote net.Addr)
+
+	// ConnectionClosed is called when the handler for an accepted connection
+	// has finished.
+	ConnectionClosed func(transport string, remote net.Addr)
+}
+
+// Listener describes a running listener.
+type Listener struct {
+	Transport string
+	Addr      net.Addr
+
+	closer io.Closer
+}
+
+// Connection describes an accepted connection that is being handled.
+type Connection struct {
+	ID        uint64
+	Transport string
+	Remote    net.Addr
+	Started   time.Time
+
+	// BytesIn and BytesOut count the bytes received from and sent over the
+	// transport.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// connection is the live record behind a Connection.
+type connection struct {
+	id        uint64
+	transport string
+	remote    net.Addr
+	source    string
+	started   time.Time
+	conn      net.Conn
+	logger    *log.Logger
+	bytesIn   int64
+	bytesOut  int64
+
+	// peer is the connection the copy loop relays to. shutdown is set when
+	// the dispatcher closes the connection, and relayed and copyError once the
+	// copy loop has finished. They are guarded by the runtime lock.
+	peer      net.Conn
+	shutdown  bool
+	relayed   bool
+	copyError error
+}
+
+// Runtime holds the configuration and state shared by the listeners and
+// connection handlers of one running dispatcher.
+type Runtime struct {
+	Options      *Options
+	ProxyURI     *url.URL
+	EnableLocket bool
+	StateDir     string
+	Events       Events
+
+	// Accounting, if set, gets a record of every accepted connection when it
+	// ends.
+	Accounting *AccountingLog
+
+	// Mode is the proxy mode, used to label the metrics.
+	Mode string
+
+	// Limits restricts the connections accepted by the listeners.
+	Limits Limits
+
+	// Shaping limits the bandwidth used by the connections.
+	Shaping Shaping
+
+	// Timeouts bound the dials, the transport handshakes and the idle
+	// connections.
+	Timeouts Timeouts
+
+	// KeepAlive detects dead peers on long lived connections.
+	KeepAlive KeepAlive
+
+	// Reject, if set, is called to refuse a connection over the limits in
+	// the protocol of the proxy mode, before the connection is closed.
+	Reject func(conn net.Conn) error
+
+	lock        sync.Mutex
+	listeners   []Listener
+	setupErrors []string
+	connections map[uint64]*connection
+	byConn      map[net.Conn]*connection
+	sources     map[string]int
+	flows       map[string]string
+	reserved    map[string]string
+	lastID      uint64
+	idle        chan struct{}
+	done        chan struct{}
+	closed      bool
+
+	listenerOptions   map[string]*Options
+	acceptBucket      *tokenBucket
+	limiters          *shapingLimiters
+	rejected          int
+	lastRejectWarning time.Time
+}
+
+func NewRuntime(options string) *Runtime {
+	return &Runtime{
+		Options:     NewOptions(options),
+		connections: make(map[uint64]*connection),
+		byConn:      make(map[net.Conn]*connection),
+		sources:     make(map[string]int),
+		flows:       make(map[string]string),
+		reserved:    make(map[string]string),
+		done:        make(chan struct{}),
+	}
+}
+
+// Listeners returns the listeners that are currently running.
+func (runtime *Runtime) Listeners() []Listener {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	return append([]Listener(nil), runtime.listeners...)
+}
+
+// Connections returns the accepted connections that are still being handled,
+// oldest first.
+func (runtime *Runtime) Connections() []Connection {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	result := make([]Connection, 0, len(runtime.connections))
+	for _, record := range runtime.connections {
+		result = append(result, Connection{
+			ID:        record.id,
+			Transport: record.transport,
+			Remote:    record.remote,
+			Started:   record.started,
+			BytesIn:   atomic.LoadInt64(&record.bytesIn),
+			BytesOut:  atomic.LoadInt64(&record.bytesOut),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result
+}
+
+// CloseConnection closes the accepted connection with the given ID, which
+// ends its handler.
+func (runtime *Runtime) CloseConnection(id uint64) error {
+	runtime.lock.Lock()
+	record, ok := runtime.connections[id]
+	var peer net.Conn
+	if ok {
+		record.shutdown = true
+		peer = record.peer
+	}
+	runtime.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("there is no connection %d", id)
+	}
+
+	// The copy loop only ends once both of its directions have, so the
+	// connection it relays to is closed too.
+	if peer != nil {
+		_ = peer.Close()
+	}
+
+	return record.conn.Close()
+}
+
+// drainCloseWait is how long Drain waits for the handlers of the connections
+// it closed to finish. A handler blocked on something other than its
+// connection would otherwise keep Drain from returning.
+var drainCloseWait = 5 * time.Second
+
+// Drain stops every listener, then waits for the connections that are still
+// being handled to finish. Connections still open after the timeout are
+// closed.
+func (runtime *Runtime) Drain(timeout time.Duration) {
+	_ = runtime.Close()
+
+	runtime.lock.Lock()
+	if len(runtime.connections) == 0 {
+		runtime.lock.Unlock()
+		return
+	}
+	if runtime.idle == nil {
+		runtime.idle = make(chan struct{})
+	}
+	idle := runtime.idle
+	runtime.lock.Unlock()
+
+	select {
+	case <-idle:
+	case <-time.After(timeout):
+		for _, open := range runtime.Connections() {
+			_ = runtime.CloseConnection(open.ID)
+		}
+
+		select {
+		case <-idle:
+		case <-time.After(drainCloseWait):
+			log.Warnf("%d connections were still being handled after the drain", len(runtime.Connections()))
+		}
+	}
+}
+
+// Done returns a channel that is closed when the runtime is closed.
+func (runtime *Runtime) Done() <-chan struct{} {
+	return runtime.done
+}
+
+// Closed reports whether Close has been called.
+func (runtime *Runtime) Closed() bool {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	return runtime.closed
+}
+
+// Close stops every listener. Connections that are already established are
+// left running until either side closes them.
+func (runtime *Runtime) Close() error {
+	runtime.lock.Lock()
+	if runtime.closed {
+		runtime.lock.Unlock()
+		return nil
+	}
+	runtime.closed = true
+	listeners := runtime.listeners
+	runtime.listeners = nil
+	close(runtime.done)
+	runtime.lock.Unlock()
+
+	var closeError error
+	for _, listener := range listeners {
+		if err := listener.closer.Close(); err != nil && closeError == nil {
+			closeError = err
+		}
+	}
+
+	return closeError
+}
+
+// SetupErrors returns the reasons listeners failed to start.
+func (runtime *Runtime) SetupErrors() []string {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	return append([]string(nil), runtime.setupErrors...)
+}
+
+// setupFailed logs and records why a listener could not be started.
+func (runtime *Runtime) setupFailed(transport string, err error) {
+	log.With("transport", transport, "mode", runtime.Mode, "error", err).Errorf("failed to start listener")
+
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	runtime.setupErrors = append(runtime.setupErrors, transport+": "+log.ElideError(err))
+}
+
+// addListener records a running listener. It returns false, after closing
+// the listener, if the runtime has already been closed.
+func (runtime *Runtime) addListener(transport string, addr net.Addr, closer io.Closer) bool {
+	runtime.lock.Lock()
+	if runtime.closed {
+		runtime.lock.Unlock()
+		_ = closer.Close()
+		return false
+	}
+	runtime.listeners = append(runtime.listeners, Listener{Transport: transport, Addr: addr, closer: closer})
+	runtime.lock.Unlock()
+
+	if runtime.Events.Listening != nil {
+		runtime.Events.Listening(transport, addr)
+	}
+
+	return true
+}
+
+func (runtime *Runtime) removeListener(closer io.Closer) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	for index, listener := range runtime.listeners {
+		if listener.closer == closer {
+			runtime.listeners = append(runtime.listeners[:index], runtime.listeners[index+1:]...)
+			return
+		}
+	}
+}
+
+// addConnection records an accepted connection. If the connection is over
+// the limits, it returns nil and the reason. A connection admitted by its
+// listener takes over the slot reserved for it. Without one it already has
+// its rate token, which is returned if it is rejected.
+func (runtime *Runtime) addConnection(transport string, conn net.Conn, admitted bool) (*connection, string) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	remote := conn.RemoteAddr()
+	source := runtime.Limits.sourceKey(remote)
+	if reservedSource, ok := runtime.reservation(remote); admitted && ok {
+		delete(runtime.reserved, remote.String())
+		source = reservedSource
+	} else if reason := runtime.overLimit(source, !admitted); reason != "" {
+		if admitted {
+			runtime.refundToken()
+		}
+		return nil, reason
+	} else if source != "" {
+		runtime.sources[source]++
+	}
+
+	runtime.lastID++
+	record := &connection{id: runtime.lastID, transport: transport, remote: remote, source: source, started: time.Now(), conn: conn}
+	record.logger = runtime.connectionLogger(record.id, transport, record.remote)
+	runtime.connections[record.id] = record
+	runtime.byConn[conn] = record
+
+	return record, ""
+}
+
+func (runtime *Runtime) removeConnection(record *connection) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	delete(runtime.connections, record.id)
+	delete(runtime.byConn, record.conn)
+	runtime.releaseSource(record.source)
+	if len(runtime.connections) == 0 && runtime.idle != nil {
+		close(runtime.idle)
+		runtime.idle = nil
+	}
+}
+
+// connectionLogger returns a logger that adds the connection ID, transport,
+// mode and remote address to every line about a connection.
+func (runtime *Runtime) connectionLogger(id uint64, transport string, remote net.Addr) *log.Logger {
+	return log.With("conn", id, "transport", transport, "mode", runtime.Mode, "remote", remote)
+}
+
+// flowLogger returns a logger for the transport connection opened for a UDP
+// flow, with its own connection ID.
+func (runtime *Runtime) flowLogger(transport string, remote string) *log.Logger {
+	runtime.lock.Lock()
+	runtime.lastID++
+	id := runtime.lastID
+	runtime.lock.Unlock()
+
+	return log.With("conn", id, "transport", transport, "mode", runtime.Mode, "remote", remote)
+}
+
+// trackedConnection returns the record of whichever of the connections was
+// accepted, or nil if neither was.
+func (runtime *Runtime) trackedConnection(conns ...net.Conn) *connection {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	for _, conn := range conns {
+		if record, ok := runtime.byConn[conn]; ok {
+			return record
+		}
+	}
+
+	return nil
+}
+
+// copyStarted records the connection the copy loop of a connection relays
+// to, so that closing the connection ends the copy loop. It is closed at once
+// if the connection has already been closed.
+func (runtime *Runtime) copyStarted(record *connection, conns ...net.Conn) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	for _, conn := range conns {
+		if conn != record.conn {
+			record.peer = conn
+		}
+	}
+
+	if record.shutdown && record.peer != nil {
+		_ = record.peer.Close()
+	}
+}
+
+// copyFinished records how the copy loop of a connection ended.
+func (runtime *Runtime) copyFinished(record *connection, copyError error) {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	record.relayed = true
+	record.copyError = copyError
+}
+
+// connectionEnded logs the end of a connection and writes its accounting
+// record.
+func (runtime *Runtime) connectionEnded(record *connection) {
+	ended := time.Now()
+	bytesIn := atomic.LoadInt64(&record.bytesIn)
+	bytesOut := atomic.LoadInt64(&record.bytesOut)
+
+	runtime.lock.Lock()
+	reason := closeReason(record.shutdown, record.relayed, record.copyError)
+	runtime.lock.Unlock()
+
+	record.logger.With(
+		"duration", ended.Sub(record.started).Round(time.Millisecond),
+		"bytesIn", bytesIn,
+		"bytesOut", bytesOut,
+		"reason", reason,
+	).Infof("connection closed")
+
+	if runtime.Accounting == nil {
+		return
+	}
+
+	remote := ""
+	if record.remote != nil {
+		remote = log.ElideAddr(record.remote.String())
+	}
+
+	runtime.Accounting.write(AccountingRecord{
+		ID:          record.id,
+		Transport:   record.transport,
+		Mode:        runtime.Mode,
+		Remote:      remote,
+		Start:       record.started,
+		End:         ended,
+		Duration:    ended.Sub(record.started).Seconds(),
+		BytesIn:     bytesIn,
+		BytesOut:    bytesOut,
+		CloseReason: reason,
+	})
+}
+
+// handleConnection runs handler for an accepted connection, reporting the
+// connection to the event callbacks and keeping track of it while it is
+// handled. Connections over the limits are rejected instead. admitted tells
+// that the listener has already checked the connection against the limits.
+func (runtime *Runtime) handleConnection(transport string, conn net.Conn, admitted bool, handler func(logger *log.Logger)) {
+	record, reason := runtime.addConnection(transport, conn, admitted)
+	if record == nil {
+		runtime.reject(transport, conn, reason)
+		return
+	}
+	defer runtime.removeConnection(record)
+
+	record.logger.Infof("new connection")
+	defer runtime.connectionEnded(record)
+
+	remote := record.remote
+	if runtime.Events.ConnectionOpened != nil {
+		runtime.Events.ConnectionOpened(transport, remote)
+	}
+
+	metrics.ConnectionsAccepted.With(transport, runtime.Mode).Inc()
+	active := metrics.ConnectionsActive.With(transport, runtime.Mode)
+	active.Inc()
+
+	handler(record.logger)
+
+	active.Dec()
+
+	if runtime.Events.ConnectionClosed != nil {
+		runtime.Events.ConnectionClosed(transport, remote)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// TestDrainStuckHandler tests that Drain returns when the handler of a
+// connection it closed doesn't finish.
+func TestDrainStuckHandler(t *testing.T) {
+	closeWait := drainCloseWait
+	drainCloseWait = 100 * time.Millisecond
+	defer func() { drainCloseWait = closeWait }()
+
+	runtime := NewRuntime("")
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	handling := make(chan struct{})
+	go runtime.handleConnection("plain", server, false, func(_ *log.Logger) {
+		close(handling)
+		<-stuck
+	})
+	<-handling
+
+	drained := make(chan struct{})
+	go func() {
+		runtime.Drain(50 * time.Millisecond)
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Drain to return while the handler is stuck")
+	}
+}
@@ -0,0 +1,190 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shapingChunk is the most that is written at once through a rate limiter,
+// so that large writes are spread out instead of sent in bursts.
+const shapingChunk = 16 * 1024
+
+// Bandwidth is a rate in bytes per second in each direction. Upload is the
+// data sent over the transport and Download the data received from it. Zero
+// is unlimited.
+type Bandwidth struct {
+	Upload   int64
+	Download int64
+}
+
+// Shaping limits the bandwidth used by the connections copied through
+// CopyLoop. Every limit applies at the same time: a connection is limited by
+// its own rate, by the rate shared by the connections of its transport and by
+// the rate shared by every connection.
+type Shaping struct {
+	Global Bandwidth
+
+	// PerTransport is keyed by the lower case transport name.
+	PerTransport map[string]Bandwidth
+
+	PerConnection Bandwidth
+}
+
+// rateLimiter is a token bucket of bytes that can be shared by several
+// connections.
+type rateLimiter struct {
+	lock   sync.Mutex
+	bucket *tokenBucket
+}
+
+// newRateLimiter returns a limiter for rate bytes per second, or nil for an
+// unlimited rate. Up to a second of data can be sent at once.
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := int(rate)
+	if burst < shapingChunk {
+		burst = shapingChunk
+	}
+
+	return &rateLimiter{bucket: newTokenBucket(float64(rate), burst)}
+}
+
+// wait blocks until n bytes can be sent.
+func (limiter *rateLimiter) wait(n int) {
+	limiter.lock.Lock()
+	delay := limiter.bucket.reserve(float64(n))
+	limiter.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// shapingLimiters holds the limiters shared between connections.
+type shapingLimiters struct {
+	global [2]*rateLimiter
+
+	// transport is keyed by the lower case transport name, like
+	// Shaping.PerTransport.
+	transport map[string][2]*rateLimiter
+}
+
+// Indexes of the limiters for each direction.
+const (
+	upload   = 0
+	download = 1
+)
+
+// connectionLimiters returns the limiters that apply to a new connection of
+// the transport, for uploads and for downloads.
+func (runtime *Runtime) connectionLimiters(transport string) (uploadLimiters []*rateLimiter, downloadLimiters []*rateLimiter) {
+	shaping := runtime.Shaping
+
+	runtime.lock.Lock()
+	if runtime.limiters == nil {
+		runtime.limiters = &shapingLimiters{
+			global:    [2]*rateLimiter{newRateLimiter(shaping.Global.Upload), newRateLimiter(shaping.Global.Download)},
+			transport: make(map[string][2]*rateLimiter),
+		}
+	}
+	limiters := runtime.limiters
+
+	name := strings.ToLower(transport)
+	transportLimiters, ok := limiters.transport[name]
+	if !ok {
+		rate := shaping.PerTransport[name]
+		transportLimiters = [2]*rateLimiter{newRateLimiter(rate.Upload), newRateLimiter(rate.Download)}
+		limiters.transport[name] = transportLimiters
+	}
+	runtime.lock.Unlock()
+
+	uploadLimiters = present(limiters.global[upload], transportLimiters[upload], newRateLimiter(shaping.PerConnection.Upload))
+	downloadLimiters = present(limiters.global[download], transportLimiters[download], newRateLimiter(shaping.PerConnection.Download))
+
+	return uploadLimiters, downloadLimiters
+}
+
+// present returns the limiters that are not nil.
+func present(limiters ...*rateLimiter) []*rateLimiter {
+	var result []*rateLimiter
+	for _, limiter := range limiters {
+		if limiter != nil {
+			result = append(result, limiter)
+		}
+	}
+
+	return result
+}
+
+// shapedWriter writes no faster than every one of its limiters allows. The
+// idle watchdog is paused while it waits, so that a connection held back by
+// its rate is not closed as idle.
+type shapedWriter struct {
+	writer   io.Writer
+	limiters []*rateLimiter
+	idle     *Watchdog
+}
+
+// shape returns writer limited by the limiters, or writer itself if there
+// are none.
+func shape(writer io.Writer, limiters []*rateLimiter, idle *Watchdog) io.Writer {
+	if len(limiters) == 0 {
+		return writer
+	}
+
+	return shapedWriter{writer, limiters, idle}
+}
+
+func (writer shapedWriter) Write(buffer []byte) (int, error) {
+	total := 0
+	for len(buffer) > 0 {
+		chunk := buffer
+		if len(chunk) > shapingChunk {
+			chunk = chunk[:shapingChunk]
+		}
+
+		writer.idle.Pause()
+		for _, limiter := range writer.limiters {
+			limiter.wait(len(chunk))
+		}
+		writer.idle.Resume()
+
+		written, err := writer.writer.Write(chunk)
+		total += written
+		if err != nil {
+			return total, err
+		}
+		buffer = buffer[written:]
+	}
+
+	return total, nil
+}
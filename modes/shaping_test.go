@@ -0,0 +1,132 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestConnectionLimiters checks which limiters a connection gets, and that
+// only the global and per-transport ones are shared between connections.
+func TestConnectionLimiters(t *testing.T) {
+	runtime := NewRuntime("")
+	runtime.Shaping = Shaping{
+		Global:        Bandwidth{Upload: 1024 * 1024},
+		PerTransport:  map[string]Bandwidth{"shadow": {Download: 1024 * 1024}},
+		PerConnection: Bandwidth{Upload: 2 * 1024 * 1024},
+	}
+
+	firstUpload, firstDownload := runtime.connectionLimiters("shadow")
+	secondUpload, secondDownload := runtime.connectionLimiters("Shadow")
+
+	if len(firstUpload) != 2 || len(firstDownload) != 1 {
+		t.Fatalf("expected 2 upload limiters and 1 download limiter, got %d and %d", len(firstUpload), len(firstDownload))
+	}
+	if firstUpload[0] != secondUpload[0] {
+		t.Error("expected the connections to share the global limiter")
+	}
+	if firstUpload[1] == secondUpload[1] {
+		t.Error("expected each connection to get its own per-connection limiter")
+	}
+	if firstDownload[0] != secondDownload[0] {
+		t.Error("expected the transport names to be matched without regard to case")
+	}
+
+	if _, download := runtime.connectionLimiters("Replicant"); len(download) != 0 {
+		t.Errorf("expected no download limit for a transport without one, got %d limiters", len(download))
+	}
+}
+
+// TestShapedWriter checks that a shaped writer sends its burst at once, waits
+// for the rest, and never writes more than a chunk at a time.
+func TestShapedWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	if shape(&buffer, nil, nil) != &buffer {
+		t.Error("expected a writer without limiters to be left as it is")
+	}
+
+	const rate = 64 * 1024
+	recorder := &chunkRecorder{}
+	writer := shape(recorder, []*rateLimiter{newRateLimiter(rate)}, nil)
+
+	started := time.Now()
+	written, err := writer.Write(make([]byte, rate+rate/2))
+	elapsed := time.Since(started)
+
+	if err != nil || written != rate+rate/2 {
+		t.Fatalf("expected %d bytes written, got %d and %v", rate+rate/2, written, err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected the half second over the burst to be waited for, took %s", elapsed)
+	}
+	if recorder.largest > shapingChunk {
+		t.Errorf("expected writes of at most %d bytes, got %d", shapingChunk, recorder.largest)
+	}
+}
+
+// chunkRecorder records the largest write it is given.
+type chunkRecorder struct {
+	largest int
+}
+
+func (recorder *chunkRecorder) Write(buffer []byte) (int, error) {
+	if len(buffer) > recorder.largest {
+		recorder.largest = len(buffer)
+	}
+
+	return len(buffer), nil
+}
+
+// TestShapedWriterIdle checks that a write held back by its rate limit is not
+// closed by the idle watchdog, which runs again once the write is done.
+func TestShapedWriterIdle(t *testing.T) {
+	limiter := &rateLimiter{bucket: newTokenBucket(1000, 100)}
+	closer := &countingCloser{}
+	idle := newWatchdog(100*time.Millisecond, closer)
+	idle.Reset()
+	defer idle.Stop()
+
+	// The 400 bytes take 300ms more than the burst allows.
+	writer := shape(watch(io.Discard, idle, nil), []*rateLimiter{limiter}, idle)
+	started := time.Now()
+	if _, err := writer.Write(make([]byte, 400)); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Errorf("expected the write to wait for the rate limit, took %s", elapsed)
+	}
+	if idle.Fired() {
+		t.Error("expected the idle watchdog not to fire while the write waited for the rate limit")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if !idle.Fired() {
+		t.Error("expected the idle watchdog to run again after the write")
+	}
+}
@@ -30,143 +30,163 @@
 package stun_udp
 
 import (
-	"fmt"
 	"io"
-	golog "log"
 	"net"
-	"net/url"
-
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	common "github.com/willscott/goturn/common"
-
-	"github.com/willscott/goturn"
+	"time"
 
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/willscott/goturn"
+	common "github.com/willscott/goturn/common"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string) bool {
-	return modes.ClientSetupUDP(socksAddr, ptClientProxy, names, options, clientHandler)
+func ClientSetup(socksAddr string, names []string, runtime *modes.Runtime) bool {
+	return modes.ClientSetupUDP(socksAddr, names, runtime, clientHandler)
 }
 
-func clientHandler(name string, options string, conn *net.UDPConn, proxyURI *url.URL) {
+func clientHandler(name string, conn *net.UDPConn, runtime *modes.Runtime) {
 
 	//defers are never called due to infinite loop
 
-	fmt.Println("@@@ handling...")
-
-	tracker := make(modes.ConnTracker)
+	logger := log.With("transport", name, "mode", runtime.Mode)
 
-	fmt.Println("Transport is", name)
+	tracker := modes.NewConnTracker(runtime)
 
 	buf := make([]byte, 1024)
 
+	forwarded := metrics.UDPPacketsForwarded.With(name, runtime.Mode)
+
+	idleTimeout := runtime.Timeouts.Idle
+	lastSweep := time.Now()
+
 	// Receive UDP packets and forward them over transport connections forever
 	for {
-		numBytes, addr, err := conn.ReadFromUDP(buf)
-		fmt.Println("Received ", string(buf[0:numBytes]), " from ", addr)
+		if idleTimeout > 0 {
+			if time.Since(lastSweep) >= idleTimeout/2 {
+				tracker.CloseIdle(idleTimeout, logger)
+				lastSweep = time.Now()
+			}
 
+			// Wake up to close the idle flows even when no packets arrive.
+			_ = conn.SetReadDeadline(time.Now().Add(idleTimeout / 2))
+		}
+
+		numBytes, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Println("Error: ", err)
+			if runtime.Closed() {
+				return
+			}
+
+			if netError, ok := err.(net.Error); ok && netError.Timeout() {
+				continue
+			}
+
+			logger.With("error", err).Warnf("failed to read a UDP packet")
+			continue
 		}
 
 		goodBytes := buf[:numBytes]
 
-		fmt.Println(tracker)
-
-		if state, ok := tracker[addr.String()]; ok {
+		if state, ok := tracker.Get(addr.String()); ok {
 			// There is an open transport connection, or a connection attempt is in progress.
 
 			if state.Waiting {
 				// The connection attempt is in progress.
 				// Drop the packet.
-				fmt.Println("recv: waiting")
+				metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropWaiting).Inc()
 			} else {
 				// There is an open transport connection.
 				// Send the packet through the transport.
-				fmt.Println("recv: write")
 				//ignoring failed writes because packets can be dropped
-				_, _ = state.Conn.Write(goodBytes)
+				if _, writeError := state.Conn.Write(goodBytes); writeError != nil {
+					metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropError).Inc()
+				} else {
+					forwarded.Inc()
+					state.LastActive = time.Now()
+					tracker.Set(addr.String(), state)
+				}
 			}
 		} else {
 			// There is not an open transport connection and a connection attempt is not in progress.
-			// Open a transport connection.
-
-			fmt.Println("Opening connection to ")
-
-			modes.OpenConnection(&tracker, addr.String(), name, options, proxyURI, false, "")
-
-			// Drop the packet.
-			fmt.Println("recv: Open")
+			// Open a transport connection, unless the flow is over the
+			// connection limits, and drop the packet.
+			if modes.OpenConnection(tracker, addr, name, runtime.Options.Get(), runtime, nil) {
+				metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropConnecting).Inc()
+			} else {
+				metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropRejected).Inc()
+			}
 		}
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, options string) (launched bool) {
-	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, runtime *modes.Runtime) (launched bool) {
+	return modes.ServerSetupUDP(ptServerInfo, runtime, serverHandler)
 }
 
-func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo, runtime *modes.Runtime, logger *log.Logger) {
 	var header *common.Message
 
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	fmt.Println("### handling", name)
-	log.Infof("%s(%s) - new connection", name, addrStr)
+	defer remote.Close()
 
 	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
 	if err != nil {
-		_ = remote.Close()
-
-		golog.Fatal(err)
+		logger.With("error", err).Errorf("failed to resolve the target")
+		return
 	}
 
 	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
 	if err != nil {
-		_ = remote.Close()
-		golog.Fatal(err)
+		logger.With("error", err).Errorf("failed to resolve the local address")
+		return
 	}
 
 	dest, err := net.DialUDP("udp", localAddr, serverAddr)
 	if err != nil {
-		_ = remote.Close()
-		golog.Fatal(err)
+		logger.With("error", err).Errorf("failed to connect to the target")
+		return
 	}
+	defer dest.Close()
 
-	fmt.Println("pumping")
+	idle := runtime.IdleWatchdog(remote, dest)
+	defer idle.Stop()
 
 	headerBuffer := make([]byte, 20)
+	forwarded := metrics.UDPPacketsForwarded.With(name, runtime.Mode)
 
 	for {
-		fmt.Println("reading...")
 		// Read the incoming connection into the buffer.
 		_, err := io.ReadFull(remote, headerBuffer)
 		if err != nil {
-			fmt.Println("read error")
+			if idle.Fired() {
+				logger.Debugf("closing idle UDP flow")
+			} else {
+				logger.With("error", err).Debugf("read error")
+			}
 			break
 		}
 
 		header, err = goturn.ParseStun(headerBuffer)
 		if err != nil {
-			fmt.Println("parse error")
+			logger.With("error", err).Errorf("failed to parse a STUN header")
 			break
 		}
 
-		fmt.Println(header.Length)
-
-		fmt.Println("reading data")
-
 		readBuffer := make([]byte, header.Length)
 		_, err = io.ReadFull(remote, readBuffer)
 		if err != nil {
-			fmt.Println("read error")
+			logger.With("error", err).Debugf("read error")
 			break
 		}
 
 		writeBuffer := append(headerBuffer, readBuffer...)
 
-		_, _ = dest.Write(writeBuffer)
+		if _, writeError := dest.Write(writeBuffer); writeError != nil {
+			metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropError).Inc()
+		} else {
+			forwarded.Inc()
+		}
+		idle.Reset()
 	}
-
-	_ = dest.Close()
-	_ = remote.Close()
 }
@@ -26,53 +26,64 @@ package modes
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"net"
-	"net/url"
-	"os"
+	"sync/atomic"
 
 	locketgo "github.com/OperatorFoundation/locket-go"
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/kataras/golog"
 )
 
-func ClientSetupTCP(socksAddr string, ptClientProxy *url.URL, names []string, options string, clientHandler ClientHandlerTCP, enableLocket bool, stateDir string) (launched bool) {
+func ClientSetupTCP(socksAddr string, names []string, runtime *Runtime, clientHandler ClientHandlerTCP) (launched bool) {
 	// Launch each of the client listeners.
 	for _, name := range names {
 		ln, err := net.Listen("tcp", socksAddr)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to listen %s %s", name, err.Error())
-			golog.Errorf("failed to listen %s %s", name, err.Error())
+			runtime.setupFailed(name, err)
 			continue
 		}
 
-		go clientAcceptLoop(name, options, ln, ptClientProxy, clientHandler, enableLocket, stateDir)
-		golog.Infof("%s - registered listener: %s", name, ln.Addr())
+		if !runtime.addListener(name, ln.Addr(), ln) {
+			return false
+		}
+
+		go ClientAcceptLoop(name, ln, runtime, clientHandler)
+		log.With("transport", name, "mode", runtime.Mode, "addr", ln.Addr()).Infof("registered listener")
 		launched = true
 	}
 
 	return
 }
 
-func clientAcceptLoop(name string, options string, ln net.Listener, proxyURI *url.URL, clientHandler ClientHandlerTCP, enableLocket bool, stateDir string) {
+// ClientAcceptLoop accepts application connections on ln and hands each of
+// them to clientHandler together with the transport options current at the
+// time the connection was accepted.
+func ClientAcceptLoop(name string, ln net.Listener, runtime *Runtime, clientHandler ClientHandlerTCP) {
+	defer runtime.removeListener(ln)
+
+	logger := log.With("transport", name, "mode", runtime.Mode)
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				fmt.Fprintf(os.Stderr, "Fatal listener error: %s", err.Error())
-				golog.Errorf("Fatal listener error: %s", err.Error())
+				if !runtime.Closed() {
+					logger.With("error", err).Errorf("fatal listener error")
+				}
 				return
 			}
-			golog.Warnf("Failed to accept connection: %s", err.Error())
+			logger.With("error", err).Warnf("failed to accept connection")
 			continue
 		}
 
-		if enableLocket {
-			locketConn, err := locketgo.NewLocketConn(conn, stateDir, "DispatcherClient")
+		runtime.SetKeepAlive(conn)
+
+		if runtime.EnableLocket {
+			locketConn, err := locketgo.NewLocketConn(conn, runtime.StateDir, "DispatcherClient")
 			if err != nil {
-				golog.Error("client failed to enable Locket")
+				logger.With("error", err).Errorf("client failed to enable Locket")
 				conn.Close()
 				return
 			}
@@ -80,71 +91,166 @@ func clientAcceptLoop(name string, options string, ln net.Listener, proxyURI *ur
 			conn = locketConn
 		}
 
-		go clientHandler(name, options, conn, proxyURI, enableLocket, stateDir)
+		options := runtime.Options.Get()
+		go runtime.handleConnection(name, conn, false, func(connLogger *log.Logger) {
+			clientHandler(name, options, conn, runtime, connLogger)
+		})
 	}
 }
 
-func ServerSetupTCP(ptServerInfo pt_extras.ServerInfo, stateDir string, options string, serverHandler ServerHandler, enableLocket bool) (launched bool) {
+func ServerSetupTCP(ptServerInfo pt_extras.ServerInfo, runtime *Runtime, serverHandler ServerHandler) (launched bool) {
+	return ServerSetup(ptServerInfo, runtime, serverHandler, runtime.EnableLocket)
+}
+
+// ServerSetup starts a transport listener for each of the bindaddrs and
+// serves it until the runtime is closed. The listeners are restarted with the
+// current transport options every time the configuration is reloaded.
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, runtime *Runtime, serverHandler ServerHandler, enableLocket bool) (launched bool) {
 	// Launch each of the server listeners.
 	for _, bindaddr := range ptServerInfo.Bindaddrs {
 		name := bindaddr.MethodName
 
 		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options, enableLocket, stateDir)
+		current, changed := runtime.ListenerOptions(bindaddr).Watch()
+		listen, parseError := runtime.serverListener(name, current, enableLocket, bindaddr.Addr.String())
 		if parseError != nil {
+			runtime.setupFailed(name, parseError)
 			return false
 		}
 
-		go func() {
-			for {
-				transportLn, LnError := listen()
-				if LnError != nil {
-					print(LnError)
-					break
-				}
+		transportLn, LnError := listen()
+		if LnError != nil {
+			runtime.setupFailed(name, LnError)
+			continue
+		}
+
+		if !registerListener(name, bindaddr, transportLn, runtime) {
+			return false
+		}
+
+		go serveTransport(name, bindaddr, restartAddr(bindaddr, transportLn), transportLn, changed, &ptServerInfo, serverHandler, runtime, enableLocket)
 
-				print(name)
-				print(" listening on ")
-				println(bindaddr.Addr.String())
+		launched = true
+	}
 
-				golog.Infof("%s - registered listener: %s", name, commonLog.ElideAddr(bindaddr.Addr.String()))
+	return
+}
 
-				ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler, enableLocket, stateDir)
+// restartAddr is the address a listener is restarted on. A bindaddr with port
+// 0 keeps the port it was first given, so that the clients can still reach it.
+func restartAddr(bindaddr pt_extras.Bindaddr, transportLn net.Listener) string {
+	if addr, ok := transportLn.Addr().(*net.TCPAddr); ok && bindaddr.Addr.Port == 0 && addr.Port != 0 {
+		return (&net.TCPAddr{IP: bindaddr.Addr.IP, Port: addr.Port}).String()
+	}
 
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					fmt.Fprintf(os.Stderr, "Listener close error: %s", transportLnErr.Error())
-					golog.Errorf("Listener close error: %s", transportLnErr.Error())
+	return bindaddr.Addr.String()
+}
+
+func serveTransport(name string, bindaddr pt_extras.Bindaddr, listenAddr string, transportLn net.Listener, changed <-chan struct{}, info *pt_extras.ServerInfo, serverHandler ServerHandler, runtime *Runtime, enableLocket bool) {
+	logger := log.With("transport", name, "mode", runtime.Mode, "addr", bindaddr.Addr)
+
+	for {
+		stop := closeOnChange(transportLn, changed, runtime.Done())
+		ServerAcceptLoop(name, transportLn, info, serverHandler, runtime, enableLocket)
+		stop()
+		runtime.removeListener(transportLn)
+
+		transportLnErr := transportLn.Close()
+		if transportLnErr != nil && !errors.Is(transportLnErr, net.ErrClosed) {
+			logger.With("error", transportLnErr).Errorf("listener close error")
+		}
+
+		// The listener is rebuilt from the current options, which may have
+		// been replaced by a configuration reload.
+		for {
+			if runtime.Closed() {
+				return
+			}
+
+			var current string
+			current, changed = runtime.ListenerOptions(bindaddr).Watch()
+			listen, parseError := runtime.serverListener(name, current, enableLocket, listenAddr)
+			if parseError == nil {
+				var LnError error
+				transportLn, LnError = listen()
+				if LnError == nil {
+					break
 				}
+				parseError = LnError
 			}
-		}()
 
-		launched = true
+			logger.With("error", parseError).Errorf("failed to start listener, waiting for a configuration reload")
+			select {
+			case <-changed:
+			case <-runtime.Done():
+				return
+			}
+		}
+
+		metrics.ListenerRestarts.With(name, runtime.Mode).Inc()
+
+		if !registerListener(name, bindaddr, transportLn, runtime) {
+			return
+		}
 	}
+}
 
-	return
+// registerListener announces a transport listener and records it in the
+// runtime. It returns false if the runtime has already been closed.
+func registerListener(name string, bindaddr pt_extras.Bindaddr, transportLn net.Listener, runtime *Runtime) bool {
+	addr := listenerAddr(transportLn, bindaddr)
+	log.With("transport", name, "mode", runtime.Mode, "addr", addr).Infof("registered listener")
+
+	return runtime.addListener(name, addr, transportLn)
 }
 
-func CopyLoop(client net.Conn, server net.Conn) error {
+// listenerAddr returns the address a transport listener is bound to, which
+// has the real port when the bindaddr asked for port 0. Listeners that do not
+// report a TCP address fall back to the bindaddr.
+func listenerAddr(ln net.Listener, bindaddr pt_extras.Bindaddr) net.Addr {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		return addr
+	}
+
+	return bindaddr.Addr
+}
+
+// CopyLoop copies data both ways between the application or target
+// connection and the transport connection until both directions are closed,
+// counting the bytes in the metrics of the transport.
+func CopyLoop(client net.Conn, server net.Conn, name string, runtime *Runtime) error {
 	if server == nil {
-		println("--> Copy loop has a nil server connection.")
-		fmt.Fprintln(os.Stderr, "--> Copy loop has a nil server connection (b).")
 		return errors.New("copy loop has a nil connection (b)")
 	}
 
 	if client == nil {
-		println("--> Copy loop has a nil client connection.")
-		fmt.Fprintln(os.Stderr, "--> Copy loop has a nil connection (a).")
 		return errors.New("copy loop has a nil connection (a)")
 	}
 
 	// Note: b is always the pt connection.  a is the SOCKS/ORPort connection.
 	okToCloseClientChannel := make(chan bool)
 	okToCloseServerChannel := make(chan bool)
-	copyErrorChannel := make(chan error)
+	copyErrorChannel := make(chan error, 2)
+
+	logger := log.With("transport", name, "mode", runtime.Mode)
+	uploadLimiters, downloadLimiters := runtime.connectionLimiters(name)
+	idle := runtime.IdleWatchdog(client, server)
+	uploadStalled := newWatchdog(runtime.Timeouts.Write, client, server)
+	downloadStalled := newWatchdog(runtime.Timeouts.Write, client, server)
+	// The watchdogs are inside the shapers, so that the write timeout only
+	// covers the writes and not the waits for the rate limits.
+	sent := countingWriter{shape(watch(server, idle, uploadStalled), uploadLimiters, idle), metrics.Bytes.With(name, runtime.Mode, metrics.DirectionOut), nil}
+	received := countingWriter{shape(watch(client, idle, downloadStalled), downloadLimiters, idle), metrics.Bytes.With(name, runtime.Mode, metrics.DirectionIn), nil}
+	record := runtime.trackedConnection(client, server)
+	if record != nil {
+		logger = record.logger
+		sent.total = &record.bytesOut
+		received.total = &record.bytesIn
+		runtime.copyStarted(record, client, server)
+	}
 
-	go CopyClientToServer(client, server, okToCloseClientChannel, copyErrorChannel)
-	go CopyServerToClient(client, server, okToCloseServerChannel, copyErrorChannel)
+	go CopyClientToServer(client, sent, okToCloseClientChannel, copyErrorChannel)
+	go CopyServerToClient(received, server, okToCloseServerChannel, copyErrorChannel)
 
 	serverRunning := true
 	clientRunning := true
@@ -156,32 +262,76 @@ func CopyLoop(client net.Conn, server net.Conn) error {
 			clientRunning = false
 		case <-okToCloseServerChannel:
 			serverRunning = false
-		case copyError = <-copyErrorChannel:
-			golog.Errorf("Error while copying", copyError)
+		case err := <-copyErrorChannel:
+			copyError = firstError(copyError, err, logger)
 		}
 	}
 
+	// The errors are sent before the copy finishes, so any that are left are
+	// already in the channel.
+	for len(copyErrorChannel) > 0 {
+		copyError = firstError(copyError, <-copyErrorChannel, logger)
+	}
+
 	client.Close()
 	server.Close()
 
+	idle.Stop()
+	// A connection closed by a watchdog fails with a read or write error on
+	// the closed connection, which does not say why it was closed.
+	if timeoutError := watchdogError(idle, uploadStalled, downloadStalled); timeoutError != nil {
+		copyError = timeoutError
+	}
+
+	if record != nil {
+		runtime.copyFinished(record, copyError)
+	}
+
 	return copyError
 }
 
-func CopyClientToServer(client net.Conn, server net.Conn, okToCloseClient chan bool, errorChannel chan error) {
+// firstError logs a copy error and keeps the first one, which is what ended
+// the connection.
+func firstError(first error, err error, logger *log.Logger) error {
+	logger.With("error", err).Debugf("error while copying")
+	if first != nil {
+		return first
+	}
+
+	return err
+}
+
+func CopyClientToServer(client net.Conn, server io.Writer, okToCloseClient chan bool, errorChannel chan error) {
 	_, copyError := io.Copy(server, client)
-	okToCloseClient <- true
 	if copyError != nil {
-		println("!! CopyClientToServer received an error from io.Copy: ")
-		println(copyError)
 		errorChannel <- copyError
 	}
+	okToCloseClient <- true
 }
 
-func CopyServerToClient(client net.Conn, server net.Conn, okToCloseServer chan bool, errorChannel chan error) {
+func CopyServerToClient(client io.Writer, server net.Conn, okToCloseServer chan bool, errorChannel chan error) {
 	_, copyError := io.Copy(client, server)
-	okToCloseServer <- true
 	if copyError != nil {
-		fmt.Printf("\n!! CopyServerToClient received an error: %s", commonLog.ElideError(copyError))
 		errorChannel <- copyError
 	}
+	okToCloseServer <- true
+}
+
+// countingWriter adds the bytes written to the metrics, and to the total of
+// the connection if it is tracked, as they are written so that long running
+// connections show up.
+type countingWriter struct {
+	writer  io.Writer
+	counter *metrics.Counter
+	total   *int64
+}
+
+func (writer countingWriter) Write(buffer []byte) (int, error) {
+	written, err := writer.writer.Write(buffer)
+	writer.counter.Add(float64(written))
+	if writer.total != nil {
+		atomic.AddInt64(writer.total, int64(written))
+	}
+
+	return written, err
 }
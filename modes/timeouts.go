@@ -0,0 +1,262 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+)
+
+// Timeouts bound how long the dispatcher waits on the network. Zero disables
+// a timeout.
+type Timeouts struct {
+	// Dial bounds the TCP connection to the transport server, the upstream
+	// proxy or the target.
+	Dial time.Duration
+
+	// Handshake bounds the whole transport dial, including the handshake of
+	// the transport, and on a server the handshake of each connection.
+	Handshake time.Duration
+
+	// Idle closes a connection or a UDP flow that has carried no data in
+	// either direction for this long.
+	Idle time.Duration
+
+	// Write closes a connection when a single write is blocked for this
+	// long, such as when the other side stops reading.
+	Write time.Duration
+}
+
+// errShutdown is returned by a transport dial that is abandoned because the
+// dispatcher is shutting down.
+var errShutdown = errors.New("the dispatcher is shutting down")
+
+// timeoutError is the error of a connection ended by one of the timeouts. Its
+// Timeout method has the connection accounted as timed out, like a net.Error
+// for an expired deadline.
+type timeoutError struct {
+	what string
+}
+
+func (err timeoutError) Error() string {
+	return err.what + " timed out"
+}
+
+func (err timeoutError) Timeout() bool {
+	return true
+}
+
+// directDialer returns the dialer for the TCP connections that do not go
+// through the upstream proxy.
+func (runtime *Runtime) directDialer() *net.Dialer {
+	return &net.Dialer{Timeout: runtime.Timeouts.Dial, KeepAlive: runtime.KeepAlive.Period}
+}
+
+// DialWithTimeout dials the transport, giving up after timeout, unless it is
+// zero, or once done is closed. The transports do not take a context, so an
+// abandoned dial is left to finish and its connection is closed.
+func DialWithTimeout(transport Optimizer.TransportDialer, timeout time.Duration, done <-chan struct{}) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := transport.Dial()
+		results <- result{conn, err}
+	}()
+
+	var err error
+	select {
+	case dialed := <-results:
+		return dialed.conn, dialed.err
+	case <-ctx.Done():
+		err = timeoutError{"transport handshake"}
+	case <-done:
+		err = errShutdown
+	}
+
+	go func() {
+		if dialed := <-results; dialed.conn != nil {
+			_ = dialed.conn.Close()
+		}
+	}()
+
+	return nil, err
+}
+
+// Watchdog closes connections when it is not reset in time. A nil Watchdog
+// never fires, so that the callers need not check whether the timeout is set.
+type Watchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+
+	// paused counts the writers waiting for the rate limiters, during
+	// which the watchdog does not run.
+	lock   sync.Mutex
+	paused int
+}
+
+// newWatchdog returns a stopped watchdog that closes conns once it runs for
+// longer than timeout, or nil if there is no timeout.
+func newWatchdog(timeout time.Duration, conns ...io.Closer) *Watchdog {
+	if timeout <= 0 {
+		return nil
+	}
+
+	watchdog := &Watchdog{timeout: timeout}
+	watchdog.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&watchdog.fired, 1)
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+	watchdog.timer.Stop()
+
+	return watchdog
+}
+
+// IdleWatchdog returns a running watchdog that closes conns after the idle
+// timeout, or nil if there is no idle timeout. It is reset whenever data is
+// relayed.
+func (runtime *Runtime) IdleWatchdog(conns ...io.Closer) *Watchdog {
+	watchdog := newWatchdog(runtime.Timeouts.Idle, conns...)
+	watchdog.Reset()
+
+	return watchdog
+}
+
+// Reset restarts the watchdog for its full timeout, unless it is paused.
+func (watchdog *Watchdog) Reset() {
+	if watchdog == nil {
+		return
+	}
+
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+
+	if watchdog.paused == 0 {
+		watchdog.timer.Reset(watchdog.timeout)
+	}
+}
+
+// Pause stops the watchdog until every Pause is matched by a Resume. A
+// connection waiting for its rate limit is neither idle nor stalled.
+func (watchdog *Watchdog) Pause() {
+	if watchdog == nil {
+		return
+	}
+
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+
+	watchdog.paused++
+	watchdog.timer.Stop()
+}
+
+// Resume restarts the watchdog for its full timeout once nothing else holds
+// it paused.
+func (watchdog *Watchdog) Resume() {
+	if watchdog == nil {
+		return
+	}
+
+	watchdog.lock.Lock()
+	defer watchdog.lock.Unlock()
+
+	watchdog.paused--
+	if watchdog.paused == 0 {
+		watchdog.timer.Reset(watchdog.timeout)
+	}
+}
+
+// Stop stops the watchdog without closing the connections.
+func (watchdog *Watchdog) Stop() {
+	if watchdog != nil {
+		watchdog.timer.Stop()
+	}
+}
+
+// Fired reports whether the watchdog has closed the connections.
+func (watchdog *Watchdog) Fired() bool {
+	return watchdog != nil && atomic.LoadInt32(&watchdog.fired) != 0
+}
+
+// watchedWriter resets the idle watchdog on every write, and runs the stall
+// watchdog for as long as each write is blocked.
+type watchedWriter struct {
+	writer  io.Writer
+	idle    *Watchdog
+	stalled *Watchdog
+}
+
+// watch returns writer watched by the watchdogs, or writer itself if there
+// are none.
+func watch(writer io.Writer, idle *Watchdog, stalled *Watchdog) io.Writer {
+	if idle == nil && stalled == nil {
+		return writer
+	}
+
+	return watchedWriter{writer, idle, stalled}
+}
+
+func (writer watchedWriter) Write(buffer []byte) (int, error) {
+	writer.stalled.Reset()
+	written, err := writer.writer.Write(buffer)
+	writer.stalled.Stop()
+	writer.idle.Reset()
+
+	return written, err
+}
+
+// watchdogError returns the timeout that ended a copy loop, if any.
+func watchdogError(idle *Watchdog, stalled ...*Watchdog) error {
+	if idle.Fired() {
+		return timeoutError{"idle connection"}
+	}
+
+	for _, watchdog := range stalled {
+		if watchdog.Fired() {
+			return timeoutError{"write"}
+		}
+	}
+
+	return nil
+}
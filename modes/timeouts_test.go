@@ -0,0 +1,293 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCloser counts the times it is closed.
+type countingCloser struct {
+	closed int32
+}
+
+func (closer *countingCloser) Close() error {
+	atomic.AddInt32(&closer.closed, 1)
+	return nil
+}
+
+func (closer *countingCloser) count() int32 {
+	return atomic.LoadInt32(&closer.closed)
+}
+
+// TestWatchdogFires checks that a watchdog left running closes each of its
+// connections once.
+func TestWatchdogFires(t *testing.T) {
+	first, second := &countingCloser{}, &countingCloser{}
+	watchdog := newWatchdog(50*time.Millisecond, first, second)
+	watchdog.Reset()
+	time.Sleep(200 * time.Millisecond)
+
+	if !watchdog.Fired() {
+		t.Error("expected the watchdog to fire")
+	}
+	if first.count() != 1 || second.count() != 1 {
+		t.Errorf("expected each connection to be closed once, got %d and %d", first.count(), second.count())
+	}
+}
+
+// TestWatchdogReset checks that resetting a watchdog in time keeps it from
+// firing for longer than its timeout, and that a watchdog that was never
+// started or was stopped does not fire.
+func TestWatchdogReset(t *testing.T) {
+	closer := &countingCloser{}
+	watchdog := newWatchdog(100*time.Millisecond, closer)
+	time.Sleep(150 * time.Millisecond)
+	if watchdog.Fired() {
+		t.Error("expected a watchdog that was never started not to fire")
+	}
+
+	watchdog.Reset()
+	for i := 0; i < 5; i++ {
+		time.Sleep(40 * time.Millisecond)
+		watchdog.Reset()
+	}
+	watchdog.Stop()
+	time.Sleep(150 * time.Millisecond)
+
+	if watchdog.Fired() || closer.count() != 0 {
+		t.Error("expected a watchdog reset in time and then stopped not to fire")
+	}
+}
+
+// TestWatchdogPause checks that the pauses nest, that a reset does not
+// restart a paused watchdog, and that the last resume does.
+func TestWatchdogPause(t *testing.T) {
+	watchdog := newWatchdog(50*time.Millisecond, &countingCloser{})
+	watchdog.Reset()
+	watchdog.Pause()
+	watchdog.Pause()
+	watchdog.Resume()
+	watchdog.Reset()
+	time.Sleep(150 * time.Millisecond)
+
+	if watchdog.Fired() {
+		t.Fatal("expected the watchdog not to fire while it is still paused once")
+	}
+
+	watchdog.Resume()
+	time.Sleep(150 * time.Millisecond)
+	if !watchdog.Fired() {
+		t.Error("expected the watchdog to run again after the last resume")
+	}
+}
+
+// TestNoWatchdog checks that without a timeout there is no watchdog, and
+// that the nil watchdog can be used like any other.
+func TestNoWatchdog(t *testing.T) {
+	watchdog := newWatchdog(0, &countingCloser{})
+	if watchdog != nil {
+		t.Fatal("expected no watchdog without a timeout")
+	}
+
+	watchdog.Reset()
+	watchdog.Pause()
+	watchdog.Resume()
+	watchdog.Stop()
+	if watchdog.Fired() || watchdogError(watchdog, watchdog) != nil {
+		t.Error("expected the nil watchdog never to fire")
+	}
+
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	if watch(conn, nil, nil) != conn {
+		t.Error("expected a writer without watchdogs to be left as it is")
+	}
+}
+
+// TestWatchedWriterStall checks that a write blocked for longer than the
+// write timeout closes the connection, and that the copy loop reports it as
+// a timeout of the write rather than of the idle connection.
+func TestWatchedWriterStall(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	idle := newWatchdog(time.Minute, conn)
+	stalled := newWatchdog(50*time.Millisecond, conn)
+	idle.Reset()
+	defer idle.Stop()
+
+	// Nothing reads from the peer, so the write blocks until the stall
+	// watchdog closes the connection.
+	if _, err := watch(conn, idle, stalled).Write([]byte("blocked")); err == nil {
+		t.Fatal("expected the stalled write to fail")
+	}
+
+	err := watchdogError(idle, stalled)
+	if err == nil || err.Error() != "write timed out" {
+		t.Errorf("expected the write timeout, got %v", err)
+	}
+	if reason := closeReason(false, true, err); reason != CloseTimeout {
+		t.Errorf("expected the write timeout to be accounted as a timeout, got %s", reason)
+	}
+}
+
+// slowDialer dials after a delay, and reports when the connection it returns
+// is closed.
+type slowDialer struct {
+	delay  time.Duration
+	err    error
+	closed chan struct{}
+}
+
+func (dialer *slowDialer) Dial() (net.Conn, error) {
+	time.Sleep(dialer.delay)
+	if dialer.err != nil {
+		return nil, dialer.err
+	}
+
+	conn, peer := net.Pipe()
+	go func() {
+		_, _ = peer.Read(make([]byte, 1))
+		close(dialer.closed)
+	}()
+
+	return conn, nil
+}
+
+// TestDialTimeout checks that a transport dial gives up after its timeout,
+// and that the connection it finally gets is closed.
+func TestDialTimeout(t *testing.T) {
+	dialer := &slowDialer{delay: 200 * time.Millisecond, closed: make(chan struct{})}
+	started := time.Now()
+	conn, err := DialWithTimeout(dialer, 50*time.Millisecond, nil)
+	if conn != nil || err != (timeoutError{"transport handshake"}) {
+		t.Fatalf("expected the handshake timeout, got %v and %v", conn, err)
+	}
+	if elapsed := time.Since(started); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the dial to give up after the timeout, took %s", elapsed)
+	}
+
+	select {
+	case <-dialer.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the abandoned connection to be closed")
+	}
+}
+
+// TestDialShutdown checks that a dial without a timeout is abandoned when the
+// dispatcher shuts down, and that a failed dial keeps its own error.
+func TestDialShutdown(t *testing.T) {
+	refused := errors.New("connection refused")
+	if _, err := DialWithTimeout(&slowDialer{err: refused}, 0, nil); err != refused {
+		t.Errorf("expected the error of the dial, got %v", err)
+	}
+
+	done := make(chan struct{})
+	dialer := &slowDialer{delay: 100 * time.Millisecond, closed: make(chan struct{})}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(done)
+	}()
+	if _, err := DialWithTimeout(dialer, 0, done); err != errShutdown {
+		t.Errorf("expected the dial to be abandoned at shutdown, got %v", err)
+	}
+
+	select {
+	case <-dialer.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the abandoned connection to be closed")
+	}
+}
+
+// shadowServerOptions is the Shadow server config from ConfigFiles.
+const shadowServerOptions = `{"serverAddress":"127.0.0.1:2222","transport":"shadow","cipherName":"darkstar","serverPrivateKey":"AtpykHwt9NAe2JZatzsixjjnAEuqn3xz06/GgRT/3hWK"}`
+
+// silentClient connects to a Shadow server started with the handshake timeout
+// and never sends its half of the handshake. It returns how long the server
+// took to hang up, or an error if it was still connected after wait.
+func silentClient(t *testing.T, timeout time.Duration, wait time.Duration) (time.Duration, error) {
+	runtime := NewRuntime("")
+	runtime.Timeouts.Handshake = timeout
+
+	listen, err := runtime.serverListener("shadow", shadowServerOptions, false, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	started := time.Now()
+
+	_ = client.SetReadDeadline(started.Add(wait))
+	_, err = client.Read(make([]byte, 1))
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, err
+	}
+
+	return time.Since(started), nil
+}
+
+// TestServerHandshakeTimeout checks that the handshake timeout drops a server
+// connection whose client never finishes the transport handshake, and that
+// without one the server keeps waiting.
+func TestServerHandshakeTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+
+	elapsed, err := silentClient(t, timeout, 5*time.Second)
+	if err != nil {
+		t.Fatal("expected the silent client to be disconnected")
+	}
+	if elapsed < timeout-50*time.Millisecond || elapsed > timeout+time.Second {
+		t.Errorf("expected the silent client to be disconnected after the handshake timeout, took %s", elapsed)
+	}
+
+	if _, err = silentClient(t, 0, timeout); err == nil {
+		t.Error("expected the silent client to stay connected without a handshake timeout")
+	}
+}
@@ -30,101 +30,71 @@
 package transparent_tcp
 
 import (
-	"fmt"
 	"net"
-	"net/url"
 
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	"github.com/kataras/golog"
-	"golang.org/x/net/proxy"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string, enableLocket bool, stateDir string) (launched bool) {
-	return modes.ClientSetupTCP(socksAddr, ptClientProxy, names, options, clientHandler, enableLocket, stateDir)
+func ClientSetup(socksAddr string, names []string, runtime *modes.Runtime) (launched bool) {
+	return modes.ClientSetupTCP(socksAddr, names, runtime, clientHandler)
 }
 
-func clientHandler(name string, options string, conn net.Conn, proxyURI *url.URL, enableLocket bool, logDir string) {
-	var dialer proxy.Dialer
-	dialer = proxy.Direct
-	if proxyURI != nil {
-		var err error
-		dialer, err = proxy.FromURL(proxyURI, proxy.Direct)
-		if err != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			fmt.Println("-> failed to obtain dialer", proxyURI, proxy.Direct)
-			golog.Errorf("(%s) - failed to obtain proxy dialer: %s", commonLog.ElideError(err))
-			conn.Close()
-			return
-		}
+func clientHandler(name string, options string, conn net.Conn, runtime *modes.Runtime, logger *log.Logger) {
+	dialer, err := modes.ProxyDialer(runtime)
+	if err != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		logger.With("error", err).Errorf("failed to obtain proxy dialer")
+		conn.Close()
+		return
 	}
 
 	// Deal with arguments.
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
+	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, runtime.EnableLocket, runtime.StateDir)
 	if argsToDialerErr != nil {
-		golog.Errorf("Error creating a transport with the provided options: %v", options)
-		golog.Errorf("Error: %v", argsToDialerErr.Error())
-		println("-> Error creating a transport with the provided options: ", options)
-		println("-> Error: ", argsToDialerErr.Error())
+		logger.With("options", options).Errorf("error creating a transport with the provided options: %s", argsToDialerErr)
 		conn.Close()
 
 		return
 	}
 
-	if conn == nil {
-		println("--> Application connection is nil")
-		golog.Errorf("%s - closed connection. Application connection is nil", name)
-	}
-
-	fmt.Println("Dialing ")
-	remote, dialErr := transport.Dial()
+	remote, dialErr := modes.DialTransport(name, transport, runtime)
 	if dialErr != nil {
-
-		println("--> Unable to dial transport server: ", dialErr.Error())
-		println("-> Name: ", name)
-		println("-> Options: ", options)
-		golog.Errorf("--> Unable to dial transport server: %v", dialErr.Error())
+		logger.With("error", dialErr).Errorf("unable to dial transport server")
 		conn.Close()
 		return
 	}
 
 	if remote == nil {
-		println("--> Transport server connection is nil.")
-		golog.Errorf("%s - closed connection. Transport server connection is nil", name)
+		logger.Errorf("closed connection, the transport server connection is nil")
 		conn.Close()
+		return
 	}
+	logger.Debugf("connected to the transport server")
 
-	if err := modes.CopyLoop(conn, remote); err != nil {
-		golog.Warnf("%s(%s) - closed connection: %s", name, commonLog.ElideError(err))
-		println("%s(%s) - closed connection: %s", name, commonLog.ElideError(err))
-	} else {
-		golog.Infof("%s(%s) - closed connection", name)
-		println("%s(%s) - closed connection", name)
+	if err := modes.CopyLoop(conn, remote, name, runtime); err != nil {
+		logger.With("error", err).Warnf("closed connection")
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, statedir string, options string, enableLocket bool) (launched bool) {
-	return modes.ServerSetupTCP(ptServerInfo, statedir, options, serverHandler, enableLocket)
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, runtime *modes.Runtime) (launched bool) {
+	return modes.ServerSetupTCP(ptServerInfo, runtime, serverHandler)
 }
 
-func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo, runtime *modes.Runtime, logger *log.Logger) {
 	// Connect to the orport.
-	orConn, err := pt_extras.DialOr(info, remote.RemoteAddr().String(), name)
+	orConn, err := pt_extras.DialOr(info, modes.RemoteAddrString(remote), name, runtime.Timeouts.Dial)
 	if err != nil {
-		print("failed to connect to ORPort: ")
-		println(commonLog.ElideError(err))
-		golog.Errorf("%s - failed to connect to ORPort: %s", name, commonLog.ElideError(err))
+		logger.With("error", err).Errorf("failed to connect to ORPort")
 		remote.Close()
 		return
 	}
 
-	if err = modes.CopyLoop(orConn, remote); err != nil {
-		print("closed a connection: ")
-		println(commonLog.ElideError(err))
-		golog.Warnf("%s - closed connection: %s", name, commonLog.ElideError(err))
-	} else {
-		golog.Infof("%s - closed connection", name)
+	runtime.SetKeepAlive(orConn)
+
+	if err = modes.CopyLoop(orConn, remote, name, runtime); err != nil {
+		logger.With("error", err).Warnf("closed connection")
 	}
 }
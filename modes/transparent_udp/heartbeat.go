@@ -0,0 +1,120 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transparent_udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+// heartbeatFrame is an empty packet. The server does not forward it to the
+// target but echoes it back. A server from before heartbeats forwards it as
+// an empty datagram instead, which is why they are only sent when enabled.
+var heartbeatFrame = []byte{0, 0}
+
+// heartbeats returns the function that starts the heartbeats of a new flow,
+// or nil if they are disabled.
+func heartbeats(runtime *modes.Runtime) modes.FlowOpened {
+	interval := runtime.KeepAlive.Heartbeat
+	if interval <= 0 {
+		return nil
+	}
+
+	return func(remote net.Conn, logger *log.Logger) net.Conn {
+		flow := &heartbeatConn{Conn: remote, lastSeen: time.Now().UnixNano()}
+		go flow.readEchoes(logger)
+		go flow.send(interval, logger)
+
+		return flow
+	}
+}
+
+// heartbeatConn is the transport connection of a flow with heartbeats. The
+// packets and the heartbeats are written from different goroutines, so the
+// writes are serialized.
+type heartbeatConn struct {
+	net.Conn
+
+	lock     sync.Mutex
+	lastSeen int64
+}
+
+func (flow *heartbeatConn) Write(buffer []byte) (int, error) {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+
+	return flow.Conn.Write(buffer)
+}
+
+// send writes a heartbeat every interval, and closes the connection once the
+// server has not answered for HeartbeatMisses intervals.
+func (flow *heartbeatConn) send(interval time.Duration, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		silence := time.Since(time.Unix(0, atomic.LoadInt64(&flow.lastSeen)))
+		if silence > modes.HeartbeatMisses*interval {
+			logger.With("silence", silence.Round(time.Second)).Warnf("the transport server stopped answering heartbeats, closing the flow")
+			_ = flow.Close()
+			return
+		}
+
+		if _, err := flow.Write(heartbeatFrame); err != nil {
+			return
+		}
+	}
+}
+
+// readEchoes reads the frames sent back by the server, which are only the
+// echoes of the heartbeats, until the connection is closed.
+func (flow *heartbeatConn) readEchoes(logger *log.Logger) {
+	var length16 uint16
+	lengthBuffer := make([]byte, 2)
+
+	for {
+		if _, err := io.ReadFull(flow.Conn, lengthBuffer); err != nil {
+			logger.With("error", err).Debugf("stopped reading heartbeats")
+			_ = flow.Close()
+			return
+		}
+
+		_ = binary.Read(bytes.NewReader(lengthBuffer), binary.LittleEndian, &length16)
+		if _, err := io.CopyN(io.Discard, flow.Conn, int64(length16)); err != nil {
+			_ = flow.Close()
+			return
+		}
+
+		atomic.StoreInt64(&flow.lastSeen, time.Now().UnixNano())
+	}
+}
@@ -0,0 +1,136 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transparent_udp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+// TestHeartbeats tests that a flow sends heartbeats while the server answers
+// them, and is closed once the server stops answering.
+func TestHeartbeats(t *testing.T) {
+	if heartbeats(modes.NewRuntime("")) != nil {
+		t.Error("expected no heartbeats unless they are configured")
+	}
+
+	runtime := modes.NewRuntime("")
+	runtime.KeepAlive.Heartbeat = 20 * time.Millisecond
+
+	client, server := net.Pipe()
+	defer server.Close()
+	flow := heartbeats(runtime)(client, log.With())
+	defer flow.Close()
+
+	// Answered for longer than HeartbeatMisses intervals, the flow stays
+	// open.
+	frame := make([]byte, len(heartbeatFrame))
+	for count := 0; count < 2*modes.HeartbeatMisses; count++ {
+		_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(server, frame); err != nil {
+			t.Fatalf("heartbeat %d was not sent: %s", count, err)
+		}
+		if !bytes.Equal(frame, heartbeatFrame) {
+			t.Fatalf("received %v, expected the heartbeat %v", frame, heartbeatFrame)
+		}
+		if _, err := server.Write(heartbeatFrame); err != nil {
+			t.Fatalf("the flow stopped reading the heartbeat echoes: %s", err)
+		}
+	}
+
+	// Unanswered, the heartbeats stop and the flow is closed.
+	_ = server.SetDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := io.ReadFull(server, frame); err != nil {
+			if err != io.EOF && err != io.ErrClosedPipe {
+				t.Errorf("expected the flow to be closed, got %s", err)
+			}
+			break
+		}
+	}
+}
+
+// TestServerHeartbeats tests that the server answers a heartbeat and does
+// not forward it to the target.
+func TestServerHeartbeats(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+	info := &pt_extras.ServerInfo{OrAddr: &net.TCPAddr{IP: targetAddr.IP, Port: targetAddr.Port}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	handled := make(chan struct{})
+	go func() {
+		serverHandler("plain", server, info, modes.NewRuntime(""), log.With())
+		close(handled)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = client.Write(heartbeatFrame); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(heartbeatFrame))
+	if _, err = io.ReadFull(client, echo); err != nil {
+		t.Fatalf("the heartbeat was not answered: %s", err)
+	}
+	if !bytes.Equal(echo, heartbeatFrame) {
+		t.Errorf("received %v, expected the heartbeat %v", echo, heartbeatFrame)
+	}
+
+	packet := []byte("hello")
+	if _, err = client.Write(append([]byte{byte(len(packet)), 0}, packet...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first datagram the target gets is the packet, not an empty one for
+	// the heartbeat.
+	_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, 64)
+	read, _, err := target.ReadFromUDP(received)
+	if err != nil {
+		t.Fatalf("the packet was not forwarded: %s", err)
+	}
+	if !bytes.Equal(received[:read], packet) {
+		t.Errorf("the target received %q, expected %q", received[:read], packet)
+	}
+
+	_ = client.Close()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the handler to return once the flow is closed")
+	}
+}
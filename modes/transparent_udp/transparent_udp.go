@@ -32,142 +32,186 @@ package transparent_udp
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
-	"net/url"
+	"time"
 
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	"github.com/kataras/golog"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string) bool {
-	return modes.ClientSetupUDP(socksAddr, ptClientProxy, names, options, clientHandler)
+func ClientSetup(socksAddr string, names []string, runtime *modes.Runtime) bool {
+	return modes.ClientSetupUDP(socksAddr, names, runtime, clientHandler)
 }
 
-func clientHandler(name string, options string, conn *net.UDPConn, proxyURI *url.URL) {
+func clientHandler(name string, conn *net.UDPConn, runtime *modes.Runtime) {
 	var length16 uint16
 
-	tracker := make(modes.ConnTracker)
+	logger := log.With("transport", name, "mode", runtime.Mode)
+
+	tracker := modes.NewConnTracker(runtime)
 
 	buf := make([]byte, 1024)
 
+	forwarded := metrics.UDPPacketsForwarded.With(name, runtime.Mode)
+
+	idleTimeout := runtime.Timeouts.Idle
+	lastSweep := time.Now()
+
 	// Receive UDP packets and forward them over transport connections forever
 	for {
+		if idleTimeout > 0 {
+			if time.Since(lastSweep) >= idleTimeout/2 {
+				tracker.CloseIdle(idleTimeout, logger)
+				lastSweep = time.Now()
+			}
+
+			// Wake up to close the idle flows even when no packets arrive.
+			_ = conn.SetReadDeadline(time.Now().Add(idleTimeout / 2))
+		}
+
 		numBytes, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Println("Error: ", err)
+			if runtime.Closed() {
+				return
+			}
+
+			if netError, ok := err.(net.Error); ok && netError.Timeout() {
+				continue
+			}
+
+			logger.With("error", err).Warnf("failed to read a UDP packet")
+			continue
 		}
 
 		goodBytes := buf[:numBytes]
 
-		fmt.Println(tracker)
-
-		if state, ok := tracker[addr.String()]; ok {
+		if state, ok := tracker.Get(addr.String()); ok {
 			// There is an open transport connection, or a connection attempt is in progress.
 
 			if state.Waiting {
 				// The connection attempt is in progress.
 				// Drop the packet.
+				metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropWaiting).Inc()
 			} else {
 				// There is an open transport connection.
 				// Send the packet through the transport.
+				// The length and the packet are written at once so that a
+				// heartbeat cannot come between them.
 				length16 = uint16(numBytes)
-				lengthBuf := new(bytes.Buffer)
-				err = binary.Write(lengthBuf, binary.LittleEndian, length16)
+				frame := new(bytes.Buffer)
+				err = binary.Write(frame, binary.LittleEndian, length16)
 				if err != nil {
-					fmt.Println("binary.Write failed:", err)
+					logger.With("error", err).Errorf("failed to encode the packet length")
+					metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropError).Inc()
+				} else if _, writeError := state.Conn.Write(append(frame.Bytes(), goodBytes...)); writeError != nil {
+					// The transport connection is gone, so the next packet
+					// of the flow opens a new one.
+					logger.With("remote", addr, "error", writeError).Errorf("failed to forward a packet over the transport")
+					metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropError).Inc()
+					_ = state.Conn.Close()
+					tracker.Delete(addr.String())
 				} else {
-					println("writing data to server")
-					println(len(lengthBuf.Bytes()))
-					_, writErr := state.Conn.Write(lengthBuf.Bytes())
-					if writErr != nil {
-						continue
-					} else {
-						println("writing data to server")
-						println(len(goodBytes))
-						_, writeBufErr := state.Conn.Write(goodBytes)
-						if writeBufErr != nil {
-							_ = state.Conn.Close()
-							_ = conn.Close()
-						}
-
-					}
+					forwarded.Inc()
+					state.LastActive = time.Now()
+					tracker.Set(addr.String(), state)
 				}
 			}
 		} else {
 			// There is not an open transport connection and a connection attempt is not in progress.
-			// Open a transport connection.
-			modes.OpenConnection(&tracker, addr.String(), name, options, proxyURI, false, "")
-			// Drop the packet.
+			// Open a transport connection, unless the flow is over the
+			// connection limits, and drop the packet.
+			if modes.OpenConnection(tracker, addr, name, runtime.Options.Get(), runtime, heartbeats(runtime)) {
+				metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropConnecting).Inc()
+			} else {
+				metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropRejected).Inc()
+			}
 		}
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, options string) (launched bool) {
-	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, runtime *modes.Runtime) (launched bool) {
+	return modes.ServerSetupUDP(ptServerInfo, runtime, serverHandler)
 }
 
-func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo, runtime *modes.Runtime, logger *log.Logger) {
 	var length16 uint16
 
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	fmt.Println("### handling", name)
-	golog.Infof("%s(%s) - new connection", name, addrStr)
+	defer remote.Close()
 
-	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
+	dest, err := dialTarget(info)
 	if err != nil {
-		golog.Fatal(err)
+		logger.With("error", err).Errorf("failed to connect to the target")
+		return
 	}
+	defer dest.Close()
 
-	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	if err != nil {
-		golog.Fatal(err)
-	}
-
-	dest, err := net.DialUDP("udp", localAddr, serverAddr)
-	if err != nil {
-		golog.Fatal(err)
-	}
-
-	fmt.Println("pumping")
+	idle := runtime.IdleWatchdog(remote, dest)
+	defer idle.Stop()
 
 	lengthBuffer := make([]byte, 2)
+	forwarded := metrics.UDPPacketsForwarded.With(name, runtime.Mode)
 
 	for {
-		fmt.Println("reading...")
 		// Read the incoming connection into the buffer.
-		readLen, err := io.ReadFull(remote, lengthBuffer)
+		_, err := io.ReadFull(remote, lengthBuffer)
 		if err != nil {
-			fmt.Println("read error")
+			if idle.Fired() {
+				logger.Debugf("closing idle UDP flow")
+			} else {
+				logger.With("error", err).Debugf("read error")
+			}
 			break
 		}
 
-		fmt.Println(readLen)
-
 		err = binary.Read(bytes.NewReader(lengthBuffer), binary.LittleEndian, &length16)
 		if err != nil {
-			fmt.Println("deserialization error")
-			_ = dest.Close()
+			logger.With("error", err).Errorf("deserialization error")
 			return
 		}
 
-		fmt.Println("reading data")
-		fmt.Println(length16)
+		if length16 == 0 {
+			// An empty frame is a heartbeat, which is echoed back so that the
+			// client knows the connection is still alive.
+			if _, writeError := remote.Write(heartbeatFrame); writeError != nil {
+				logger.With("error", writeError).Debugf("failed to answer a heartbeat")
+				break
+			}
+			continue
+		}
+
 		readBuffer := make([]byte, length16)
-		readLen, err = io.ReadFull(remote, readBuffer)
+		readLen, err := io.ReadFull(remote, readBuffer)
 		if err != nil {
-			fmt.Println("read error")
+			logger.With("error", err).Debugf("read error")
 			break
 		}
 		if readLen != int(length16) {
-			println("short read")
+			logger.Errorf("short read")
 			break
 		}
-		_, _ = dest.Write(readBuffer)
+		if _, writeError := dest.Write(readBuffer); writeError != nil {
+			metrics.UDPPacketsDropped.With(name, runtime.Mode, metrics.DropError).Inc()
+		} else {
+			forwarded.Inc()
+		}
+		idle.Reset()
+	}
+}
+
+// dialTarget opens the UDP socket the packets are forwarded to.
+func dialTarget(info *pt_extras.ServerInfo) (*net.UDPConn, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
 	}
 
-	_ = dest.Close()
+	return net.DialUDP("udp", localAddr, serverAddr)
 }
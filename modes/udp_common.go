@@ -26,68 +26,41 @@ package modes
 
 import (
 	"net"
-	"net/url"
 
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/kataras/golog"
 )
 
-func ClientSetupUDP(socksAddr string, ptClientProxy *url.URL, names []string, options string, clientHandler ClientHandlerUDP) bool {
+func ClientSetupUDP(socksAddr string, names []string, runtime *Runtime, clientHandler ClientHandlerUDP) bool {
 	// Launch each of the client listeners.
 	for _, name := range names {
 		udpAddr, err := net.ResolveUDPAddr("udp", socksAddr)
 		if err != nil {
-			golog.Errorf("Error resolving address %s", socksAddr)
+			runtime.setupFailed(name, err)
+			continue
 		}
 
 		ln, err := net.ListenUDP("udp", udpAddr)
 		if err != nil {
-			golog.Errorf("failed to listen %s %s", name, err.Error())
+			runtime.setupFailed(name, err)
 			continue
 		}
 
-		golog.Infof("%s - registered listener", name)
-
-		go clientHandler(name, options, ln, ptClientProxy)
-	}
-
-	return true
-}
-
-func ServerSetupUDP(ptServerInfo pt_extras.ServerInfo, stateDir string, options string, serverHandler ServerHandler) (launched bool) {
-	// Launch each of the server listeners.
-	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options, false, "")
-		if parseError != nil {
+		if !runtime.addListener(name, ln.LocalAddr(), ln) {
 			return false
 		}
 
-		go func() {
-			for {
-				transportLn, LnError := listen()
-				if LnError != nil {
-					continue
-				}
-
-				print(name)
-				print(" listening on ")
-				println(bindaddr.Addr.String())
-
-				golog.Infof("%s - registered listener: %s", name, commonLog.ElideAddr(bindaddr.Addr.String()))
-				ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler, false, "")
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					golog.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
+		log.With("transport", name, "mode", runtime.Mode, "addr", ln.LocalAddr()).Infof("registered listener")
 
-		launched = true
+		go func(name string) {
+			clientHandler(name, ln, runtime)
+			runtime.removeListener(ln)
+		}(name)
 	}
 
-	return
+	return true
+}
+
+func ServerSetupUDP(ptServerInfo pt_extras.ServerInfo, runtime *Runtime, serverHandler ServerHandler) (launched bool) {
+	return ServerSetup(ptServerInfo, runtime, serverHandler, false)
 }
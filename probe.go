@@ -0,0 +1,131 @@
+/*
+	MIT License
+
+	Copyright (c) 2020 Operator Foundation
+
+	Permission is hereby granted, free of charge, to any person obtaining a copy
+	of this software and associated documentation files (the "Software"), to deal
+	in the Software without restriction, including without limitation the rights
+	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+	copies of the Software, and to permit persons to whom the Software is
+	furnished to do so, subject to the following conditions:
+
+	The above copyright notice and this permission notice shall be included in all
+	copies or substantial portions of the Software.
+
+	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+	SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/kataras/golog"
+	"golang.org/x/net/proxy"
+)
+
+// clientFlags are the flags needed to connect to a transport server without
+// running the dispatcher.
+type clientFlags struct {
+	transport   *string
+	options     *string
+	optionsFile *string
+	proxy       *string
+	timeout     *time.Duration
+}
+
+func defineClientFlags(flags *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		transport:   flags.String("transport", "", "Specify the transport to connect with"),
+		options:     flags.String("options", "", "Specify the client transport options"),
+		optionsFile: flags.String("optionsFile", "", "Read the client transport options from a file"),
+		proxy:       flags.String("proxy", "", "Specify an HTTP or SOCKS proxy to connect through"),
+		timeout:     flags.Duration("timeout", 30*time.Second, "Give up on a connection that has not completed its handshake after this long, 0 for no timeout"),
+	}
+}
+
+// dial connects to the server with the transport, giving up after the
+// timeout. The transports do their handshake while dialing, so a connection
+// is only returned once the handshake has succeeded.
+func (clientFlags *clientFlags) dial() (net.Conn, error) {
+	if *clientFlags.transport == "" {
+		return nil, errors.New("-transport is required")
+	}
+
+	options := *clientFlags.options
+	if *clientFlags.optionsFile != "" {
+		if options != "" {
+			return nil, errors.New("-options and -optionsFile cannot be used at the same time")
+		}
+
+		contents, readError := os.ReadFile(*clientFlags.optionsFile)
+		if readError != nil {
+			return nil, readError
+		}
+		options = string(contents)
+	}
+
+	var dialer proxy.Dialer = proxy.Direct
+	if *clientFlags.proxy != "" {
+		proxyURI, uriError := pt_extras.ParseProxyURI(*clientFlags.proxy)
+		if uriError != nil {
+			return nil, uriError
+		}
+
+		var proxyError error
+		if dialer, proxyError = proxy.FromURL(proxyURI, proxy.Direct); proxyError != nil {
+			return nil, proxyError
+		}
+	}
+
+	transport, parseError := pt_extras.ArgsToDialer(*clientFlags.transport, options, dialer, false, "")
+	if parseError != nil {
+		return nil, parseError
+	}
+
+	return modes.DialWithTimeout(transport, *clientFlags.timeout, nil)
+}
+
+func probeCommand(arguments []string) {
+	flags := newCommandFlags("probe", "-transport [transport] -optionsFile [client config]")
+	clientFlags := defineClientFlags(flags)
+	count := flags.Int("count", 1, "Number of connections to attempt")
+	_ = flags.Parse(arguments)
+
+	golog.SetLevel("disable")
+
+	succeeded := 0
+	for attempt := 1; attempt <= *count; attempt++ {
+		start := time.Now()
+		conn, err := clientFlags.dial()
+		elapsed := time.Since(start)
+
+		if err != nil {
+			fmt.Printf("%d: failed after %s: %s\n", attempt, elapsed.Round(time.Millisecond), err.Error())
+			continue
+		}
+
+		fmt.Printf("%d: connected to %s in %s\n", attempt, modes.RemoteAddrString(conn), elapsed.Round(time.Millisecond))
+		_ = conn.Close()
+		succeeded++
+	}
+
+	fmt.Printf("%d of %d connections succeeded\n", succeeded, *count)
+	if succeeded == 0 {
+		os.Exit(1)
+	}
+}
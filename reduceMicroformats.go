@@ -25,8 +25,7 @@
 package main
 
 import (
-	"errors"
-	"github.com/kataras/golog"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/dispatcher"
 )
 
 //This is for proposal no.9
@@ -42,126 +41,108 @@ import (
 //modeName := flag.String("mode", "socks5", "Specify which mode is being used: transparent-TCP, transparent-UDP, socks5, or STUN")
 //set transparent or udp to nil
 
-func validateTransports(transport *string, transports *string) error {
+// The functions below check the command line flags that can be given in
+// several forms, such as -bindaddr or -bindhost and -bindport. Each of them
+// adds every problem it finds to problems, so that they can all be reported
+// at once.
+
+func validateTransports(problems *configProblems, transport *string, transports *string) {
 	if *transports == "" && *transport == "" {
-		return errors.New("you must specify either --transport or --transports")
+		problems.add("you must specify either --transport or --transports")
 	}
 
 	if *transports != "" && *transport != "" {
-		return errors.New("you cannot specify both --transport and --transports")
+		problems.add("you cannot specify both --transport and --transports")
 	}
-
-	return nil
 }
 
-func validateServerBindAddr(transport *string, serverBindHost *string, serverBindPort *string, serverBindAddr *string) error {
+func validateServerBindAddr(problems *configProblems, transport *string, serverBindHost *string, serverBindPort *string, serverBindAddr *string) {
 	if *serverBindHost == "" && *serverBindAddr == "" {
-		return errors.New("you must specify either --bindhost or --bindaddr")
+		problems.add("you must specify either --bindhost or --bindaddr")
 	}
 
 	if *serverBindHost != "" && *serverBindAddr != "" {
-		return errors.New("you cannot specify both --bindhost and --bindaddr")
+		problems.add("you cannot specify both --bindhost and --bindaddr")
 	}
 
 	if (*serverBindHost != "" && *serverBindPort == "") || (*serverBindHost == "" && *serverBindPort != "") {
-		return errors.New("you must specify both --bindhost and --bindport (or use --bindaddr)")
+		problems.add("you must specify both --bindhost and --bindport (or use --bindaddr)")
 	}
 
 	if *serverBindHost != "" && *transport == "" {
-		return errors.New("you must specify --transport when you use --bindhost")
+		problems.add("you must specify --transport when you use --bindhost")
 	}
-
-	return nil
 }
 
-func validateSocksServerBindAddr(serverBindHost *string, serverBindPort *string, serverBindAddr *string) error {
+func validateSocksServerBindAddr(problems *configProblems, serverBindHost *string, serverBindPort *string, serverBindAddr *string) {
 	if *serverBindHost != "" && *serverBindAddr != "" && *serverBindPort != "" {
-		return errors.New("you cannot specify --bindhost, --bindport, or --bindaddr in socks5 mode")
+		problems.add("you cannot specify --bindhost, --bindport, or --bindaddr in socks5 mode")
 	}
-
-	return nil
 }
 
-func validateProxyListenAddr(proxyListenHost *string, proxyListenPort *string, proxyListenAddr *string) error {
+func validateProxyListenAddr(problems *configProblems, proxyListenHost *string, proxyListenPort *string, proxyListenAddr *string) {
 	if *proxyListenHost == "" && *proxyListenAddr == "" {
-		return errors.New("you must specify either --proxylistenhost or --proxylistenaddr")
+		problems.add("you must specify either --proxylistenhost or --proxylistenaddr")
 	}
 
 	if *proxyListenHost != "" && *proxyListenAddr != "" {
-		golog.Infof("proxylistenhost: %s", *proxyListenHost)
-		golog.Infof("proxylistenport: %s", *proxyListenPort)
-		golog.Infof("proxylistenaddr: %s", *proxyListenAddr)
-		return errors.New("you cannot specify both --proxylistenhost and --proxylistenaddr")
+		problems.add("you cannot specify both --proxylistenhost and --proxylistenaddr")
 	}
 
 	if (*proxyListenHost != "" && *proxyListenPort == "") || (*proxyListenHost == "" && *proxyListenPort != "") {
-		return errors.New("you must specify both --proxylistenhost and --proxylistenport (or use --proxylistenaddr)")
+		problems.add("you must specify both --proxylistenhost and --proxylistenport (or use --proxylistenaddr)")
 	}
-
-	return nil
 }
 
-func validatetarget(isClient bool, targetHost *string, targetPort *string, targetAddr *string) error {
+func validatetarget(problems *configProblems, isClient bool, targetHost *string, targetPort *string, targetAddr *string) {
 	if isClient {
 		if *targetHost != "" || *targetPort != "" || *targetAddr != "" {
-			return errors.New("cannot specify --target, --targethost, or --targetport in client mode")
-		}
-		return nil
-	} else {
-		if *targetHost == "" && *targetAddr == "" {
-			return errors.New("you must specify either --targethost or --target")
+			problems.add("cannot specify --target, --targethost, or --targetport in client mode")
 		}
+		return
+	}
 
-		if *targetHost != "" && *targetAddr != "" {
-			return errors.New("you cannot specify both --targethost and --target")
-		}
+	if *targetHost == "" && *targetAddr == "" {
+		problems.add("you must specify either --targethost or --target")
+	}
 
-		if (*targetHost != "" && *targetPort == "") || (*targetHost == "" && *targetPort != "") {
-			return errors.New("you must specify both --targethost and --targetport (or use --target)")
-		}
-		return nil
+	if *targetHost != "" && *targetAddr != "" {
+		problems.add("you cannot specify both --targethost and --target")
+	}
+
+	if (*targetHost != "" && *targetPort == "") || (*targetHost == "" && *targetPort != "") {
+		problems.add("you must specify both --targethost and --targetport (or use --target)")
 	}
 }
 
-func validatetargetSocks5(targetHost *string, targetPort *string, targetAddr *string) error {
+func validatetargetSocks5(problems *configProblems, targetHost *string, targetPort *string, targetAddr *string) {
 	if *targetHost != "" {
-		return errors.New("you cannot specify --targethost in socks5 mode")
+		problems.add("you cannot specify --targethost in socks5 mode")
 	}
 
 	if *targetPort != "" {
-		return errors.New("you cannot specify --targetport in socks5 mode")
+		problems.add("you cannot specify --targetport in socks5 mode")
 	}
 
 	if *targetAddr != "" {
-		return errors.New("you cannot specify --target in socks5 mode")
+		problems.add("you cannot specify --target in socks5 mode")
 	}
-
-	return nil
 }
 
-func validateMode(mode *string, transparent *bool, udp *bool) error {
+func validateMode(problems *configProblems, mode *string, transparent *bool, udp *bool) {
 	if *mode != "" && *transparent != false {
-		return errors.New("cannot specify --mode and --transparent at the same time")
+		problems.add("cannot specify --mode and --transparent at the same time")
 	}
 
 	if *mode != "" && *udp != false {
-		return errors.New("cannot specify --mode and --udp at the same time")
+		problems.add("cannot specify --mode and --udp at the same time")
 	}
 
 	if *mode != "" {
 		switch *mode {
-		case "socks5":
-			return nil
-		case "transparent-TCP":
-			return nil
-		case "transparent-UDP":
-			return nil
-		case "STUN":
-			return nil
+		case dispatcher.ModeSocks5, dispatcher.ModeTransparentTCP, dispatcher.ModeTransparentUDP, dispatcher.ModeSTUN:
 		default:
-			return errors.New("invalid mode")
+			problems.add("invalid mode %q", *mode)
 		}
 	}
-
-	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,164 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"errors"
+	"net"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+)
+
+// The built-in transports, in the order they are listed.
+func init() {
+	Register(Factory{
+		Name:      "shadow",
+		Dialer:    shadowDialer,
+		Listener:  shadowListener,
+		Generate:  writeGenerated("Shadow", shadowGeneratedConfigs),
+		Configs:   shadowGeneratedConfigs,
+		Check:     checkShadow,
+		Chainable: true,
+	})
+
+	Register(Factory{
+		Name:      "Replicant",
+		Dialer:    replicantDialer,
+		Listener:  replicantListener,
+		Generate:  writeGenerated("Replicant", replicantGeneratedConfigs),
+		Configs:   replicantGeneratedConfigs,
+		Check:     checkReplicant,
+		Chainable: true,
+	})
+
+	Register(Factory{
+		Name:      "Starbridge",
+		Dialer:    starbridgeDialer,
+		Listener:  starbridgeListener,
+		Generate:  writeGenerated("Starbridge", starbridgeGeneratedConfigs),
+		Configs:   starbridgeGeneratedConfigs,
+		Check:     checkStarbridge,
+		Chainable: true,
+	})
+
+	Register(Factory{
+		Name:     "Optimizer",
+		Dialer:   optimizerDialer,
+		Listener: optimizerListener,
+		Generate: generateOptimizer,
+		Check:    checkOptimizer,
+	})
+
+	// The plain and loopback transports do not obfuscate anything. They are
+	// meant for testing and for telling transport problems from others.
+	Register(Factory{
+		Name:      "plain",
+		Dialer:    plainDialer,
+		Listener:  plainListener,
+		Check:     checkPlain,
+		Chainable: true,
+	})
+
+	Register(Factory{
+		Name:     "loopback",
+		Dialer:   loopbackDialer,
+		Listener: loopbackListener,
+		Check:    checkLoopback,
+	})
+
+	Register(Factory{
+		Name:      "chain",
+		Dialer:    chainDialer,
+		Listener:  chainListener,
+		Check:     checkChain,
+		Chainable: true,
+	})
+}
+
+// The dialers return a nil interface rather than a nil pointer when the
+// options cannot be parsed.
+
+func shadowDialer(options string, environment Environment) (Optimizer.TransportDialer, error) {
+	transport, err := ParseArgsShadow(options, environment.EnableLocket, environment.LogDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialShadow(transport, environment)
+}
+
+func shadowListener(options string, environment Environment) (func() (net.Listener, error), error) {
+	config, err := ParseArgsShadowServer(options, environment.EnableLocket, environment.LogDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return listenShadow(config, environment)
+}
+
+func replicantDialer(options string, environment Environment) (Optimizer.TransportDialer, error) {
+	transport, err := ParseArgsReplicantClient(options, environment.Dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialReplicant(transport, environment)
+}
+
+func replicantListener(options string, environment Environment) (func() (net.Listener, error), error) {
+	config, err := ParseArgsReplicantServer(options)
+	if err != nil {
+		return nil, errors.New("could not parse Replicant options")
+	}
+
+	return listenReplicant(config, environment)
+}
+
+func starbridgeDialer(options string, environment Environment) (Optimizer.TransportDialer, error) {
+	transport, err := ParseArgsStarbridgeClient(options, environment.Dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialStarbridge(transport, environment)
+}
+
+func starbridgeListener(options string, environment Environment) (func() (net.Listener, error), error) {
+	config, err := ParseArgsStarbridgeServer(options)
+	if err != nil {
+		return nil, errors.New("could not parse Starbridge options")
+	}
+
+	return listenStarbridge(config, environment)
+}
+
+func optimizerDialer(options string, environment Environment) (Optimizer.TransportDialer, error) {
+	transport, err := ParseArgsOptimizer(options, environment.Dialer, environment.EnableLocket, environment.LogDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,170 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+)
+
+// ChainConfig is the config of the chain transport, which carries each of
+// its transports inside the one before it. The first transport is the one
+// seen on the network and the last one carries the application data. The
+// client and the server list the same transports in the same order, each
+// with its client or server config.
+type ChainConfig struct {
+	Transports []ChainLayer `json:"transports"`
+}
+
+// ChainLayer is one of the transports of a chain.
+type ChainLayer struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+// chainLayers parses a chain config and checks that every transport after
+// the first can be carried inside another one.
+func chainLayers(options string) ([]ChainLayer, error) {
+	var config ChainConfig
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, errors.New("chain options json decoding error")
+	}
+
+	if len(config.Transports) == 0 {
+		return nil, errors.New("the chain config does not list any transports")
+	}
+
+	for index, layer := range config.Transports {
+		factory, ok := Default.Lookup(layer.Name)
+		if !ok {
+			return nil, fmt.Errorf("transport %d (%s): unknown transport", index+1, layer.Name)
+		}
+
+		if index > 0 && !factory.Chainable {
+			return nil, fmt.Errorf("transport %d (%s): cannot be carried inside another transport", index+1, layer.Name)
+		}
+	}
+
+	return config.Transports, nil
+}
+
+// layerDialer dials a transport of a chain through the one before it,
+// whatever address it is asked for.
+type layerDialer struct {
+	below Optimizer.TransportDialer
+}
+
+func (dialer layerDialer) Dial(_, _ string) (net.Conn, error) {
+	return dialer.below.Dial()
+}
+
+// chainDialer builds the clients of the transports in order, each of them
+// dialing through the one before it. The first one dials the server with the
+// Dialer of the environment.
+func chainDialer(options string, environment Environment) (Optimizer.TransportDialer, error) {
+	layers, err := chainLayers(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer Optimizer.TransportDialer
+	for index, layer := range layers {
+		layerEnvironment := environment
+		if index > 0 {
+			layerEnvironment.Dialer = layerDialer{dialer}
+		}
+
+		if dialer, err = Default.Dialer(layer.Name, string(layer.Config), layerEnvironment); err != nil {
+			return nil, fmt.Errorf("transport %d (%s): %s", index+1, layer.Name, err.Error())
+		}
+	}
+
+	return dialer, nil
+}
+
+// chainListener builds the servers of the transports in the same order. The
+// first one listens on the bindaddr and each of the others accepts its
+// connections from the one before it, so the connections are unwrapped in
+// the order they were wrapped in by the client.
+func chainListener(options string, environment Environment) (func() (net.Listener, error), error) {
+	layers, err := chainLayers(options)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, len(layers))
+	listens := make([]func() (net.Listener, error), len(layers))
+	for index, layer := range layers {
+		layerEnvironment := environment
+		if index > 0 {
+			below := &listeners[index-1]
+			layerEnvironment.ListenAddr = ""
+			layerEnvironment.Listen = func(string) (net.Listener, error) {
+				return *below, nil
+			}
+		}
+
+		if listens[index], err = Default.Listener(layer.Name, string(layer.Config), layerEnvironment); err != nil {
+			return nil, fmt.Errorf("transport %d (%s): %s", index+1, layer.Name, err.Error())
+		}
+	}
+
+	return func() (net.Listener, error) {
+		for index, listen := range listens {
+			listener, listenErr := listen()
+			if listenErr != nil {
+				// Closing a transport closes the ones below it.
+				if index > 0 {
+					_ = listeners[index-1].Close()
+				}
+
+				return nil, fmt.Errorf("transport %d (%s): %s", index+1, layers[index].Name, listenErr.Error())
+			}
+
+			listeners[index] = listener
+		}
+
+		return listeners[len(listeners)-1], nil
+	}, nil
+}
+
+func checkChain(options string, isClient bool) error {
+	layers, err := chainLayers(options)
+	if err != nil {
+		return err
+	}
+
+	for index, layer := range layers {
+		if err := CheckConfig(layer.Name, string(layer.Config), isClient); err != nil {
+			return fmt.Errorf("transport %d (%s): %s", index+1, layer.Name, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/polish"
+	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"golang.org/x/net/proxy"
+)
+
+// The keys in the config files are in the keychain format: a format byte
+// followed by the P-256 private scalar or the uncompressed public point. Every
+// transport reads them the same way, and DarkStar skips the format byte of a
+// private key.
+const (
+	keychainFormatByte = 2
+
+	keychainPublicKeySize  = 66
+	keychainPrivateKeySize = 33
+)
+
+// CheckConfig parses the options of the named transport the same way the
+// dispatcher does, in the client or server role, and checks that the
+// addresses and keys it contains are usable. It does not open any
+// connections.
+func CheckConfig(name string, options string, isClient bool) (checkError error) {
+	// Some of the transport libraries panic on options meant for another
+	// transport.
+	defer func() {
+		if panicError := recover(); panicError != nil {
+			checkError = fmt.Errorf("the options could not be parsed: %v", panicError)
+		}
+	}()
+
+	return Default.Check(name, options, isClient)
+}
+
+func checkShadow(options string, isClient bool) error {
+	if isClient {
+		config, err := ParseArgsShadow(options, false, "")
+		if err != nil {
+			return err
+		}
+
+		return checkShadowConfig(config.ServerAddress, config.CipherName, config.ServerKey, isClient)
+	}
+
+	config, err := ParseArgsShadowServer(options, false, "")
+	if err != nil {
+		return err
+	}
+
+	return checkShadowConfig(config.ServerAddress, config.CipherName, config.ServerPrivateKey, isClient)
+}
+
+func checkStarbridge(options string, isClient bool) error {
+	if isClient {
+		config, err := ParseArgsStarbridgeClient(options, proxy.Direct)
+		if err != nil {
+			return err
+		}
+
+		if err = checkServerAddress(config.Address); err != nil {
+			return err
+		}
+
+		return checkPublicKey("serverPublicKey", config.Config.ServerPublicKey)
+	}
+
+	config, err := ParseArgsStarbridgeServer(options)
+	if err != nil {
+		return err
+	}
+
+	if err = checkServerAddress(config.ServerAddress); err != nil {
+		return err
+	}
+
+	return checkPrivateKey("serverPrivateKey", config.ServerPrivateKey)
+}
+
+func checkReplicant(options string, isClient bool) error {
+	if isClient {
+		config, err := ParseArgsReplicantClient(options, proxy.Direct)
+		if err != nil {
+			return err
+		}
+
+		return checkReplicantClientConfig(config.Config)
+	}
+
+	config, err := ParseArgsReplicantServer(options)
+	if err != nil {
+		return err
+	}
+
+	return checkReplicantServerConfig(*config)
+}
+
+func checkOptimizer(options string, isClient bool) error {
+	if isClient {
+		if _, err := ParseArgsOptimizer(options, proxy.Direct, false, ""); err != nil {
+			return err
+		}
+	}
+
+	return checkOptimizerConfig(options, isClient)
+}
+
+func checkShadowConfig(serverAddress string, cipherName string, key string, isClient bool) error {
+	if err := checkServerAddress(serverAddress); err != nil {
+		return err
+	}
+
+	if strings.ToLower(cipherName) != "darkstar" {
+		return fmt.Errorf("unsupported cipherName %q, only DarkStar is supported", cipherName)
+	}
+
+	if isClient {
+		return checkPublicKey("serverPublicKey", key)
+	}
+
+	return checkPrivateKey("serverPrivateKey", key)
+}
+
+func checkReplicantClientConfig(config replicant.ClientConfig) error {
+	if err := checkServerAddress(config.ServerAddress); err != nil {
+		return err
+	}
+
+	switch polishConfig := config.Polish.(type) {
+	case polish.DarkStarPolishClientConfig:
+		return checkPublicKey("polish serverPublicKey", polishConfig.ServerPublicKey)
+	case *polish.DarkStarPolishClientConfig:
+		return checkPublicKey("polish serverPublicKey", polishConfig.ServerPublicKey)
+	}
+
+	return nil
+}
+
+func checkReplicantServerConfig(config replicant.ServerConfig) error {
+	if err := checkServerAddress(config.ServerAddress); err != nil {
+		return err
+	}
+
+	switch polishConfig := config.Polish.(type) {
+	case polish.DarkStarPolishServerConfig:
+		return checkPrivateKey("polish serverPrivateKey", polishConfig.ServerPrivateKey)
+	case *polish.DarkStarPolishServerConfig:
+		return checkPrivateKey("polish serverPrivateKey", polishConfig.ServerPrivateKey)
+	}
+
+	return nil
+}
+
+// checkOptimizerConfig checks every transport listed in an Optimizer config,
+// in the client or server role.
+func checkOptimizerConfig(options string, isClient bool) error {
+	listed, err := optimizerTransports(options)
+	if err != nil {
+		return err
+	}
+
+	if len(listed) == 0 {
+		return errors.New("the optimizer config does not list any transports")
+	}
+
+	for index, transport := range listed {
+		if err := CheckConfig(transport.Name, transport.Config, isClient); err != nil {
+			return fmt.Errorf("transport %d (%s): %s", index+1, transport.Name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkServerAddress checks that a host:port address can be resolved.
+func checkServerAddress(address string) error {
+	if address == "" {
+		return errors.New("serverAddress is missing")
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid serverAddress %q: %s", address, err.Error())
+	}
+
+	if _, err = net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid serverAddress %q: %s", address, err.Error())
+	}
+
+	if net.ParseIP(host) == nil {
+		if _, err = net.LookupHost(host); err != nil {
+			return fmt.Errorf("serverAddress %q cannot be resolved: %s", address, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func checkPublicKey(field string, key string) error {
+	if key == "" {
+		return fmt.Errorf("%s is missing", field)
+	}
+
+	keyBytes, decodeError := base64.StdEncoding.DecodeString(key)
+	if decodeError != nil {
+		return fmt.Errorf("%s is not valid base64: %s", field, decodeError.Error())
+	}
+
+	if len(keyBytes) != keychainPublicKeySize {
+		return fmt.Errorf("%s must be %d bytes long, found %d", field, keychainPublicKeySize, len(keyBytes))
+	}
+
+	if keyError := Starbridge.CheckPublicKey(darkstar.KeychainFormatBytesToPublicKey(keyBytes)); keyError != nil {
+		return fmt.Errorf("%s is not a valid P-256 public key: %s", field, keyError.Error())
+	}
+
+	return nil
+}
+
+// checkPrivateKey checks a base64 P-256 private key in the keychain format.
+func checkPrivateKey(field string, key string) error {
+	if key == "" {
+		return fmt.Errorf("%s is missing", field)
+	}
+
+	keyBytes, decodeError := base64.StdEncoding.DecodeString(key)
+	if decodeError != nil {
+		return fmt.Errorf("%s is not valid base64: %s", field, decodeError.Error())
+	}
+
+	if len(keyBytes) != keychainPrivateKeySize {
+		return fmt.Errorf("%s must be %d bytes long, found %d", field, keychainPrivateKeySize, len(keyBytes))
+	}
+
+	if !Starbridge.CheckPrivateKey(keyBytes[1:]) {
+		return fmt.Errorf("%s is not a valid P-256 private key", field)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/polish"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
+	"github.com/OperatorFoundation/Shadow-go/shadow/v3"
+	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	locketgo "github.com/OperatorFoundation/locket-go"
+	"golang.org/x/net/proxy"
+)
+
+// The transport libraries dial the serverAddress in their options directly.
+// The clients here dial it with the Dialer of the environment instead, which
+// may be an upstream proxy or the transport below in a chain, and run the
+// handshake of the transport on the connection.
+
+// transportClient dials the server and runs the client side of the transport
+// handshake on the connection.
+type transportClient struct {
+	address   string
+	dialer    proxy.Dialer
+	handshake func(conn net.Conn) (net.Conn, error)
+}
+
+func (client transportClient) Dial() (net.Conn, error) {
+	conn, err := client.dialer.Dial("tcp", client.address)
+	if err != nil {
+		return nil, err
+	}
+
+	transportConn, handshakeErr := client.handshake(conn)
+	if handshakeErr != nil {
+		_ = conn.Close()
+		return nil, handshakeErr
+	}
+
+	return transportConn, nil
+}
+
+func dialShadow(transport *shadow.Transport, environment Environment) (Optimizer.TransportDialer, error) {
+	if !strings.EqualFold(transport.CipherName, "darkstar") {
+		return nil, errors.New("invalid cipher name")
+	}
+
+	host, portString, err := net.SplitHostPort(transport.ServerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	return transportClient{transport.ServerAddress, environment.dialer(), func(conn net.Conn) (net.Conn, error) {
+		if transport.LogDir != nil {
+			locketConn, locketErr := locketgo.NewLocketConn(conn, *transport.LogDir, "ShadowClient")
+			if locketErr != nil {
+				return nil, locketErr
+			}
+			conn = locketConn
+		}
+
+		darkStarClient := darkstar.NewDarkStarClient(transport.ServerKey, host, port)
+		if darkStarClient == nil {
+			return nil, errors.New("failed to create a DarkStarClient with the provided password")
+		}
+
+		return darkStarClient.StreamConn(conn)
+	}}, nil
+}
+
+func dialReplicant(transport *replicant.TransportClient, environment Environment) (Optimizer.TransportDialer, error) {
+	config := transport.Config
+
+	return transportClient{transport.Address, environment.dialer(), func(conn net.Conn) (net.Conn, error) {
+		return replicant.NewClientConnection(conn, config)
+	}}, nil
+}
+
+func dialStarbridge(transport *Starbridge.TransportClient, environment Environment) (Optimizer.TransportDialer, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(transport.Config.ServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Starbridge.CheckPublicKey(darkstar.KeychainFormatBytesToPublicKey(keyBytes)); err != nil {
+		return nil, err
+	}
+
+	// Starbridge is Replicant with the Starburst SMTP toneburst and the
+	// DarkStar polish.
+	config := replicant.ClientConfig{
+		Toneburst: toneburst.StarburstConfig{Mode: "SMTPClient"},
+		Polish: polish.DarkStarPolishClientConfig{
+			ServerAddress:   transport.Address,
+			ServerPublicKey: transport.Config.ServerPublicKey,
+		},
+	}
+
+	return transportClient{transport.Address, environment.dialer(), func(conn net.Conn) (net.Conn, error) {
+		return Starbridge.NewClientConnection(config, conn)
+	}}, nil
+}
@@ -0,0 +1,270 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeGenerated returns the Generate function of a transport, which writes
+// the configs built by configs under the given name.
+func writeGenerated(name string, configs func(options GenerateOptions) (interface{}, interface{}, error)) func(options GenerateOptions) error {
+	return func(options GenerateOptions) error {
+		serverConfig, clientConfig, err := configs(options)
+		if err != nil {
+			return err
+		}
+
+		return writeConfigsWithURI(options, name, serverConfig, clientConfig)
+	}
+}
+
+// writeConfigsWithURI writes a generated pair of configs together with the
+// URI of the client config.
+func writeConfigsWithURI(options GenerateOptions, name string, serverConfig interface{}, clientConfig interface{}) error {
+	clientURI, err := EncodeURI(name, clientConfig)
+	if err != nil {
+		return err
+	}
+
+	return writeConfigs(options, name, serverConfig, clientConfig, clientURI)
+}
+
+// generateOptimizer writes an Optimizer bundle. Its client config lists
+// several transports, so it has no URI.
+func generateOptimizer(options GenerateOptions) error {
+	serverConfig, clientConfig, err := optimizerConfigs(options)
+	if err != nil {
+		return err
+	}
+
+	return writeConfigs(options, "Optimizer", serverConfig, clientConfig, "")
+}
+
+func shadowGeneratedConfigs(options GenerateOptions) (interface{}, interface{}, error) {
+	return shadowConfigs(options.ServerAddress, options.BindAddress)
+}
+
+func replicantGeneratedConfigs(options GenerateOptions) (interface{}, interface{}, error) {
+	return replicantConfigs(options.ServerAddress, options.Toneburst, options.Polish, options.BindAddress)
+}
+
+func starbridgeGeneratedConfigs(options GenerateOptions) (interface{}, interface{}, error) {
+	return starbridgeConfigs(options.ServerAddress, options.BindAddress)
+}
+
+// writeConfigs writes a generated pair of configs to <name>ServerConfig.json
+// and <name>ClientConfig.json in the output directory, and the client URI, if
+// any, to <name>ClientConfig.uri. With an output of "-" they are printed to
+// stdout as one JSON object with server, client and clientURI fields.
+// Existing files are only overwritten when forced.
+func writeConfigs(options GenerateOptions, name string, serverConfig interface{}, clientConfig interface{}, clientURI string) error {
+	if options.Output == "-" {
+		bundle := struct {
+			Server    interface{} `json:"server"`
+			Client    interface{} `json:"client"`
+			ClientURI string      `json:"clientURI,omitempty"`
+		}{serverConfig, clientConfig, clientURI}
+
+		// The URI is printed as it is, without its & escaped.
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(bundle)
+	}
+
+	serverJsonBytes, marshalError := json.MarshalIndent(serverConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	clientJsonBytes, marshalError := json.MarshalIndent(clientConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	serverPath := filepath.Join(options.Output, name+"ServerConfig.json")
+	clientPath := filepath.Join(options.Output, name+"ClientConfig.json")
+	uriPath := filepath.Join(options.Output, name+"ClientConfig.uri")
+
+	paths := []string{serverPath, clientPath}
+	if clientURI != "" {
+		paths = append(paths, uriPath)
+	}
+
+	// All of the files are checked first so that a refused overwrite does not
+	// leave a server config without its client config.
+	if !options.Force {
+		for _, configPath := range paths {
+			if _, statError := os.Stat(configPath); statError == nil {
+				return fmt.Errorf("%s already exists, use -force to overwrite it", configPath)
+			}
+		}
+	}
+
+	if options.Output != "" {
+		if mkdirError := os.MkdirAll(options.Output, 0700); mkdirError != nil {
+			return mkdirError
+		}
+	}
+
+	// The server config holds the private key.
+	if serverJsonError := writeConfigFile(serverPath, serverJsonBytes, 0600, options.Force); serverJsonError != nil {
+		return serverJsonError
+	}
+
+	if clientJsonError := writeConfigFile(clientPath, clientJsonBytes, 0644, options.Force); clientJsonError != nil {
+		return clientJsonError
+	}
+
+	if clientURI == "" {
+		return nil
+	}
+
+	return writeConfigFile(uriPath, []byte(clientURI+"\n"), 0644, options.Force)
+}
+
+// writeConfigFile writes a config file with the given permissions, failing if
+// it already exists unless forced.
+func writeConfigFile(configPath string, contents []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(configPath, flags, perm)
+	if err != nil {
+		return err
+	}
+
+	// A file that is overwritten keeps its old permissions otherwise.
+	if err = file.Chmod(perm); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if _, err = file.Write(contents); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// optimizerEntry is one transport of a generated Optimizer config.
+type optimizerEntry struct {
+	Name   string      `json:"name"`
+	Config interface{} `json:"config"`
+}
+
+// generatedOptimizerConfig is the format read by ParseArgsOptimizer on the
+// client and by the Optimizer server.
+type generatedOptimizerConfig struct {
+	Transports []optimizerEntry `json:"transports"`
+	Strategy   string           `json:"strategy"`
+}
+
+// optimizerConfigs generates the configs of every transport in the options.
+// The Optimizer server starts each transport on the address in its own
+// config, so the transports are given consecutive ports starting at the port
+// of the server address, and of the bind address if there is one.
+func optimizerConfigs(options GenerateOptions) (*generatedOptimizerConfig, *generatedOptimizerConfig, error) {
+	if len(options.Transports) == 0 {
+		return nil, nil, errors.New("an Optimizer config needs at least one transport")
+	}
+
+	if _, err := parseStrategy(options.Strategy, nil); err != nil {
+		return nil, nil, fmt.Errorf("invalid strategy %q, use first, random, rotate, track or minimizeDialDuration", options.Strategy)
+	}
+
+	serverAddresses, err := consecutiveAddresses("server address", options.ServerAddress, len(options.Transports))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var bindAddresses []string
+	if options.BindAddress != nil {
+		bindAddresses, err = consecutiveAddresses("bind address", *options.BindAddress, len(options.Transports))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	serverConfig := &generatedOptimizerConfig{Strategy: options.Strategy}
+	clientConfig := &generatedOptimizerConfig{Strategy: options.Strategy}
+	for index, name := range options.Transports {
+		factory, ok := Lookup(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown transport %q", name)
+		}
+		if factory.Configs == nil {
+			return nil, nil, fmt.Errorf("configs cannot be generated for %s inside an Optimizer config", factory.Name)
+		}
+
+		transportOptions := options
+		transportOptions.ServerAddress = serverAddresses[index]
+		if bindAddresses != nil {
+			transportOptions.BindAddress = &bindAddresses[index]
+		}
+
+		transportServer, transportClient, configsError := factory.Configs(transportOptions)
+		if configsError != nil {
+			return nil, nil, fmt.Errorf("transport %d (%s): %s", index+1, factory.Name, configsError.Error())
+		}
+
+		serverConfig.Transports = append(serverConfig.Transports, optimizerEntry{factory.Name, transportServer})
+		clientConfig.Transports = append(clientConfig.Transports, optimizerEntry{factory.Name, transportClient})
+	}
+
+	return serverConfig, clientConfig, nil
+}
+
+// consecutiveAddresses returns count addresses on the host of address, with
+// ports counting up from its port.
+func consecutiveAddresses(field string, address string, count int) ([]string, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %s", field, address, err.Error())
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port+count-1 > 65535 {
+		return nil, fmt.Errorf("the %s %q needs %d free ports starting at its port", field, address, count)
+	}
+
+	addresses := make([]string, count)
+	for index := range addresses {
+		addresses[index] = net.JoinHostPort(host, strconv.Itoa(port+index))
+	}
+
+	return addresses, nil
+}
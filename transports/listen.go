@@ -0,0 +1,350 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/polish"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
+	"github.com/OperatorFoundation/Shadow-go/shadow/v3"
+	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	locketgo "github.com/OperatorFoundation/locket-go"
+)
+
+// The transport libraries listen on the serverAddress in their options, which
+// is also the address the clients are given and, for DarkStar, part of the
+// handshake. The servers here open their own listener on the bindaddr instead
+// and run the handshake of the transport on each connection, so that the
+// listening address and the advertised one can differ, and so that a
+// transport can accept its connections from another one in a chain.
+
+// listenAddress decides where a transport server listens. The bindaddr wins
+// over the options, but a bindAddress in the options has to agree with it, and
+// without a bindAddress so does the port of the serverAddress. Without a
+// bindaddr, the server listens on its bindAddress or else its serverAddress.
+func listenAddress(serverAddress string, bindAddress *string, environment Environment) (string, error) {
+	hasBindAddress := bindAddress != nil && *bindAddress != ""
+
+	if environment.ListenAddr == "" {
+		if hasBindAddress {
+			return *bindAddress, nil
+		}
+
+		return serverAddress, nil
+	}
+
+	if hasBindAddress {
+		if !sameAddress(*bindAddress, environment.ListenAddr) {
+			return "", fmt.Errorf("the bindaddr %s conflicts with the bindAddress %s in the transport options", environment.ListenAddr, *bindAddress)
+		}
+	} else if !samePort(serverAddress, environment.ListenAddr) {
+		return "", fmt.Errorf("the bindaddr %s conflicts with the serverAddress %s in the transport options, set bindAddress in the options if the clients reach the server through another port", environment.ListenAddr, serverAddress)
+	}
+
+	return environment.ListenAddr, nil
+}
+
+func sameAddress(first string, second string) bool {
+	firstHost, _, firstErr := net.SplitHostPort(first)
+	secondHost, _, secondErr := net.SplitHostPort(second)
+	if firstErr != nil || secondErr != nil {
+		return first == second
+	}
+
+	firstIP, secondIP := net.ParseIP(firstHost), net.ParseIP(secondHost)
+	if firstIP != nil && secondIP != nil {
+		return firstIP.Equal(secondIP) && samePort(first, second)
+	}
+
+	return strings.EqualFold(firstHost, secondHost) && samePort(first, second)
+}
+
+// samePort reports whether a server listening on listenAddr can be reached on
+// the port of serverAddress. Port 0 could be any port. Addresses that cannot
+// be parsed are left for the transport to reject.
+func samePort(serverAddress string, listenAddr string) bool {
+	_, serverPort, serverErr := net.SplitHostPort(serverAddress)
+	_, listenPort, listenErr := net.SplitHostPort(listenAddr)
+	if serverErr != nil || listenErr != nil {
+		return true
+	}
+
+	return listenPort == "0" || serverPort == "0" || serverPort == listenPort
+}
+
+// serverListener accepts connections on a socket the dispatcher opened and
+// runs the server side of the transport handshake on each of them. Every
+// handshake runs in a goroutine of its own, so that a slow client does not
+// hold up the others, and gives up after the handshake timeout if there is
+// one.
+type serverListener struct {
+	net.Listener
+	handshake func(conn net.Conn) (net.Conn, error)
+	timeout   time.Duration
+	accepted  chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newServerListener(ln net.Listener, environment Environment, handshake func(conn net.Conn) (net.Conn, error)) *serverListener {
+	listener := &serverListener{
+		Listener:  ln,
+		handshake: handshake,
+		timeout:   environment.HandshakeTimeout,
+		accepted:  make(chan accepted),
+		done:      make(chan struct{}),
+	}
+
+	go listener.serve()
+
+	return listener
+}
+
+// serve accepts the connections from the socket and starts their handshakes,
+// until the socket fails or the listener is closed.
+func (listener *serverListener) serve() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err == nil {
+			go listener.shake(conn)
+			continue
+		}
+
+		select {
+		case listener.accepted <- accepted{nil, err}:
+		case <-listener.done:
+			return
+		}
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if netError, ok := err.(net.Error); ok && !netError.Temporary() {
+			return
+		}
+	}
+}
+
+// shake runs the handshake on one connection and hands the result to Accept.
+// The deadline only bounds the handshake, the transport connection is
+// returned without one.
+func (listener *serverListener) shake(conn net.Conn) {
+	if listener.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(listener.timeout))
+	}
+
+	transportConn, err := listener.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		transportConn = nil
+	} else {
+		if listener.timeout > 0 {
+			_ = conn.SetDeadline(time.Time{})
+		}
+		if transportConn.RemoteAddr() == nil {
+			transportConn = detachedConn{transportConn, conn}
+		}
+	}
+
+	select {
+	case listener.accepted <- accepted{transportConn, err}:
+	case <-listener.done:
+		if transportConn != nil {
+			_ = transportConn.Close()
+		}
+	}
+}
+
+// detachedConn is a transport connection that is not tied to its socket, such
+// as the black hole DarkStar gives a client that fails its handshake. The
+// socket stands in for its addresses and is closed with it.
+type detachedConn struct {
+	net.Conn
+	socket net.Conn
+}
+
+func (conn detachedConn) LocalAddr() net.Addr {
+	return conn.socket.LocalAddr()
+}
+
+func (conn detachedConn) RemoteAddr() net.Addr {
+	return conn.socket.RemoteAddr()
+}
+
+func (conn detachedConn) Close() error {
+	_ = conn.Conn.Close()
+	return conn.socket.Close()
+}
+
+func (listener *serverListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-listener.accepted:
+		return result.conn, result.err
+	case <-listener.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: listener.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (listener *serverListener) Close() error {
+	var closeError error
+	listener.closeOnce.Do(func() {
+		close(listener.done)
+		closeError = listener.Listener.Close()
+	})
+
+	return closeError
+}
+
+func checkTransportName(transport string, name string) error {
+	if !strings.EqualFold(transport, name) {
+		return errors.New("incorrect transport name")
+	}
+
+	return nil
+}
+
+func listenShadow(config *shadow.ServerConfig, environment Environment) (func() (net.Listener, error), error) {
+	address, err := listenAddress(config.ServerAddress, config.BindAddress, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (net.Listener, error) {
+		if nameErr := checkTransportName(config.Transport, "shadow"); nameErr != nil {
+			return nil, nameErr
+		}
+
+		if !strings.EqualFold(config.CipherName, "darkstar") {
+			return nil, errors.New("invalid cipher name")
+		}
+
+		// A key too short for DarkStar would only fail, or panic, once a
+		// client connects.
+		if keyErr := checkPrivateKey("serverPrivateKey", config.ServerPrivateKey); keyErr != nil {
+			return nil, keyErr
+		}
+
+		host, portString, splitErr := net.SplitHostPort(config.ServerAddress)
+		if splitErr != nil {
+			return nil, splitErr
+		}
+
+		port, portErr := strconv.Atoi(portString)
+		if portErr != nil {
+			return nil, portErr
+		}
+
+		ln, listenErr := environment.listen(address)
+		if listenErr != nil {
+			return nil, listenErr
+		}
+
+		// The DarkStar handshake is keyed to the serverAddress the clients
+		// know, like in ShadowListener, which runs it inside Accept.
+		return newServerListener(ln, environment, func(conn net.Conn) (net.Conn, error) {
+			if config.LogDir != nil {
+				locketConn, locketErr := locketgo.NewLocketConn(conn, *config.LogDir, "ShadowServer")
+				if locketErr != nil {
+					return nil, locketErr
+				}
+				conn = locketConn
+			}
+
+			server := darkstar.NewDarkStarServer(config.ServerPrivateKey, host, port)
+			if server == nil {
+				return nil, errors.New("failed to create a DarkStarServer with the provided key")
+			}
+
+			return server.StreamConn(conn)
+		}), nil
+	}, nil
+}
+
+func listenReplicant(config *replicant.ServerConfig, environment Environment) (func() (net.Listener, error), error) {
+	address, err := listenAddress(config.ServerAddress, config.BindAddress, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (net.Listener, error) {
+		if nameErr := checkTransportName(config.Transport, "replicant"); nameErr != nil {
+			return nil, nameErr
+		}
+
+		ln, listenErr := environment.listen(address)
+		if listenErr != nil {
+			return nil, listenErr
+		}
+
+		return newServerListener(ln, environment, func(conn net.Conn) (net.Conn, error) {
+			return replicant.NewServerConnection(conn, *config)
+		}), nil
+	}, nil
+}
+
+func listenStarbridge(config *Starbridge.ServerConfig, environment Environment) (func() (net.Listener, error), error) {
+	address, err := listenAddress(config.ServerAddress, config.BindAddress, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (net.Listener, error) {
+		if nameErr := checkTransportName(config.Transport, "starbridge"); nameErr != nil {
+			return nil, nameErr
+		}
+
+		if keyErr := checkPrivateKey("serverPrivateKey", config.ServerPrivateKey); keyErr != nil {
+			return nil, keyErr
+		}
+
+		// Starbridge is Replicant with the Starburst SMTP toneburst and the
+		// DarkStar polish, keyed to the serverAddress the clients know.
+		replicantConfig := replicant.ServerConfig{
+			Toneburst: toneburst.StarburstConfig{Mode: "SMTPServer"},
+			Polish: polish.DarkStarPolishServerConfig{
+				ServerAddress:    config.ServerAddress,
+				ServerPrivateKey: config.ServerPrivateKey,
+			},
+		}
+
+		ln, listenErr := environment.listen(address)
+		if listenErr != nil {
+			return nil, listenErr
+		}
+
+		return newServerListener(ln, environment, func(conn net.Conn) (net.Conn, error) {
+			return Starbridge.NewServerConnection(replicantConfig, conn)
+		}), nil
+	}, nil
+}
@@ -0,0 +1,157 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+)
+
+// The loopback transport connects a client and a server in the same process
+// with in-memory pipes instead of sockets. The serverAddress is only a name
+// that the client and the server share, and the bindaddr is ignored.
+
+// loopbackServers are the loopback servers of the process, by the name they
+// listen on.
+var loopbackServers = struct {
+	sync.Mutex
+	listeners map[string]*loopbackServer
+}{listeners: make(map[string]*loopbackServer)}
+
+// loopbackAddr is the name a loopback server listens on.
+type loopbackAddr string
+
+func (addr loopbackAddr) Network() string {
+	return "loopback"
+}
+
+func (addr loopbackAddr) String() string {
+	return string(addr)
+}
+
+type loopbackServer struct {
+	name      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func listenLoopback(name string) (net.Listener, error) {
+	loopbackServers.Lock()
+	defer loopbackServers.Unlock()
+
+	if _, ok := loopbackServers.listeners[name]; ok {
+		return nil, fmt.Errorf("a loopback server is already listening on %s", name)
+	}
+
+	server := &loopbackServer{name: name, conns: make(chan net.Conn), done: make(chan struct{})}
+	loopbackServers.listeners[name] = server
+
+	return server, nil
+}
+
+func (server *loopbackServer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-server.conns:
+		return conn, nil
+	case <-server.done:
+		return nil, &net.OpError{Op: "accept", Net: "loopback", Addr: server.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (server *loopbackServer) Close() error {
+	server.closeOnce.Do(func() {
+		loopbackServers.Lock()
+		if loopbackServers.listeners[server.name] == server {
+			delete(loopbackServers.listeners, server.name)
+		}
+		loopbackServers.Unlock()
+
+		close(server.done)
+	})
+
+	return nil
+}
+
+func (server *loopbackServer) Addr() net.Addr {
+	return loopbackAddr(server.name)
+}
+
+// loopbackClient connects to the loopback server with the same name. It
+// blocks until the server accepts the connection.
+type loopbackClient struct {
+	name string
+}
+
+func (client loopbackClient) Dial() (net.Conn, error) {
+	refused := &net.OpError{Op: "dial", Net: "loopback", Addr: loopbackAddr(client.name), Err: errors.New("no loopback server is listening")}
+
+	loopbackServers.Lock()
+	server := loopbackServers.listeners[client.name]
+	loopbackServers.Unlock()
+
+	if server == nil {
+		return nil, refused
+	}
+
+	clientConn, serverConn := net.Pipe()
+	select {
+	case server.conns <- serverConn:
+		return clientConn, nil
+	case <-server.done:
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+		return nil, refused
+	}
+}
+
+func loopbackDialer(options string, _ Environment) (Optimizer.TransportDialer, error) {
+	config, err := parsePlainConfig(options, "loopback")
+	if err != nil {
+		return nil, err
+	}
+
+	return loopbackClient{config.ServerAddress}, nil
+}
+
+func loopbackListener(options string, _ Environment) (func() (net.Listener, error), error) {
+	config, err := parsePlainConfig(options, "loopback")
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (net.Listener, error) {
+		return listenLoopback(config.ServerAddress)
+	}, nil
+}
+
+func checkLoopback(options string, _ bool) error {
+	_, err := parsePlainConfig(options, "loopback")
+	return err
+}
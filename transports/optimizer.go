@@ -0,0 +1,201 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// optimizerTransport is one of the transports listed in an Optimizer config,
+// with its own config as JSON.
+type optimizerTransport struct {
+	Name   string
+	Config string
+}
+
+// optimizerTransports returns the transports listed in an Optimizer config.
+func optimizerTransports(options string) ([]optimizerTransport, error) {
+	var config OptimizerConfig
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, errors.New("could not marshal optimizer config")
+	}
+
+	var result []optimizerTransport
+	for _, untypedOtc := range config.Transports {
+		otc, ok := untypedOtc.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("unsupported type for transport")
+		}
+
+		name, _ := otc["name"].(string)
+
+		// A client config can also be given as a URI.
+		if uri, isURI := otc["config"].(string); isURI {
+			result = append(result, optimizerTransport{name, uri})
+			continue
+		}
+
+		transportConfig, marshalError := json.Marshal(otc["config"])
+		if marshalError != nil {
+			return nil, errors.New("could not marshal Optimizer config")
+		}
+
+		result = append(result, optimizerTransport{name, string(transportConfig)})
+	}
+
+	return result, nil
+}
+
+// optimizerListener builds the server for an Optimizer client. Its options
+// have the same format as the client options, with the server config of each
+// transport in place of the client config, and every server is started with
+// the others, on the address in its own config rather than the bindaddr. The
+// strategy only matters to the client and is ignored.
+func optimizerListener(options string, environment Environment) (func() (net.Listener, error), error) {
+	servers, err := optimizerTransports(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("the optimizer config does not list any transports")
+	}
+
+	serverEnvironment := environment
+	serverEnvironment.ListenAddr = ""
+
+	listens := make([]func() (net.Listener, error), len(servers))
+	for index, server := range servers {
+		if listens[index], err = Default.Listener(server.Name, server.Config, serverEnvironment); err != nil {
+			return nil, fmt.Errorf("transport %d (%s): %s", index+1, server.Name, err.Error())
+		}
+	}
+
+	return func() (net.Listener, error) {
+		var listeners []net.Listener
+		for index, listen := range listens {
+			listener, listenError := listen()
+			if listenError != nil {
+				for _, started := range listeners {
+					_ = started.Close()
+				}
+
+				return nil, fmt.Errorf("%s: %s", servers[index].Name, listenError.Error())
+			}
+
+			log.With("transport", servers[index].Name, "addr", listener.Addr()).Infof("started an optimizer server")
+			listeners = append(listeners, listener)
+		}
+
+		return newMultiListener(listeners), nil
+	}, nil
+}
+
+// multiListener accepts the connections of several listeners as one.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan accepted
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	multi := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan accepted),
+		done:      make(chan struct{}),
+	}
+
+	for _, listener := range listeners {
+		go multi.serve(listener)
+	}
+
+	return multi
+}
+
+// serve hands the connections accepted by one of the listeners to Accept,
+// until the listener fails or the multiListener is closed.
+func (multi *multiListener) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+
+		select {
+		case multi.accepted <- accepted{conn, err}:
+		case <-multi.done:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		}
+
+		// A failed handshake only loses that one connection, so keep
+		// accepting unless the listener itself has stopped.
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if netError, ok := err.(net.Error); ok && !netError.Temporary() {
+			return
+		}
+	}
+}
+
+func (multi *multiListener) Accept() (net.Conn, error) {
+	select {
+	case result := <-multi.accepted:
+		return result.conn, result.err
+	case <-multi.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: multi.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (multi *multiListener) Close() error {
+	var closeError error
+	multi.closeOnce.Do(func() {
+		close(multi.done)
+		for _, listener := range multi.listeners {
+			if err := listener.Close(); err != nil && closeError == nil {
+				closeError = err
+			}
+		}
+	})
+
+	return closeError
+}
+
+// Addr returns the address of the first server.
+func (multi *multiListener) Addr() net.Addr {
+	return multi.listeners[0].Addr()
+}
@@ -0,0 +1,108 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"golang.org/x/net/proxy"
+)
+
+// PlainConfig is the config of the plain and loopback transports, on the
+// client and on the server. They do not obfuscate anything, so all they need
+// is the address of the server.
+type PlainConfig struct {
+	ServerAddress string  `json:"serverAddress"`
+	Transport     string  `json:"transport,omitempty"`
+	BindAddress   *string `json:"bindAddress,omitempty"`
+}
+
+// parsePlainConfig parses the options of the plain or loopback transport.
+// The transport name may be left out.
+func parsePlainConfig(options string, name string) (*PlainConfig, error) {
+	var config PlainConfig
+	if err := json.Unmarshal([]byte(options), &config); err != nil {
+		return nil, errors.New(name + " options json decoding error")
+	}
+
+	if config.Transport != "" && !strings.EqualFold(config.Transport, name) {
+		return nil, errors.New("incorrect transport name")
+	}
+
+	if config.ServerAddress == "" {
+		return nil, errors.New("serverAddress is missing")
+	}
+
+	return &config, nil
+}
+
+// plainClient connects to the server directly, or through the upstream proxy,
+// and passes the data through as it is.
+type plainClient struct {
+	address string
+	dialer  proxy.Dialer
+}
+
+func (client plainClient) Dial() (net.Conn, error) {
+	return client.dialer.Dial("tcp", client.address)
+}
+
+func plainDialer(options string, environment Environment) (Optimizer.TransportDialer, error) {
+	config, err := parsePlainConfig(options, "plain")
+	if err != nil {
+		return nil, err
+	}
+
+	return plainClient{config.ServerAddress, environment.dialer()}, nil
+}
+
+func plainListener(options string, environment Environment) (func() (net.Listener, error), error) {
+	config, err := parsePlainConfig(options, "plain")
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := listenAddress(config.ServerAddress, config.BindAddress, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (net.Listener, error) {
+		return environment.listen(address)
+	}, nil
+}
+
+func checkPlain(options string, _ bool) error {
+	config, err := parsePlainConfig(options, "plain")
+	if err != nil {
+		return err
+	}
+
+	return checkServerAddress(config.ServerAddress)
+}
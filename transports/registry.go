@@ -0,0 +1,322 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"golang.org/x/net/proxy"
+)
+
+// Environment is what the dispatcher provides to the transports it builds.
+type Environment struct {
+	// Dialer connects to the transport server, through the upstream proxy if
+	// there is one. Transports that open their own connections ignore it.
+	Dialer proxy.Dialer
+
+	// EnableLocket has the transport log its traffic with Locket in LogDir.
+	EnableLocket bool
+	LogDir       string
+
+	// ListenAddr is the bindaddr a server listens on, in place of the address
+	// in its options. Port 0 picks a free port. If it is empty, the server
+	// listens where its options say.
+	ListenAddr string
+
+	// Listen opens the listener a server accepts its connections from, on
+	// the given address. If it is nil, the server listens on TCP.
+	Listen func(address string) (net.Listener, error)
+
+	// HandshakeTimeout bounds the handshake of each connection a server
+	// accepts. Zero means no timeout.
+	HandshakeTimeout time.Duration
+}
+
+// dialer returns the Dialer of the environment, or a direct dialer if it has
+// none.
+func (environment Environment) dialer() proxy.Dialer {
+	if environment.Dialer == nil {
+		return proxy.Direct
+	}
+
+	return environment.Dialer
+}
+
+// listen opens the listener of a server with the Listen of the environment,
+// or on TCP if it has none.
+func (environment Environment) listen(address string) (net.Listener, error) {
+	if environment.Listen == nil {
+		return net.Listen("tcp", address)
+	}
+
+	return environment.Listen(address)
+}
+
+// GenerateOptions describes the configs to generate for a transport.
+type GenerateOptions struct {
+	// ServerAddress is the address the clients connect to.
+	ServerAddress string
+
+	// BindAddress, if not nil, is the address the server listens on when it
+	// is not ServerAddress.
+	BindAddress *string
+
+	// Toneburst and Polish add the Starburst toneburst and the DarkStar
+	// polish to the Replicant configs.
+	Toneburst bool
+	Polish    bool
+
+	// Transports and Strategy are the transports and the strategy of an
+	// Optimizer config.
+	Transports []string
+	Strategy   string
+
+	// Output is the directory the configs are written to, the current
+	// directory if empty, or "-" to write them to stdout.
+	Output string
+
+	// Force allows existing config files to be overwritten.
+	Force bool
+}
+
+// Factory builds the parts of a transport that the dispatcher uses. A
+// function is nil when the transport does not support that part, such as a
+// transport that only has a client.
+type Factory struct {
+	// Name is the name of the transport, which is matched without regard to
+	// case.
+	Name string
+
+	// Dialer builds the client of the transport from its options.
+	Dialer func(options string, environment Environment) (Optimizer.TransportDialer, error)
+
+	// Listener builds the function that starts the server of the transport
+	// from its options.
+	Listener func(options string, environment Environment) (func() (net.Listener, error), error)
+
+	// Generate writes a matching pair of server and client configs as
+	// described by GenerateOptions.Output.
+	Generate func(options GenerateOptions) error
+
+	// Configs returns a matching pair of server and client configs without
+	// writing them, so that the transport can be generated inside an
+	// Optimizer config.
+	Configs func(options GenerateOptions) (serverConfig interface{}, clientConfig interface{}, err error)
+
+	// Check checks the options of the client or the server without opening
+	// any connections. Without it, the options are only checked by building
+	// the client or the server.
+	Check func(options string, isClient bool) error
+
+	// Chainable is set when the client connects with Environment.Dialer and
+	// the server accepts from Environment.Listen, so that the transport can
+	// be carried inside another one in a chain.
+	Chainable bool
+}
+
+// Registry holds the transports the dispatcher can run.
+type Registry struct {
+	lock      sync.RWMutex
+	factories map[string]Factory
+	names     []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]Factory)}
+}
+
+// Default is the registry used by the dispatcher. The built-in transports
+// are registered in it, and other packages can add their own from an init
+// function with Register.
+var Default = NewRegistry()
+
+// Register adds a transport to the default registry. It panics if the
+// transport has no name or if one with the same name is already registered.
+func Register(factory Factory) {
+	if err := Default.Register(factory); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup returns the transport registered in the default registry under
+// name.
+func Lookup(name string) (Factory, bool) {
+	return Default.Lookup(name)
+}
+
+// Transports returns the names of the transports in the default registry, in
+// the order they were registered.
+func Transports() []string {
+	return Default.Names()
+}
+
+// Register adds a transport to the registry.
+func (registry *Registry) Register(factory Factory) error {
+	if factory.Name == "" {
+		return errors.New("a transport must have a name")
+	}
+
+	key := strings.ToLower(factory.Name)
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if _, ok := registry.factories[key]; ok {
+		return fmt.Errorf("transport %s is already registered", factory.Name)
+	}
+
+	registry.factories[key] = factory
+	registry.names = append(registry.names, factory.Name)
+
+	return nil
+}
+
+// Lookup returns the transport registered under name.
+func (registry *Registry) Lookup(name string) (Factory, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	factory, ok := registry.factories[strings.ToLower(name)]
+	return factory, ok
+}
+
+// Names returns the names of the registered transports, in the order they
+// were registered.
+func (registry *Registry) Names() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return append([]string(nil), registry.names...)
+}
+
+// Generators returns the names of the registered transports that can
+// generate configs, sorted.
+func (registry *Registry) Generators() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	var names []string
+	for _, name := range registry.names {
+		if registry.factories[strings.ToLower(name)].Generate != nil {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Dialer builds the client of the named transport. Its options can also be
+// given as a URI, as returned by EncodeURI.
+func (registry *Registry) Dialer(name string, options string, environment Environment) (Optimizer.TransportDialer, error) {
+	factory, err := registry.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if factory.Dialer == nil {
+		return nil, fmt.Errorf("%s can only be used by the server", factory.Name)
+	}
+
+	if options, err = clientOptions(factory, options); err != nil {
+		return nil, err
+	}
+
+	return factory.Dialer(options, environment)
+}
+
+// Listener builds the function that starts the server of the named
+// transport.
+func (registry *Registry) Listener(name string, options string, environment Environment) (func() (net.Listener, error), error) {
+	factory, err := registry.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if factory.Listener == nil {
+		return nil, fmt.Errorf("%s can only be used by the client", factory.Name)
+	}
+
+	return factory.Listener(options, environment)
+}
+
+// Generate writes the configs of the named transport.
+func (registry *Registry) Generate(name string, options GenerateOptions) error {
+	factory, err := registry.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if factory.Generate == nil {
+		return fmt.Errorf("configs cannot be generated for %s", factory.Name)
+	}
+
+	return factory.Generate(options)
+}
+
+// Check checks the options of the named transport in the client or server
+// role.
+func (registry *Registry) Check(name string, options string, isClient bool) error {
+	factory, err := registry.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if isClient {
+		if options, err = clientOptions(factory, options); err != nil {
+			return err
+		}
+	}
+
+	if factory.Check != nil {
+		return factory.Check(options, isClient)
+	}
+
+	// Without a check of its own, the options are checked by building the
+	// client or the server, which does not connect or listen.
+	if isClient {
+		_, err = registry.Dialer(name, options, Environment{Dialer: proxy.Direct})
+	} else {
+		_, err = registry.Listener(name, options, Environment{})
+	}
+
+	return err
+}
+
+func (registry *Registry) lookup(name string) (Factory, error) {
+	factory, ok := registry.Lookup(name)
+	if !ok {
+		return Factory{}, fmt.Errorf("unknown transport %s", name)
+	}
+
+	return factory, nil
+}
@@ -0,0 +1,867 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/aead/ecdh"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	dialError := errors.New("dial")
+	factory := Factory{
+		Name: "Test",
+		Dialer: func(options string, environment Environment) (Optimizer.TransportDialer, error) {
+			return nil, dialError
+		},
+	}
+
+	if err := registry.Register(factory); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if err := registry.Register(Factory{Name: "test"}); err == nil {
+		t.Error("registering a transport twice succeeded")
+	}
+	if err := registry.Register(Factory{}); err == nil {
+		t.Error("registering a transport without a name succeeded")
+	}
+
+	if found, ok := registry.Lookup("TEST"); !ok || found.Name != "Test" {
+		t.Errorf("Lookup(TEST) = %q, %v", found.Name, ok)
+	}
+	if names := registry.Names(); !reflect.DeepEqual(names, []string{"Test"}) {
+		t.Errorf("Names() = %v", names)
+	}
+
+	if _, err := registry.Dialer("test", "", Environment{}); err != dialError {
+		t.Errorf("Dialer returned %v", err)
+	}
+	if _, err := registry.Listener("test", "", Environment{}); err == nil {
+		t.Error("Listener succeeded for a client only transport")
+	}
+	if err := registry.Generate("test", GenerateOptions{}); err == nil {
+		t.Error("Generate succeeded for a transport without generation")
+	}
+	if err := registry.Check("test", "", true); err != dialError {
+		t.Errorf("Check without a check function returned %v", err)
+	}
+	if err := registry.Check("missing", "", true); err == nil {
+		t.Error("Check succeeded for an unknown transport")
+	}
+}
+
+func TestBuiltinTransports(t *testing.T) {
+	if names := Transports(); !reflect.DeepEqual(names, []string{"shadow", "Replicant", "Starbridge", "Optimizer", "plain", "loopback", "chain"}) {
+		t.Errorf("Transports() = %v", names)
+	}
+
+	if generators := Default.Generators(); !reflect.DeepEqual(generators, []string{"optimizer", "replicant", "shadow", "starbridge"}) {
+		t.Errorf("Generators() = %v", generators)
+	}
+
+	if _, err := Default.Listener("optimizer", `{"transports":[]}`, Environment{}); err == nil {
+		t.Error("Optimizer built a server without any transports")
+	}
+
+	listen, err := Default.Listener("shadow", `{"serverAddress":"127.0.0.1:0"}`, Environment{})
+	if err != nil || listen == nil {
+		t.Errorf("Listener(shadow) = %v", err)
+	}
+}
+
+func TestMultiListener(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	multi := newMultiListener(listeners)
+	for _, listener := range listeners {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		accepted, err := multi.Accept()
+		if err != nil {
+			t.Fatalf("Accept failed: %s", err)
+		}
+		if accepted.LocalAddr().String() != listener.Addr().String() {
+			t.Errorf("accepted a connection to %s, expected %s", accepted.LocalAddr(), listener.Addr())
+		}
+		accepted.Close()
+	}
+
+	if err := multi.Close(); err != nil {
+		t.Errorf("Close failed: %s", err)
+	}
+	if _, err := multi.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close returned %v", err)
+	}
+	if _, err := net.Dial("tcp", listeners[0].Addr().String()); err == nil {
+		t.Error("the listeners are still open")
+	}
+}
+
+// failingListener fails the first Accept the way a failed handshake does,
+// then accepts from the wrapped listener.
+type failingListener struct {
+	net.Listener
+	failed bool
+}
+
+func (listener *failingListener) Accept() (net.Conn, error) {
+	if !listener.failed {
+		listener.failed = true
+		return nil, errors.New("handshake failed")
+	}
+
+	return listener.Listener.Accept()
+}
+
+// readByteHandshake is a handshake that completes when the client sends a
+// byte.
+func readByteHandshake(conn net.Conn) (net.Conn, error) {
+	_, err := io.ReadFull(conn, make([]byte, 1))
+	return conn, err
+}
+
+// TestServerListener checks that a client that never completes its handshake
+// does not hold up the next one, that it is dropped after the handshake
+// timeout, and that the deadline is cleared once the handshake is done.
+func TestServerListener(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := newServerListener(socket, Environment{HandshakeTimeout: timeout}, readByteHandshake)
+	defer listener.Close()
+
+	slow, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	fast, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	if _, err := fast.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("expected the client that completed its handshake, got %s", err)
+	}
+	defer accepted.Close()
+
+	if accepted.RemoteAddr().String() != fast.LocalAddr().String() {
+		t.Errorf("expected the connection from %s, got %s", fast.LocalAddr(), accepted.RemoteAddr())
+	}
+
+	if _, err := listener.Accept(); err == nil {
+		t.Error("expected the handshake of the slow client to time out")
+	}
+
+	time.Sleep(timeout)
+	if _, err := fast.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); err != nil {
+		t.Errorf("expected no deadline after the handshake, got %s", err)
+	}
+
+	listener.Close()
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected Accept to fail after Close, got %v", err)
+	}
+}
+
+// The key pair of the Shadow configs in ConfigFiles.
+const (
+	shadowPrivateKey = "AtpykHwt9NAe2JZatzsixjjnAEuqn3xz06/GgRT/3hWK"
+	shadowPublicKey  = "AgRZf2QI7hJfOG2JCpDih3puKsZAeAPSq/hVFIcF/LAXwmoivFESJvtM00a7MJ5Qs95nsKUS9H27Wu8jfFYibJrY"
+)
+
+// TestShadowServerListener checks that a Shadow client that never sends its
+// half of the DarkStar handshake neither holds up the next client nor stays
+// connected for longer than the handshake timeout.
+func TestShadowServerListener(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+
+	listen, err := Default.Listener("shadow", `{"serverAddress":"127.0.0.1:2222","transport":"shadow","cipherName":"darkstar","serverPrivateKey":"`+shadowPrivateKey+`"}`, Environment{ListenAddr: "127.0.0.1:0", HandshakeTimeout: timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	silent, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	started := time.Now()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr == nil {
+				accepted <- conn
+				return
+			}
+			if errors.Is(acceptErr, net.ErrClosed) {
+				return
+			}
+		}
+	}()
+
+	// The second client only needs to send its half of the handshake for the
+	// server to finish its own, so its StreamConn is left waiting.
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go func() {
+		_, _ = darkstar.NewDarkStarClient(shadowPublicKey, "127.0.0.1", 2222).StreamConn(client)
+	}()
+
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		if elapsed := time.Since(started); elapsed >= timeout {
+			t.Errorf("expected the second client to be accepted before the silent one timed out, took %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second client to be accepted")
+	}
+
+	_ = silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = silent.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the silent client to be disconnected")
+	}
+	if elapsed := time.Since(started); elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("expected the silent client to be disconnected after the handshake timeout, took %s", elapsed)
+	}
+}
+
+// TestMultiListenerHandshakeError checks that a failed handshake on one
+// transport does not stop it from accepting the next connection.
+func TestMultiListenerHandshakeError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	multi := newMultiListener([]net.Listener{&failingListener{Listener: listener}})
+	defer multi.Close()
+
+	if _, err := multi.Accept(); err == nil {
+		t.Fatal("expected the handshake error from Accept")
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	accepted, err := multi.Accept()
+	if err != nil {
+		t.Fatalf("Accept after a handshake error failed: %s", err)
+	}
+	accepted.Close()
+}
+
+func TestListenAddress(t *testing.T) {
+	bindAddress := "0.0.0.0:2222"
+	otherBindAddress := "0.0.0.0:3333"
+
+	tests := []struct {
+		serverAddress string
+		bindAddress   *string
+		listenAddr    string
+		want          string
+	}{
+		{"203.0.113.1:2222", nil, "", "203.0.113.1:2222"},
+		{"203.0.113.1:2222", &bindAddress, "", "0.0.0.0:2222"},
+		{"203.0.113.1:2222", nil, "0.0.0.0:2222", "0.0.0.0:2222"},
+		{"203.0.113.1:2222", nil, "127.0.0.1:0", "127.0.0.1:0"},
+		{"203.0.113.1:2222", &bindAddress, "0.0.0.0:2222", "0.0.0.0:2222"},
+		{"203.0.113.1:2222", nil, "0.0.0.0:3333", ""},
+		{"203.0.113.1:3333", &bindAddress, "0.0.0.0:3333", ""},
+		{"203.0.113.1:2222", &otherBindAddress, "0.0.0.0:2222", ""},
+	}
+
+	for _, test := range tests {
+		got, err := listenAddress(test.serverAddress, test.bindAddress, Environment{ListenAddr: test.listenAddr})
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("listenAddress(%s, %v, %s) = %s, expected a conflict", test.serverAddress, test.bindAddress, test.listenAddr, got)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("listenAddress(%s, %v, %s) = %s, %v, expected %s", test.serverAddress, test.bindAddress, test.listenAddr, got, err, test.want)
+		}
+	}
+
+	listen, err := Default.Listener("shadow", `{"serverAddress":"203.0.113.1:2222","transport":"shadow","cipherName":"darkstar","serverPrivateKey":"`+shadowPrivateKey+`"}`, Environment{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("Listener(shadow) = %v", err)
+	}
+
+	listener, err := listen()
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	if addr, ok := listener.Addr().(*net.TCPAddr); !ok || addr.Port == 0 {
+		t.Errorf("the listener is on %v, expected the port it was given", listener.Addr())
+	}
+}
+
+// recordingDialer records the addresses it dials.
+type recordingDialer struct {
+	dialed []string
+}
+
+func (dialer *recordingDialer) Dial(network string, address string) (net.Conn, error) {
+	dialer.dialed = append(dialer.dialed, address)
+	return net.Dial(network, address)
+}
+
+func TestChain(t *testing.T) {
+	for _, options := range []string{
+		`{"transports":[]}`,
+		`{"transports":[{"name":"plain","config":{"serverAddress":"127.0.0.1:1"}},{"name":"loopback","config":{"serverAddress":"test"}}]}`,
+		`{"transports":[{"name":"nosuchtransport","config":{}}]}`,
+	} {
+		if _, err := Default.Dialer("chain", options, Environment{}); err == nil {
+			t.Errorf("chain accepted %s", options)
+		}
+	}
+
+	server := `{"transports":[{"name":"plain","config":{"serverAddress":"127.0.0.1:0"}},{"name":"plain","config":{"serverAddress":"192.0.2.1:2"}}]}`
+	listen, err := Default.Listener("chain", server, Environment{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("Listener(chain) = %v", err)
+	}
+
+	listener, err := listen()
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr == nil {
+			_, _ = io.Copy(conn, conn)
+			_ = conn.Close()
+		}
+	}()
+
+	outer := listener.Addr().String()
+	client := `{"transports":[{"name":"plain","config":{"serverAddress":"` + outer + `"}},{"name":"plain","config":{"serverAddress":"192.0.2.1:2"}}]}`
+	recorder := &recordingDialer{}
+	dialer, err := Default.Dialer("chain", client, Environment{Dialer: recorder})
+	if err != nil {
+		t.Fatalf("Dialer(chain) = %v", err)
+	}
+
+	conn, err := dialer.Dial()
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("chained")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 7)
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "chained" {
+		t.Errorf("received %q, %v", reply, err)
+	}
+
+	// Only the first transport goes to the network, the second one is
+	// carried inside it.
+	if !reflect.DeepEqual(recorder.dialed, []string{outer}) {
+		t.Errorf("dialed %v, expected only %s", recorder.dialed, outer)
+	}
+}
+
+// TestOptimizerConfigs tests that a generated Optimizer bundle gives each
+// transport its own port and that the client side is a valid config.
+func TestOptimizerConfigs(t *testing.T) {
+	for _, options := range []GenerateOptions{
+		{ServerAddress: "127.0.0.1:2222", Strategy: "first"},
+		{ServerAddress: "127.0.0.1:2222", Strategy: "best", Transports: []string{"shadow"}},
+		{ServerAddress: "127.0.0.1:2222", Strategy: "first", Transports: []string{"plain"}},
+		{ServerAddress: "127.0.0.1:65535", Strategy: "first", Transports: []string{"shadow", "Starbridge"}},
+	} {
+		if _, _, err := optimizerConfigs(options); err == nil {
+			t.Errorf("optimizerConfigs accepted %+v", options)
+		}
+	}
+
+	serverConfig, clientConfig, err := optimizerConfigs(GenerateOptions{
+		ServerAddress: "127.0.0.1:2222",
+		Strategy:      "rotate",
+		Transports:    []string{"shadow", "starbridge"},
+	})
+	if err != nil {
+		t.Fatalf("optimizerConfigs failed: %s", err)
+	}
+
+	clientJson, err := json.Marshal(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckConfig("Optimizer", string(clientJson), true); err != nil {
+		t.Errorf("the client config is not valid: %s", err)
+	}
+
+	serverJson, err := json.Marshal(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := optimizerTransports(string(serverJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"127.0.0.1:2222", "127.0.0.1:2223"}
+	if len(servers) != len(expected) {
+		t.Fatalf("the server config lists %d transports, expected %d", len(servers), len(expected))
+	}
+	for index, server := range servers {
+		var config struct {
+			ServerAddress string `json:"serverAddress"`
+		}
+		if err = json.Unmarshal([]byte(server.Config), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config.ServerAddress != expected[index] {
+			t.Errorf("transport %d (%s) is on %s, expected %s", index+1, server.Name, config.ServerAddress, expected[index])
+		}
+	}
+}
+
+// consecutiveFreeAddress returns a local address followed by count-1 more
+// ports that nothing was listening on.
+func consecutiveFreeAddress(t *testing.T, count int) string {
+	for attempt := 0; attempt < 20; attempt++ {
+		first, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listeners := []net.Listener{first}
+		port := first.Addr().(*net.TCPAddr).Port
+		for index := 1; index < count; index++ {
+			next, listenErr := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port+index)))
+			if listenErr != nil {
+				break
+			}
+			listeners = append(listeners, next)
+		}
+
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		if len(listeners) == count {
+			return first.Addr().String()
+		}
+	}
+
+	t.Fatalf("expected %d consecutive free ports", count)
+	return ""
+}
+
+// TestGeneratedOptimizerConfigs tests the round trip of a generated Optimizer
+// bundle: both sides pass the check, including the nested transports, each
+// nested client has the key of its server, the server starts every nested
+// server, and the client reaches it through the first transport.
+func TestGeneratedOptimizerConfigs(t *testing.T) {
+	options := GenerateOptions{
+		ServerAddress: consecutiveFreeAddress(t, 3),
+		Transports:    []string{"Replicant", "shadow", "Starbridge"},
+		Strategy:      "first",
+	}
+	serverConfig, clientConfig, err := optimizerConfigs(options)
+	if err != nil {
+		t.Fatalf("optimizerConfigs failed: %s", err)
+	}
+	serverJson, _ := json.Marshal(serverConfig)
+	clientJson, _ := json.Marshal(clientConfig)
+
+	if err = CheckConfig("Optimizer", string(serverJson), false); err != nil {
+		t.Errorf("the generated server bundle failed the check: %s", err)
+	}
+	if err = CheckConfig("Optimizer", string(clientJson), true); err != nil {
+		t.Errorf("the generated client bundle failed the check: %s", err)
+	}
+
+	servers, err := optimizerTransports(string(serverJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := optimizerTransports(string(clientJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 1; index < len(servers); index++ {
+		checkKeyPair(t, []byte(servers[index].Config), []byte(clients[index].Config))
+	}
+
+	// The Optimizer server only starts when every nested server does.
+	runGenerated(t, "Optimizer", serverJson, clientJson, false)
+}
+
+// TestWriteConfigs tests that generated configs are not overwritten unless
+// forced and that the server config, which holds the private key, can only be
+// read by its owner.
+func TestWriteConfigs(t *testing.T) {
+	options := GenerateOptions{ServerAddress: "127.0.0.1:2222", Output: filepath.Join(t.TempDir(), "configs")}
+	generate := writeGenerated("Shadow", shadowGeneratedConfigs)
+
+	if err := generate(options); err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+
+	if err := generate(options); err == nil {
+		t.Error("existing configs were overwritten without -force")
+	}
+
+	options.Force = true
+	if err := generate(options); err != nil {
+		t.Errorf("generate with force failed: %s", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(options.Output, "ShadowServerConfig.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("the server config has mode %o, expected 600", info.Mode().Perm())
+		}
+	}
+}
+
+// TestReplicantConfigs tests that Replicant configs can be generated and read
+// back with or without the toneburst and the polish.
+func TestReplicantConfigs(t *testing.T) {
+	for _, combination := range []struct{ toneburst, polish bool }{{false, false}, {true, false}, {false, true}, {true, true}} {
+		serverConfig, clientConfig, err := replicantConfigs("127.0.0.1:2222", combination.toneburst, combination.polish, nil)
+		if err != nil {
+			t.Fatalf("replicantConfigs%+v failed: %s", combination, err)
+		}
+
+		serverJson, _ := json.Marshal(serverConfig)
+		server, err := ParseArgsReplicantServer(string(serverJson))
+		if err != nil {
+			t.Fatalf("reading the server config %+v failed: %s", combination, err)
+		}
+
+		clientJson, _ := json.Marshal(clientConfig)
+		client, err := ParseArgsReplicantClient(string(clientJson), nil)
+		if err != nil {
+			t.Fatalf("reading the client config %+v failed: %s", combination, err)
+		}
+
+		if (server.Toneburst != nil) != combination.toneburst || (client.Config.Toneburst != nil) != combination.toneburst {
+			t.Errorf("the configs %+v have the wrong toneburst", combination)
+		}
+		if (server.Polish != nil) != combination.polish || (client.Config.Polish != nil) != combination.polish {
+			t.Errorf("the configs %+v have the wrong polish", combination)
+		}
+	}
+}
+
+// freeAddress returns a local address that nothing was listening on.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// handingDialer dials directly and also hands each connection to the test, so
+// that it can cut off a client whose handshake cannot finish.
+type handingDialer chan net.Conn
+
+func (dialer handingDialer) Dial(network string, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err == nil {
+		dialer <- conn
+	}
+
+	return conn, err
+}
+
+// checkKeyPair checks that the public key in a generated client config is the
+// key of the private key in its server config.
+func checkKeyPair(t *testing.T, serverJson []byte, clientJson []byte) {
+	var server, client struct {
+		ServerPrivateKey string `json:"serverPrivateKey"`
+		ServerPublicKey  string `json:"serverPublicKey"`
+		Polish           struct {
+			ServerPrivateKey string `json:"serverPrivateKey"`
+			ServerPublicKey  string `json:"serverPublicKey"`
+		} `json:"polish"`
+	}
+	if err := json.Unmarshal(serverJson, &server); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(clientJson, &client); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(server.ServerPrivateKey + server.Polish.ServerPrivateKey)
+	if err != nil || len(privateKey) != keychainPrivateKeySize || privateKey[0] != keychainFormatByte {
+		t.Fatalf("expected a private key in the keychain format, got %s", serverJson)
+	}
+
+	publicKey, err := darkstar.PublicKeyToKeychainFormatBytes(ecdh.Generic(elliptic.P256()).PublicKey(privateKey[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base64.StdEncoding.EncodeToString(publicKey) != client.ServerPublicKey+client.Polish.ServerPublicKey {
+		t.Errorf("expected the client config to have the public key of the server config, got %s and %s", serverJson, clientJson)
+	}
+}
+
+// runGenerated starts a server with its generated config and connects a client
+// to it with the other config. When the handshake can finish, data is sent
+// over the connection.
+func runGenerated(t *testing.T, name string, serverJson []byte, clientJson []byte, darkStar bool) {
+	listen, err := Default.Listener(name, string(serverJson), Environment{HandshakeTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("%s: the server config was refused: %s", name, err)
+	}
+	listener, err := listen()
+	if err != nil {
+		t.Fatalf("%s: the server did not start: %s", name, err)
+	}
+	defer listener.Close()
+
+	serverConns := make(chan net.Conn, 1)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr == nil {
+			serverConns <- conn
+		}
+	}()
+
+	clientConns := make(handingDialer, 1)
+	dialer, err := Default.Dialer(name, string(clientJson), Environment{Dialer: clientConns})
+	if err != nil {
+		t.Fatalf("%s: the client config was refused: %s", name, err)
+	}
+	dialed := make(chan accepted, 1)
+	go func() {
+		conn, dialErr := dialer.Dial()
+		dialed <- accepted{conn, dialErr}
+	}()
+
+	var serverConn net.Conn
+	select {
+	case serverConn = <-serverConns:
+		defer serverConn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: expected the server to accept the client", name)
+	}
+
+	if darkStar {
+		// The DarkStar client and server of the go-shadowsocks2 version in
+		// go.mod hash different encodings of the server key into the client
+		// confirmation code, so the handshake cannot finish. The server has
+		// taken the client's half of it with the generated keys, and the
+		// client is cut off.
+		(<-clientConns).Close()
+	}
+
+	var result accepted
+	select {
+	case result = <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: expected the client to connect", name)
+	}
+	if darkStar {
+		if result.conn != nil {
+			result.conn.Close()
+		}
+		return
+	}
+	if result.err != nil {
+		t.Fatalf("%s: the client failed to connect: %s", name, result.err)
+	}
+	defer result.conn.Close()
+
+	if _, err = result.conn.Write([]byte("generated")); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len("generated"))
+	_ = serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(serverConn, received); err != nil || string(received) != "generated" {
+		t.Errorf("%s: the server received %q, %v", name, received, err)
+	}
+}
+
+// TestGeneratedConfigs tests the round trip of generated configs: they pass
+// the check, the keys in the two configs belong together, and the server
+// starts with one and is reached by a client with the other.
+func TestGeneratedConfigs(t *testing.T) {
+	tests := []struct {
+		options  GenerateOptions
+		darkStar bool
+	}{
+		{GenerateOptions{Transports: []string{"shadow"}}, true},
+		{GenerateOptions{Transports: []string{"Starbridge"}}, true},
+		{GenerateOptions{Transports: []string{"Replicant"}}, false},
+		{GenerateOptions{Transports: []string{"Replicant"}, Toneburst: true}, false},
+		{GenerateOptions{Transports: []string{"Replicant"}, Polish: true}, true},
+		{GenerateOptions{Transports: []string{"Replicant"}, Toneburst: true, Polish: true}, true},
+	}
+
+	for _, test := range tests {
+		factory, ok := Lookup(test.options.Transports[0])
+		if !ok || factory.Configs == nil {
+			t.Fatalf("configs cannot be generated for %s", test.options.Transports[0])
+		}
+
+		test.options.ServerAddress = freeAddress(t)
+		serverConfig, clientConfig, err := factory.Configs(test.options)
+		if err != nil {
+			t.Fatalf("generating the %s configs failed: %s", factory.Name, err)
+		}
+		serverJson, _ := json.Marshal(serverConfig)
+		clientJson, _ := json.Marshal(clientConfig)
+
+		if err = CheckConfig(factory.Name, string(serverJson), false); err != nil {
+			t.Errorf("the generated %s server config failed the check: %s", factory.Name, err)
+		}
+		if err = CheckConfig(factory.Name, string(clientJson), true); err != nil {
+			t.Errorf("the generated %s client config failed the check: %s", factory.Name, err)
+		}
+		if test.darkStar {
+			checkKeyPair(t, serverJson, clientJson)
+		}
+
+		runGenerated(t, factory.Name, serverJson, clientJson, test.darkStar)
+	}
+}
+
+// TestURI tests that client configs survive being turned into URIs and back,
+// and that malformed URIs are rejected.
+func TestURI(t *testing.T) {
+	config := map[string]interface{}{
+		"serverAddress": "[2001:db8::1]:2222",
+		"transport":     "Replicant",
+		"toneburst":     map[string]interface{}{"mode": "SMTPClient"},
+		"polish":        map[string]interface{}{"serverPublicKey": "a+b/c=="},
+	}
+
+	uri, err := EncodeURI("Replicant", config)
+	if err != nil {
+		t.Fatalf("EncodeURI failed: %s", err)
+	}
+	if !IsURI(uri) {
+		t.Errorf("IsURI(%q) = false", uri)
+	}
+
+	name, options, err := DecodeURI(uri)
+	if err != nil {
+		t.Fatalf("DecodeURI(%q) failed: %s", uri, err)
+	}
+
+	var decoded map[string]interface{}
+	if err = json.Unmarshal([]byte(options), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if name != "replicant" || !reflect.DeepEqual(decoded, config) {
+		t.Errorf("DecodeURI(%q) = %s, %s", uri, name, options)
+	}
+
+	if _, err = EncodeURI("shadow", map[string]interface{}{"serverAddress": "127.0.0.1:1", "port": 1}); err == nil {
+		t.Error("EncodeURI accepted a number")
+	}
+
+	for _, bad := range []string{
+		"shadow://",
+		"shadow://127.0.0.1:1/path",
+		"shadow://127.0.0.1:1?a=1&a=2",
+		"shadow://127.0.0.1:1?a=1&a.b=2",
+		"shadow://127.0.0.1:1?serverAddress=127.0.0.1:2",
+	} {
+		if _, _, err = DecodeURI(bad); err == nil {
+			t.Errorf("DecodeURI accepted %q", bad)
+		}
+	}
+
+	if _, err = Default.Dialer("plain", "loopback://test", Environment{}); err == nil {
+		t.Error("plain accepted a loopback URI")
+	}
+	if _, err = Default.Dialer("plain", "plain://127.0.0.1:1", Environment{}); err != nil {
+		t.Errorf("plain did not accept its URI: %s", err)
+	}
+}
@@ -35,25 +35,20 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"os"
-	"strings"
+	"fmt"
 
 	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
 	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/polish"
 	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
 	"github.com/OperatorFoundation/Shadow-go/shadow/v3"
 	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
 	shadowsocks "github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/aead/ecdh"
-	"github.com/kataras/golog"
 	"golang.org/x/net/proxy"
 )
 
-// Transports returns the list of registered transport protocols.
-func Transports() []string {
-	return []string{"shadow", "Replicant", "Starbridge", "Optimizer"}
-}
-
 func ParseArgsShadow(args string, enableLocket bool, logDir string) (*shadow.Transport, error) {
 	var config shadow.ClientConfig
 
@@ -102,7 +97,7 @@ func CreateDefaultReplicantServer() replicant.ServerConfig {
 }
 
 func ParseArgsReplicantClient(args string, dialer proxy.Dialer) (*replicant.TransportClient, error) {
-	config, jsonError := replicant.UnmarshalClientConfig([]byte(args))
+	config, jsonError := unmarshalReplicantClientConfig([]byte(args))
 	if jsonError != nil {
 		return nil, jsonError
 	}
@@ -118,7 +113,7 @@ func ParseArgsReplicantClient(args string, dialer proxy.Dialer) (*replicant.Tran
 
 //  target string, dialer proxy.Dialer
 func ParseArgsReplicantServer(args string) (*replicant.ServerConfig, error) {
-	config, jsonError := replicant.UnmarshalServerConfig([]byte(args))
+	config, jsonError := unmarshalReplicantServerConfig([]byte(args))
 	if jsonError != nil {
 		return nil, jsonError
 	}
@@ -126,6 +121,63 @@ func ParseArgsReplicantServer(args string) (*replicant.ServerConfig, error) {
 	return config, nil
 }
 
+// unmarshalReplicantClientConfig reads a Replicant client config. The library
+// cannot read a config without a polish, turns a missing toneburst into one
+// with no mode, and strips one byte more from the polish key than DarkStar
+// expects, so the config is built here instead.
+func unmarshalReplicantClientConfig(data []byte) (*replicant.ClientConfig, error) {
+	var jsonConfig replicant.ClientJsonConfig
+	if jsonError := json.Unmarshal(data, &jsonConfig); jsonError != nil {
+		return nil, jsonError
+	}
+
+	config := &replicant.ClientConfig{
+		ServerAddress: jsonConfig.ServerAddress,
+		Transport:     jsonConfig.Transport,
+	}
+
+	if jsonConfig.Toneburst.Mode != "" {
+		config.Toneburst = jsonConfig.Toneburst
+	}
+
+	if jsonConfig.Polish.ServerPublicKey != "" {
+		config.Polish = polish.DarkStarPolishClientConfig{
+			ServerAddress:   jsonConfig.ServerAddress,
+			ServerPublicKey: jsonConfig.Polish.ServerPublicKey,
+		}
+	}
+
+	return config, nil
+}
+
+// unmarshalReplicantServerConfig reads a Replicant server config the same way,
+// leaving out the toneburst and the polish when the config has none.
+func unmarshalReplicantServerConfig(data []byte) (*replicant.ServerConfig, error) {
+	var jsonConfig replicant.ServerJsonConfig
+	if jsonError := json.Unmarshal(data, &jsonConfig); jsonError != nil {
+		return nil, jsonError
+	}
+
+	config := &replicant.ServerConfig{
+		ServerAddress: jsonConfig.ServerAddress,
+		Transport:     jsonConfig.Transport,
+		BindAddress:   jsonConfig.BindAddress,
+	}
+
+	if jsonConfig.Toneburst.Mode != "" {
+		config.Toneburst = jsonConfig.Toneburst
+	}
+
+	if jsonConfig.Polish.ServerPrivateKey != "" {
+		config.Polish = polish.DarkStarPolishServerConfig{
+			ServerAddress:    jsonConfig.ServerAddress,
+			ServerPrivateKey: jsonConfig.Polish.ServerPrivateKey,
+		}
+	}
+
+	return config, nil
+}
+
 func ParseArgsStarbridgeClient(args string, dialer proxy.Dialer) (*Starbridge.TransportClient, error) {
 	var config Starbridge.ClientConfig
 	bytes := []byte(args)
@@ -177,7 +229,7 @@ func ParseArgsOptimizer(jsonConfig string, dialer proxy.Dialer, enableLocket boo
 	}
 	transports, parseErr = parseTransports(config.Transports, dialer, enableLocket, logDir)
 	if parseErr != nil {
-		println("this is the returned error from parseTransports:", parseErr)
+		log.Debugf("could not parse the optimizer transports: %s", parseErr.Error())
 		return nil, errors.New("could not parse transports")
 	}
 
@@ -258,6 +310,10 @@ func parsedTransport(otc map[string]interface{}, dialer proxy.Dialer, enableLock
 	case map[string]interface{}:
 		config = untypedConfig.(map[string]interface{})
 
+	case string:
+		// The config is given as a URI.
+		return Default.Dialer(PartialConfig.Name, untypedConfig.(string), Environment{Dialer: dialer, EnableLocket: enableLocket, LogDir: logDir})
+
 	default:
 		return nil, errors.New("unsupported type for optimizer config option")
 	}
@@ -267,67 +323,60 @@ func parsedTransport(otc map[string]interface{}, dialer proxy.Dialer, enableLock
 		return nil, errors.New("could not marshal Optimizer config")
 	}
 	jsonConfigString := string(jsonConfigBytes)
-	switch strings.ToLower(PartialConfig.Name) {
-	case "shadow":
-		shadowTransport, parseErr := ParseArgsShadow(jsonConfigString, enableLocket, logDir)
-		if parseErr != nil {
-			return nil, errors.New("could not parse shadow Args")
-		}
-		return shadowTransport, nil
-	case "replicant":
-		replicantTransport, parseErr := ParseArgsReplicantClient(jsonConfigString, dialer)
-		if parseErr != nil {
-			return nil, errors.New("could not parse replicant Args")
-		}
-		return replicantTransport, nil
-	case "starbridge":
-		starbridgeTransport, parseErr := ParseArgsStarbridgeClient(jsonConfigString, dialer)
-		if parseErr != nil {
-			return nil, errors.New("could not parse starbridge Args")
-		}
-		return starbridgeTransport, nil
-	case "optimizer":
-		optimizerTransport, parseErr := ParseArgsOptimizer(jsonConfigString, dialer, enableLocket, logDir)
-		if parseErr != nil {
-			return nil, errors.New("could not parse Optimizer Args")
-		}
-		return optimizerTransport, nil
-	default:
-		println("unsupported transport name")
-		return nil, errors.New("unsupported transport name")
+	transport, parseErr := Default.Dialer(PartialConfig.Name, jsonConfigString, Environment{Dialer: dialer, EnableLocket: enableLocket, LogDir: logDir})
+	if parseErr != nil {
+		return nil, fmt.Errorf("could not parse %s Args: %s", PartialConfig.Name, parseErr.Error())
 	}
+
+	return transport, nil
 }
 
-func CreateShadowConfigs(address string, bindAddress *string) error {
+// generateKeyPair generates a P-256 key pair for DarkStar in the keychain
+// format of the config files: a format byte followed by the private scalar,
+// and a format byte followed by the uncompressed public point. The DarkStar
+// server skips the format byte of the private key.
+func generateKeyPair() (string, string, error) {
 	keyExchange := ecdh.Generic(elliptic.P256())
 
-	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+	privateKey, publicKey, keyError := keyExchange.GenerateKey(rand.Reader)
 	if keyError != nil {
-		return keyError
+		return "", "", keyError
 	}
 
-	point, ok := ephemeralPublicKey.(ecdh.Point)
+	privateKeyBytes, ok := privateKey.([]byte)
 	if !ok {
-		return errors.New("could not convert client public key to point")
+		return "", "", errors.New("could not convert private key to bytes")
 	}
 
-	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
-	if bytes == nil {
-		return errors.New("MarshalCompressed returned nil")
+	publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(publicKey)
+	if keyByteError != nil {
+		return "", "", keyByteError
 	}
 
-	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
-	if !ok {
-		return errors.New("could not convert private key to bytes")
-	}
+	privateKeyBytes = append([]byte{keychainFormatByte}, privateKeyBytes...)
 
-	publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
-	if keyByteError != nil {
-		return keyByteError
+	return base64.StdEncoding.EncodeToString(privateKeyBytes), base64.StdEncoding.EncodeToString(publicKeyBytes), nil
+}
+
+// CreateShadowConfigs writes new Shadow server and client configs and the
+// URI of the client config to the current directory, without overwriting
+// existing ones.
+func CreateShadowConfigs(address string, bindAddress *string) error {
+	serverConfig, clientConfig, err := shadowConfigs(address, bindAddress)
+	if err != nil {
+		return err
 	}
 
-	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
-	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
+	return writeConfigsWithURI(GenerateOptions{}, "Shadow", serverConfig, clientConfig)
+}
+
+// shadowConfigs generates a new key pair and returns the matching server and
+// client configs.
+func shadowConfigs(address string, bindAddress *string) (*shadow.ServerConfig, *shadow.ClientConfig, error) {
+	privateKeyString, publicKeyString, keyError := generateKeyPair()
+	if keyError != nil {
+		return nil, nil, keyError
+	}
 
 	shadowServerConfig := shadow.ServerConfig{
 		ServerAddress:    address,
@@ -337,11 +386,6 @@ func CreateShadowConfigs(address string, bindAddress *string) error {
 		BindAddress:      bindAddress,
 	}
 
-	serverJsonBytes, marshalError := json.MarshalIndent(shadowServerConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
 	shadowClientConfig := shadow.ClientConfig{
 		ServerAddress:   address,
 		ServerPublicKey: publicKeyString,
@@ -349,55 +393,29 @@ func CreateShadowConfigs(address string, bindAddress *string) error {
 		Transport:       "Shadow",
 	}
 
-	clientJsonBytes, marshalError := json.MarshalIndent(shadowClientConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	serverJsonError := os.WriteFile("ShadowServerConfig.json", serverJsonBytes, 0777)
-	if serverJsonError != nil {
-		return serverJsonError
-	}
-
-	clientJsonError := os.WriteFile("ShadowClientConfig.json", clientJsonBytes, 0777)
-	if clientJsonError != nil {
-		return clientJsonError
-	}
-
-	return nil
+	return &shadowServerConfig, &shadowClientConfig, nil
 }
 
+// CreateStarbridgeConfigs writes new Starbridge server and client configs and
+// the URI of the client config to the current directory, without overwriting
+// existing ones.
 func CreateStarbridgeConfigs(address string, bindAddress *string) error {
-	keyExchange := ecdh.Generic(elliptic.P256())
-
-	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
-	if keyError != nil {
-		return keyError
+	serverConfig, clientConfig, err := starbridgeConfigs(address, bindAddress)
+	if err != nil {
+		return err
 	}
 
-	point, ok := ephemeralPublicKey.(ecdh.Point)
-	if !ok {
-		return errors.New("could not convert client public key to point")
-	}
-
-	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
-	if bytes == nil {
-		return errors.New("MarshalCompressed returned nil")
-	}
-
-	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
-	if !ok {
-		return errors.New("could not convert private key to bytes")
-	}
+	return writeConfigsWithURI(GenerateOptions{}, "Starbridge", serverConfig, clientConfig)
+}
 
-	publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
-	if keyByteError != nil {
-		return keyByteError
+// starbridgeConfigs generates a new key pair and returns the matching server
+// and client configs.
+func starbridgeConfigs(address string, bindAddress *string) (*Starbridge.ServerConfig, *Starbridge.ClientConfig, error) {
+	privateKeyString, publicKeyString, keyError := generateKeyPair()
+	if keyError != nil {
+		return nil, nil, keyError
 	}
 
-	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
-	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
-
 	starbridgeClientConfig := Starbridge.ClientConfig{
 		ServerAddress:   address,
 		ServerPublicKey: publicKeyString,
@@ -411,132 +429,81 @@ func CreateStarbridgeConfigs(address string, bindAddress *string) error {
 		BindAddress:      bindAddress,
 	}
 
-	serverJsonBytes, marshalError := json.MarshalIndent(starbridgeServerConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	clientJsonBytes, marshalError := json.MarshalIndent(starbridgeClientConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	serverJsonError := os.WriteFile("StarbridgeServerConfig.json", serverJsonBytes, 0777)
-	if serverJsonError != nil {
-		return serverJsonError
-	}
+	return &starbridgeServerConfig, &starbridgeClientConfig, nil
+}
 
-	clientJsonError := os.WriteFile("StarbridgeClientConfig.json", clientJsonBytes, 0777)
-	if clientJsonError != nil {
-		return clientJsonError
+// CreateReplicantConfigs writes new Replicant server and client configs and the
+// URI of the client config to the current directory, without overwriting
+// existing ones.
+func CreateReplicantConfigs(address string, isToneburst bool, isPolish bool, bindAddress *string) error {
+	serverConfig, clientConfig, err := replicantConfigs(address, isToneburst, isPolish, bindAddress)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return writeConfigsWithURI(GenerateOptions{}, "Replicant", serverConfig, clientConfig)
 }
 
-func CreateReplicantConfigs(address string, isToneburst bool, isPolish bool, bindAddress *string) error {
-	var polishClient *replicant.DarkStarPolishClientJsonConfig = nil
-	var polishServer *replicant.DarkStarPolishServerJsonConfig = nil
-	var toneburstClient *toneburst.StarburstConfig = nil
-	var toneburstServer *toneburst.StarburstConfig = nil
-	if isPolish {
-		keyExchange := ecdh.Generic(elliptic.P256())
-
-		ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
-		if keyError != nil {
-			return keyError
-		}
+// replicantServerJsonConfig and replicantClientJsonConfig are the Replicant
+// config formats with the toneburst and the polish left out when they are not
+// used, which the types of the library cannot express.
+type replicantServerJsonConfig struct {
+	ServerAddress string                                    `json:"serverAddress"`
+	Toneburst     *toneburst.StarburstConfig                `json:"toneburst,omitempty"`
+	Polish        *replicant.DarkStarPolishServerJsonConfig `json:"polish,omitempty"`
+	Transport     string                                    `json:"transport"`
+	BindAddress   *string                                   `json:"bindAddress,omitempty"`
+}
 
-		point, ok := ephemeralPublicKey.(ecdh.Point)
-		if !ok {
-			return errors.New("could not convert client public key to point")
-		}
+type replicantClientJsonConfig struct {
+	ServerAddress string                                    `json:"serverAddress"`
+	Toneburst     *toneburst.StarburstConfig                `json:"toneburst,omitempty"`
+	Polish        *replicant.DarkStarPolishClientJsonConfig `json:"polish,omitempty"`
+	Transport     string                                    `json:"transport"`
+}
 
-		bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
-		if bytes == nil {
-			return errors.New("MarshalCompressed returned nil")
-		}
+// replicantConfigs returns matching Replicant server and client configs, with
+// a new key pair for the DarkStar polish if it is used.
+func replicantConfigs(address string, isToneburst bool, isPolish bool, bindAddress *string) (*replicantServerJsonConfig, *replicantClientJsonConfig, error) {
+	replicantServerConfig := replicantServerJsonConfig{
+		ServerAddress: address,
+		Transport:     "Replicant",
+		BindAddress:   bindAddress,
+	}
 
-		privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
-		if !ok {
-			return errors.New("could not convert private key to bytes")
-		}
+	replicantClientConfig := replicantClientJsonConfig{
+		ServerAddress: address,
+		Transport:     "Replicant",
+	}
 
-		publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
-		if keyByteError != nil {
-			return keyByteError
+	if isPolish {
+		privateKeyString, publicKeyString, keyError := generateKeyPair()
+		if keyError != nil {
+			return nil, nil, keyError
 		}
 
-		privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
-		publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
-
-		polishClient = &replicant.DarkStarPolishClientJsonConfig{
+		replicantClientConfig.Polish = &replicant.DarkStarPolishClientJsonConfig{
 			ServerAddress:   address,
 			ServerPublicKey: publicKeyString,
 		}
 
-		polishServer = &replicant.DarkStarPolishServerJsonConfig{
+		replicantServerConfig.Polish = &replicant.DarkStarPolishServerJsonConfig{
 			ServerAddress:    address,
 			ServerPrivateKey: privateKeyString,
 		}
-
-	} else {
-		golog.Info("Invalid polish name.  Setting value to nil")
-		polishClient = nil
-		polishServer = nil
 	}
 
 	if isToneburst {
-		toneburstClient = &toneburst.StarburstConfig{
+		replicantClientConfig.Toneburst = &toneburst.StarburstConfig{
 			Type: "starbridge",
 			Mode: "SMTPClient",
 		}
 
-		toneburstServer = &toneburst.StarburstConfig{
+		replicantServerConfig.Toneburst = &toneburst.StarburstConfig{
 			Type: "starbridge",
 			Mode: "SMTPServer",
 		}
-
-	} else {
-		golog.Info("Invalid toneburst name.  Setting value to nil")
-		toneburstClient = nil
-		toneburstServer = nil
-	}
-
-	replicantServerConfig := replicant.ServerJsonConfig{
-		ServerAddress: address,
-		Toneburst:     *toneburstServer,
-		Polish:        *polishServer,
-		Transport:     "Replicant",
-		BindAddress:   bindAddress,
-	}
-
-	replicantClientConfig := replicant.ClientJsonConfig{
-		ServerAddress: address,
-		Toneburst:     *toneburstClient,
-		Polish:        *polishClient,
-		Transport:     "Replicant",
-	}
-
-	serverJsonBytes, marshalError := json.MarshalIndent(replicantServerConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	clientJsonBytes, marshalError := json.MarshalIndent(replicantClientConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	serverJsonError := os.WriteFile("ReplicantServerConfig.json", serverJsonBytes, 0777)
-	if serverJsonError != nil {
-		return serverJsonError
-	}
-
-	clientJsonError := os.WriteFile("ReplicantClientConfig.json", clientJsonBytes, 0777)
-	if clientJsonError != nil {
-		return clientJsonError
 	}
 
-	return nil
+	return &replicantServerConfig, &replicantClientConfig, nil
 }
@@ -0,0 +1,184 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Client configs can be shared as URIs such as
+//
+//	shadow://203.0.113.1:2222?cipherName=darkstar&serverPublicKey=...
+//
+// The scheme is the name of the transport and the host is the serverAddress.
+// Every other field of the config is a query parameter, with the fields of
+// nested objects joined to their parent by a dot, as in polish.serverPublicKey.
+// Only configs whose fields are all strings can be put in a URI.
+
+// IsURI reports whether transport options are given as a URI rather than as
+// JSON.
+func IsURI(options string) bool {
+	options = strings.TrimSpace(options)
+	return !strings.HasPrefix(options, "{") && strings.Contains(options, "://")
+}
+
+// EncodeURI returns the URI of the client config of the named transport.
+func EncodeURI(name string, clientConfig interface{}) (string, error) {
+	configJson, err := json.Marshal(clientConfig)
+	if err != nil {
+		return "", err
+	}
+
+	var fields map[string]interface{}
+	if err = json.Unmarshal(configJson, &fields); err != nil {
+		return "", errors.New("only a JSON object can be put in a URI")
+	}
+
+	serverAddress, _ := fields["serverAddress"].(string)
+	if serverAddress == "" {
+		return "", errors.New("a config without a serverAddress cannot be put in a URI")
+	}
+	delete(fields, "serverAddress")
+
+	query := url.Values{}
+	if err = flattenURIFields("", fields, query); err != nil {
+		return "", err
+	}
+
+	uri := url.URL{
+		Scheme:   strings.ToLower(name),
+		Host:     serverAddress,
+		RawQuery: query.Encode(),
+	}
+
+	return uri.String(), nil
+}
+
+// flattenURIFields adds the fields of a config to the query, with the names
+// of nested fields prefixed.
+func flattenURIFields(prefix string, fields map[string]interface{}, query url.Values) error {
+	for key, value := range fields {
+		switch typedValue := value.(type) {
+		case nil:
+		case string:
+			query.Set(prefix+key, typedValue)
+		case map[string]interface{}:
+			if err := flattenURIFields(prefix+key+".", typedValue, query); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s%s is not a string and cannot be put in a URI", prefix, key)
+		}
+	}
+
+	return nil
+}
+
+// DecodeURI returns the transport name and the JSON client options of a URI.
+func DecodeURI(uri string) (name string, options string, err error) {
+	parsed, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid transport URI: %s", err.Error())
+	}
+
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return "", "", errors.New("invalid transport URI: it needs a transport name and a server address")
+	}
+	if (parsed.Path != "" && parsed.Path != "/") || parsed.Fragment != "" || parsed.User != nil {
+		return "", "", errors.New("invalid transport URI: only the server address and query parameters can be given")
+	}
+
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid transport URI: %s", err.Error())
+	}
+
+	fields := map[string]interface{}{"serverAddress": parsed.Host}
+
+	// The keys are sorted so that conflicting fields are always reported the
+	// same way.
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if len(query[key]) != 1 {
+			return "", "", fmt.Errorf("invalid transport URI: %s is given more than once", key)
+		}
+
+		parent := fields
+		path := strings.Split(key, ".")
+		for _, part := range path[:len(path)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				if _, taken := parent[part]; taken {
+					return "", "", fmt.Errorf("invalid transport URI: %s conflicts with another field", key)
+				}
+				child = map[string]interface{}{}
+				parent[part] = child
+			}
+			parent = child
+		}
+
+		last := path[len(path)-1]
+		if _, taken := parent[last]; taken {
+			return "", "", fmt.Errorf("invalid transport URI: %s conflicts with another field", key)
+		}
+		parent[last] = query[key][0]
+	}
+
+	optionsJson, err := json.Marshal(fields)
+	if err != nil {
+		return "", "", err
+	}
+
+	return parsed.Scheme, string(optionsJson), nil
+}
+
+// clientOptions returns the JSON options of a client of the transport, which
+// may also be given as a URI for it.
+func clientOptions(factory Factory, options string) (string, error) {
+	if !IsURI(options) {
+		return options, nil
+	}
+
+	name, decoded, err := DecodeURI(options)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.EqualFold(name, factory.Name) {
+		return "", fmt.Errorf("the URI is for %s, not %s", name, factory.Name)
+	}
+
+	return decoded, nil
+}